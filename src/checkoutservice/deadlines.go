@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRequestTimeout = 20 * time.Second
+
+	// minCallBudget is the least time worth starting a downstream call
+	// with. With less left of the request budget the call fails right away.
+	minCallBudget = 50 * time.Millisecond
+)
+
+// defaultDependencyTimeouts are the per-call timeouts of each downstream
+// service, keyed by the prefix of its address variable. Payment gets the
+// most since it talks to the card network.
+var defaultDependencyTimeouts = map[string]time.Duration{
+	"CART_SERVICE":            2 * time.Second,
+	"PRODUCT_CATALOG_SERVICE": 2 * time.Second,
+	"CURRENCY_SERVICE":        2 * time.Second,
+	"SHIPPING_SERVICE":        3 * time.Second,
+	"PAYMENT_SERVICE":         5 * time.Second,
+	"EMAIL_SERVICE":           3 * time.Second,
+}
+
+// deadlineBudget bounds how long checkout waits on its dependencies. Each
+// incoming call gets the request timeout, unless the caller's own deadline
+// is sooner, and each downstream call gets its service's timeout or what is
+// left of the request budget, whichever is less. gRPC passes the resulting
+// deadline on to the service called. A zero timeout means no limit.
+type deadlineBudget struct {
+	request  time.Duration
+	services map[string]time.Duration
+}
+
+// loadDeadlineBudget reads the budget from REQUEST_TIMEOUT and from
+// <SERVICE>_TIMEOUT for each dependency, e.g. PAYMENT_SERVICE_TIMEOUT.
+func loadDeadlineBudget() (*deadlineBudget, error) {
+	b := &deadlineBudget{request: defaultRequestTimeout, services: make(map[string]time.Duration)}
+	if err := parseTimeoutEnv("REQUEST_TIMEOUT", &b.request); err != nil {
+		return nil, err
+	}
+	for service, timeout := range defaultDependencyTimeouts {
+		if err := parseTimeoutEnv(service+"_TIMEOUT", &timeout); err != nil {
+			return nil, err
+		}
+		b.services[service] = timeout
+	}
+	return b, nil
+}
+
+func parseTimeoutEnv(env string, target *time.Duration) error {
+	s := os.Getenv(env)
+	if s == "" {
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s (%s) as time.Duration: %w", env, s, err)
+	}
+	if v < 0 {
+		return fmt.Errorf("%s must not be negative", env)
+	}
+	*target = v
+	return nil
+}
+
+// unaryServerInterceptor bounds each incoming call by the request timeout.
+func (b *deadlineBudget) unaryServerInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if b.request > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.request)
+		defer cancel()
+	}
+	return handler(ctx, req)
+}
+
+// dialOption bounds the calls made on a connection to service by its
+// timeout and by the remaining budget of the calling request.
+func (b *deadlineBudget) dialOption(service string) grpc.DialOption {
+	timeout := b.services[service]
+	return grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if deadline, ok := ctx.Deadline(); ok {
+			if left := time.Until(deadline); left < minCallBudget {
+				return status.Errorf(codes.DeadlineExceeded, "%s: only %v left of the request budget", method, left.Round(time.Millisecond))
+			}
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+}
+
+// errorStatus is status.Errorf with code c, except that errors caused by a
+// spent deadline or a cancelled call keep the DeadlineExceeded or Canceled
+// code, so that callers can tell them apart from failures.
+func errorStatus(c codes.Code, err error, format string, a ...any) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded:
+		c = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled:
+		c = codes.Canceled
+	}
+	return status.Errorf(c, format, a...)
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoadDeadlineBudget(t *testing.T) {
+	t.Setenv("REQUEST_TIMEOUT", "7s")
+	t.Setenv("PAYMENT_SERVICE_TIMEOUT", "0")
+	b, err := loadDeadlineBudget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.request != 7*time.Second {
+		t.Errorf("got a request timeout of %v, want 7s", b.request)
+	}
+	if got := b.services["PAYMENT_SERVICE"]; got != 0 {
+		t.Errorf("got a payment timeout of %v, want none", got)
+	}
+	if got, want := b.services["CART_SERVICE"], defaultDependencyTimeouts["CART_SERVICE"]; got != want {
+		t.Errorf("got a cart timeout of %v, want the default %v", got, want)
+	}
+
+	for _, v := range []string{"soon", "-1s"} {
+		t.Setenv("SHIPPING_SERVICE_TIMEOUT", v)
+		if _, err := loadDeadlineBudget(); err == nil {
+			t.Errorf("SHIPPING_SERVICE_TIMEOUT=%s: got no error", v)
+		}
+	}
+}
+
+// testBudget allows catalog calls timeout each.
+func testBudget(timeout time.Duration) *deadlineBudget {
+	return &deadlineBudget{request: time.Minute, services: map[string]time.Duration{"PRODUCT_CATALOG_SERVICE": timeout}}
+}
+
+// blockingCatalog answers no GetProduct call before its deadline, and
+// records the deadline it was given.
+func blockingCatalog(deadlines chan<- time.Duration) *fakeCatalog {
+	return &fakeCatalog{getProduct: func(ctx context.Context, id string) error {
+		if d, ok := ctx.Deadline(); ok {
+			deadlines <- time.Until(d)
+		} else {
+			deadlines <- 0
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+}
+
+func TestDependencyTimeout(t *testing.T) {
+	deadlines := make(chan time.Duration, 1)
+	cs := testCheckoutService(t, blockingCatalog(deadlines), testBudget(50*time.Millisecond).dialOption("PRODUCT_CATALOG_SERVICE"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).GetProduct(ctx, &pb.GetProductRequest{Id: "A"})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	if d := <-deadlines; d <= 0 || d > 50*time.Millisecond {
+		t.Errorf("the catalog got %v to answer, want at most the 50ms timeout", d)
+	}
+}
+
+func TestRemainingBudgetPropagates(t *testing.T) {
+	deadlines := make(chan time.Duration, 1)
+	cs := testCheckoutService(t, blockingCatalog(deadlines), testBudget(time.Minute).dialOption("PRODUCT_CATALOG_SERVICE"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).GetProduct(ctx, &pb.GetProductRequest{Id: "A"})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	if d := <-deadlines; d <= 0 || d > 200*time.Millisecond {
+		t.Errorf("the catalog got %v to answer, want at most the 200ms left of the request", d)
+	}
+}
+
+func TestSpentBudgetFailsFast(t *testing.T) {
+	fake := &fakeCatalog{}
+	cs := testCheckoutService(t, fake, testBudget(time.Minute).dialOption("PRODUCT_CATALOG_SERVICE"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), minCallBudget/2)
+	defer cancel()
+	_, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).GetProduct(ctx, &pb.GetProductRequest{Id: "A"})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	if len(fake.lookups) != 0 {
+		t.Errorf("the catalog was called with %v of budget left", minCallBudget/2)
+	}
+}
+
+func TestApplyPromotionsDeadlineExceeded(t *testing.T) {
+	deadlines := make(chan time.Duration, 1)
+	budget := testBudget(50 * time.Millisecond)
+	cs := testCheckoutService(t, blockingCatalog(deadlines), budget.dialOption("PRODUCT_CATALOG_SERVICE"))
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/hipstershop.CheckoutService/ApplyPromotions"}
+	_, err := budget.unaryServerInterceptor(context.Background(), &pb.ApplyPromotionsRequest{
+		Items: []*pb.CartItem{{ProductId: "A", Quantity: 1}}}, info,
+		func(ctx context.Context, req any) (any, error) {
+			return cs.ApplyPromotions(ctx, req.(*pb.ApplyPromotionsRequest))
+		})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want codes.Code
+	}{
+		{fmt.Errorf("failed: %w", status.Error(codes.DeadlineExceeded, "too slow")), codes.DeadlineExceeded},
+		{fmt.Errorf("failed: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{fmt.Errorf("failed: %w", status.Error(codes.Canceled, "gone")), codes.Canceled},
+		{fmt.Errorf("failed: %w", status.Error(codes.NotFound, "no such product")), codes.Internal},
+		{fmt.Errorf("failed"), codes.Internal},
+	} {
+		if got := status.Code(errorStatus(codes.Internal, tc.err, "%v", tc.err)); got != tc.want {
+			t.Errorf("errorStatus(Internal, %v) has code %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+const (
+	idempotencyMaxKeys = 10000
+	idempotencyTTL     = 24 * time.Hour
+)
+
+// idempotencyEntry is the outcome of one PlaceOrder call. done is closed once
+// resp/err are set.
+type idempotencyEntry struct {
+	key     string
+	done    chan struct{}
+	resp    *pb.PlaceOrderResponse
+	err     error
+	created time.Time
+}
+
+// idempotencyStore remembers the result of recent PlaceOrder calls by
+// idempotency key. It is bounded both in size (least recently used keys are
+// evicted first) and in time.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	maxKeys int
+	ttl     time.Duration
+	timeout time.Duration
+	lru     *list.List // of *idempotencyEntry, most recent at the front
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+// newIdempotencyStore returns a store of up to maxKeys results, each kept for
+// ttl. Calls are given timeout to finish; zero means no limit.
+func newIdempotencyStore(maxKeys int, ttl, timeout time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		maxKeys: maxKeys,
+		ttl:     ttl,
+		timeout: timeout,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// do runs fn at most once per key. Concurrent callers with the same key wait
+// for the first call and share its result; later callers get the stored
+// result back. Failed calls are forgotten so that the client can retry them.
+// A caller that gives up gets the gRPC status for ctx's error.
+//
+// fn is not cancelled with ctx: a client that gives up half way through an
+// order would otherwise leave it to be compensated, and its retry would
+// start a second one. fn runs on its own, bounded by the store's timeout,
+// and a retry with the same key waits for it.
+func (s *idempotencyStore) do(ctx context.Context, key string, fn func(context.Context) (*pb.PlaceOrderResponse, error)) (*pb.PlaceOrderResponse, error) {
+	s.mu.Lock()
+	if el, ok := s.entries[key]; ok {
+		e := el.Value.(*idempotencyEntry)
+		if s.now().Sub(e.created) < s.ttl {
+			s.lru.MoveToFront(el)
+			s.mu.Unlock()
+			select {
+			case <-e.done:
+				return e.resp, e.err
+			case <-ctx.Done():
+				return nil, status.FromContextError(ctx.Err()).Err()
+			}
+		}
+		s.removeLocked(el)
+	}
+	e := &idempotencyEntry{key: key, done: make(chan struct{}), created: s.now()}
+	s.entries[key] = s.lru.PushFront(e)
+	s.evictLocked()
+	s.mu.Unlock()
+
+	go s.run(ctx, e, fn)
+	select {
+	case <-e.done:
+		return e.resp, e.err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// run calls fn for e on a context detached from ctx's cancellation.
+func (s *idempotencyStore) run(ctx context.Context, e *idempotencyEntry, fn func(context.Context) (*pb.PlaceOrderResponse, error)) {
+	ctx = context.WithoutCancel(ctx)
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	e.resp, e.err = fn(ctx)
+	if e.err != nil {
+		s.mu.Lock()
+		if el, ok := s.entries[e.key]; ok && el.Value == e {
+			s.removeLocked(el)
+		}
+		s.mu.Unlock()
+	}
+	close(e.done)
+}
+
+func (s *idempotencyStore) evictLocked() {
+	for s.lru.Len() > s.maxKeys {
+		s.removeLocked(s.lru.Back())
+	}
+}
+
+func (s *idempotencyStore) removeLocked(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*idempotencyEntry).key)
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+func countingOrder(calls *int32, err error) func(context.Context) (*pb.PlaceOrderResponse, error) {
+	return func(context.Context) (*pb.PlaceOrderResponse, error) {
+		n := atomic.AddInt32(calls, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.PlaceOrderResponse{Order: &pb.OrderResult{OrderId: fmt.Sprintf("order-%d", n)}}, nil
+	}
+}
+
+func TestIdempotencyReturnsOriginalOrder(t *testing.T) {
+	s := newIdempotencyStore(10, time.Hour, time.Minute)
+	var calls int32
+	first, err := s.do(context.Background(), "k", countingOrder(&calls, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.do(context.Background(), "k", countingOrder(&calls, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+	if got, want := second.GetOrder().GetOrderId(), first.GetOrder().GetOrderId(); got != want {
+		t.Errorf("got order %s, want %s", got, want)
+	}
+}
+
+func TestIdempotencyConcurrentDuplicates(t *testing.T) {
+	s := newIdempotencyStore(10, time.Hour, time.Minute)
+	var calls int32
+	release := make(chan struct{})
+	slow := func(ctx context.Context) (*pb.PlaceOrderResponse, error) {
+		<-release
+		return countingOrder(&calls, nil)(ctx)
+	}
+
+	var wg sync.WaitGroup
+	ids := make([]string, 5)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := s.do(context.Background(), "k", slow)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = resp.GetOrder().GetOrderId()
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("got order ids %v, want all equal", ids)
+			break
+		}
+	}
+}
+
+func TestIdempotencyReportsCallerDeadline(t *testing.T) {
+	s := newIdempotencyStore(10, time.Hour, time.Minute)
+	release := make(chan struct{})
+	defer close(release)
+	wait := func(context.Context) (*pb.PlaceOrderResponse, error) {
+		<-release
+		return &pb.PlaceOrderResponse{}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.do(ctx, "k", wait); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want a DeadlineExceeded status", err)
+	}
+	// A retry that gives up while waiting for the first call gets the same.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.do(ctx, "k", wait); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("retry got %v, want a DeadlineExceeded status", err)
+	}
+}
+
+func TestIdempotencyOutlivesCancelledCaller(t *testing.T) {
+	s := newIdempotencyStore(10, time.Hour, time.Minute)
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+	var fnErr error
+	slow := func(ctx context.Context) (*pb.PlaceOrderResponse, error) {
+		close(started)
+		<-release
+		if fnErr = ctx.Err(); fnErr != nil {
+			return nil, fnErr
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			return nil, errors.New("no deadline")
+		}
+		return countingOrder(&calls, nil)(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := s.do(ctx, "k", slow); status.Code(err) != codes.Canceled {
+		t.Fatalf("got %v, want a Canceled status", err)
+	}
+
+	// The retry waits for the order the cancelled call started.
+	close(release)
+	resp, err := s.do(context.Background(), "k", countingOrder(&calls, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fnErr != nil {
+		t.Errorf("order was cancelled with its caller: %v", fnErr)
+	}
+	if calls != 1 || resp.GetOrder().GetOrderId() != "order-1" {
+		t.Errorf("got order %q after %d calls, want order-1 after 1", resp.GetOrder().GetOrderId(), calls)
+	}
+}
+
+func TestIdempotencyForgetsTimedOutCalls(t *testing.T) {
+	s := newIdempotencyStore(10, time.Hour, time.Millisecond)
+	var calls int32
+	wait := func(ctx context.Context) (*pb.PlaceOrderResponse, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if _, err := s.do(context.Background(), "k", wait); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := s.do(context.Background(), "k", countingOrder(&calls, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+}
+
+func TestIdempotencyForgetsFailures(t *testing.T) {
+	s := newIdempotencyStore(10, time.Hour, time.Minute)
+	var calls int32
+	if _, err := s.do(context.Background(), "k", countingOrder(&calls, errors.New("declined"))); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := s.do(context.Background(), "k", countingOrder(&calls, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2", calls)
+	}
+}
+
+func TestIdempotencyBounds(t *testing.T) {
+	s := newIdempotencyStore(2, time.Hour, time.Minute)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	var calls int32
+	for _, k := range []string{"a", "b", "c"} {
+		s.do(context.Background(), k, countingOrder(&calls, nil))
+	}
+	if got, want := s.lru.Len(), 2; got != want {
+		t.Errorf("got %d keys, want %d", got, want)
+	}
+
+	// "a" was evicted, "b" expires.
+	now = now.Add(2 * time.Hour)
+	s.do(context.Background(), "a", countingOrder(&calls, nil))
+	s.do(context.Background(), "b", countingOrder(&calls, nil))
+	if calls != 5 {
+		t.Errorf("got %d calls, want 5", calls)
+	}
+}
@@ -19,6 +19,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/profiler"
@@ -29,20 +32,28 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
-	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/grpcclient"
+	money "github.com/GoogleCloudPlatform/microservices-demo/src/shared/money"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"github.com/joho/godotenv"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
 	usdCurrency = "USD"
+
+	// maxPrepConcurrency is how many products prepOrderItems looks up at
+	// once when the catalog or currency service has no batch call.
+	maxPrepConcurrency = 8
 )
 
 var log *logrus.Logger
@@ -81,6 +92,17 @@ type checkoutService struct {
 
 	paymentSvcAddr string
 	paymentSvcConn *grpc.ClientConn
+
+	sagaStore   sagaStore
+	activeSagas sync.Map // order ID -> struct{}, sagas running in this process
+
+	idempotency *idempotencyStore
+
+	orders orderRepository
+
+	taxes          *taxRules
+	promotions     *promotionRules
+	promotionUsage *promotionLedger
 }
 
 func main() {
@@ -98,6 +120,13 @@ func main() {
 		log.Info("Tracing disabled.")
 	}
 
+	if os.Getenv("ENABLE_STATS") == "1" {
+		log.Info("Stats enabled.")
+		initStats()
+	} else {
+		log.Info("Stats disabled.")
+	}
+
 	if os.Getenv("ENABLE_PROFILER") == "1" {
 		log.Info("Profiling enabled.")
 		go initProfiling("checkoutservice", "1.0.0")
@@ -118,12 +147,44 @@ func main() {
 	mustMapEnv(&svc.emailSvcAddr, "EMAIL_SERVICE_ADDR")
 	mustMapEnv(&svc.paymentSvcAddr, "PAYMENT_SERVICE_ADDR")
 
-	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
-	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
-	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
-	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
-	mustConnGRPC(ctx, &svc.emailSvcConn, svc.emailSvcAddr)
-	mustConnGRPC(ctx, &svc.paymentSvcConn, svc.paymentSvcAddr)
+	budget, err := loadDeadlineBudget()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mustConnGRPC(&svc.shippingSvcConn, svc.shippingSvcAddr, budget.dialOption("SHIPPING_SERVICE"))
+	mustConnGRPC(&svc.productCatalogSvcConn, svc.productCatalogSvcAddr, budget.dialOption("PRODUCT_CATALOG_SERVICE"))
+	mustConnGRPC(&svc.cartSvcConn, svc.cartSvcAddr, budget.dialOption("CART_SERVICE"))
+	mustConnGRPC(&svc.currencySvcConn, svc.currencySvcAddr, budget.dialOption("CURRENCY_SERVICE"))
+	mustConnGRPC(&svc.emailSvcConn, svc.emailSvcAddr, budget.dialOption("EMAIL_SERVICE"))
+	mustConnGRPC(&svc.paymentSvcConn, svc.paymentSvcAddr, budget.dialOption("PAYMENT_SERVICE"))
+
+	if dir := os.Getenv("SAGA_STORE_DIR"); dir != "" {
+		store, err := newFileSagaStore(dir)
+		if err != nil {
+			log.Fatalf("failed to open saga store %q: %v", dir, err)
+		}
+		svc.sagaStore = store
+		log.Infof("persisting order state to %q", dir)
+	} else {
+		svc.sagaStore = newMemorySagaStore()
+		log.Info("SAGA_STORE_DIR not set, order state will not survive restarts")
+	}
+	orders, err := newOrderRepository(ctx)
+	if err != nil {
+		log.Fatalf("failed to open order store: %v", err)
+	}
+	svc.orders = orders
+	go svc.runSagaRecovery(ctx)
+	svc.idempotency = newIdempotencyStore(idempotencyMaxKeys, idempotencyTTL, budget.request)
+	if svc.taxes, err = loadTaxRules(os.Getenv("TAX_RULES_PATH")); err != nil {
+		log.Fatalf("failed to load tax rules: %v", err)
+	}
+	if svc.promotions, err = loadPromotions(os.Getenv("PROMOTIONS_PATH")); err != nil {
+		log.Fatalf("failed to load promotions: %v", err)
+	}
+	if svc.promotionUsage, err = newPromotionLedger(os.Getenv("PROMOTION_USAGE_PATH")); err != nil {
+		log.Fatalf("failed to open promotion usage: %v", err)
+	}
 
 	log.Infof("service config: %+v", svc)
 
@@ -139,19 +200,52 @@ func main() {
 		propagation.NewCompositeTextMapPropagator(
 			propagation.TraceContext{}, propagation.Baggage{}))
 	srv = grpc.NewServer(
-		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), budget.unaryServerInterceptor),
 		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
 	)
 
 	pb.RegisterCheckoutServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		log.Infof("received %s, finishing in-flight calls", sig)
+		srv.GracefulStop()
+	}()
 	log.Infof("starting to listen on tcp: %q", lis.Addr().String())
-	err = srv.Serve(lis)
-	log.Fatal(err)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+	orders.close()
+	log.Info("stopped")
 }
 
+// initStats exports metrics, such as circuit breaker states, to the
+// collector every minute.
 func initStats() {
-	//TODO(arbrown) Implement OpenTelemetry stats
+	var (
+		collectorAddr string
+		collectorConn *grpc.ClientConn
+	)
+
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
+	defer cancel()
+
+	mustMapEnv(&collectorAddr, "COLLECTOR_SERVICE_ADDR")
+	mustConnGRPC(&collectorConn, collectorAddr)
+
+	exporter, err := otlpmetricgrpc.New(
+		ctx,
+		otlpmetricgrpc.WithGRPCConn(collectorConn))
+	if err != nil {
+		log.Warnf("warn: Failed to create metric exporter: %v", err)
+		return
+	}
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)))
+	otel.SetMeterProvider(mp)
 }
 
 func initTracing() {
@@ -165,7 +259,7 @@ func initTracing() {
 	defer cancel()
 
 	mustMapEnv(&collectorAddr, "COLLECTOR_SERVICE_ADDR")
-	mustConnGRPC(ctx, &collectorConn, collectorAddr)
+	mustConnGRPC(&collectorConn, collectorAddr)
 
 	exporter, err := otlptracegrpc.New(
 		ctx,
@@ -210,14 +304,11 @@ func mustMapEnv(target *string, envKey string) {
 	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
+func mustConnGRPC(conn **grpc.ClientConn, addr string, opts ...grpc.DialOption) {
 	var err error
-	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
-	defer cancel()
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
+	*conn, err = grpcclient.Dial(addr, log, append([]grpc.DialOption{
 		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
-		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()))
+		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor())}, opts...)...)
 	if err != nil {
 		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
 	}
@@ -234,152 +325,403 @@ func (cs *checkoutService) Watch(req *healthpb.HealthCheckRequest, ws healthpb.H
 func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
 	log.Infof("[PlaceOrder] user_id=%q user_currency=%q", req.UserId, req.UserCurrency)
 
+	if key := req.GetIdempotencyKey(); key != "" {
+		// Keys are scoped to the user so they cannot be used to read someone
+		// else's order.
+		return cs.idempotency.do(ctx, req.GetUserId()+"/"+key, func(ctx context.Context) (*pb.PlaceOrderResponse, error) {
+			return cs.placeOrder(ctx, req)
+		})
+	}
+	return cs.placeOrder(ctx, req)
+}
+
+func (cs *checkoutService) placeOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
 	orderID, err := uuid.NewUUID()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to generate order uuid")
 	}
 
-	prep, err := cs.prepareOrderItemsAndShippingQuoteFromCart(ctx, req.UserId, req.UserCurrency, req.Address)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, err.Error())
+	rec := newSagaRecord(orderID.String(), req.UserId, req.Email)
+	s := cs.newOrderSaga(rec, req)
+	cs.activeSagas.Store(rec.OrderID, struct{}{})
+	defer cs.activeSagas.Delete(rec.OrderID)
+	if err := s.run(ctx); err != nil {
+		return nil, err
 	}
 
-	total := pb.Money{CurrencyCode: req.UserCurrency,
-		Units: 0,
-		Nanos: 0}
-	total = money.Must(money.Sum(total, *prep.shippingCostLocalized))
-	for _, it := range prep.orderItems {
-		multPrice := money.MultiplySlow(*it.Cost, uint32(it.GetItem().GetQuantity()))
-		total = money.Must(money.Sum(total, multPrice))
-	}
+	resp := &pb.PlaceOrderResponse{Order: rec.Order}
+	return resp, nil
+}
 
-	txID, err := cs.chargeCard(ctx, &total, req.CreditCard)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to charge card: %+v", err)
-	}
-	log.Infof("payment went through (transaction_id: %s)", txID)
+type orderPrep struct {
+	orderItems            []*pb.OrderItem
+	cartItems             []*pb.CartItem
+	shippingOption        *pb.ShippingOption
+	shippingCostLocalized *pb.Money
+	tax                   *pb.TaxLine
+	promotions            []*promotion
+	discounts             []*pb.DiscountLine
+}
 
-	shippingTrackingID, err := cs.shipOrder(ctx, req.Address, prep.cartItems)
-	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "shipping error: %+v", err)
+func (cs *checkoutService) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*pb.OrderResult, error) {
+	order, err := cs.orders.getOrder(ctx, req.GetOrderId())
+	if errors.Is(err, errOrderNotFound) {
+		return nil, status.Errorf(codes.NotFound, "order %q not found", req.GetOrderId())
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up order: %+v", err)
 	}
+	return order, nil
+}
 
-	_ = cs.emptyUserCart(ctx, req.UserId)
-
-	orderResult := &pb.OrderResult{
-		OrderId:            orderID.String(),
-		ShippingTrackingId: shippingTrackingID,
-		ShippingCost:       prep.shippingCostLocalized,
-		ShippingAddress:    req.Address,
-		Items:              prep.orderItems,
+func (cs *checkoutService) ListOrdersForUser(ctx context.Context, req *pb.ListOrdersForUserRequest) (*pb.ListOrdersForUserResponse, error) {
+	orders, err := cs.orders.listOrdersForUser(ctx, req.GetUserId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list orders: %+v", err)
 	}
+	return &pb.ListOrdersForUserResponse{Orders: orders}, nil
+}
 
-	if err := cs.sendOrderConfirmation(ctx, req.Email, orderResult); err != nil {
-		log.Warnf("failed to send order confirmation to %q: %+v", req.Email, err)
-	} else {
-		log.Infof("order confirmation email sent to %q", req.Email)
+func (cs *checkoutService) ApplyPromotions(ctx context.Context, req *pb.ApplyPromotionsRequest) (*pb.ApplyPromotionsResponse, error) {
+	q, err := cs.quoteOrder(ctx, req.GetUserId(), req.GetUserCurrency(), req.GetItems(), req.GetAddress(), "", req.GetPromotionCodes())
+	if err != nil {
+		return nil, errorStatus(codes.Internal, err, "failed to price cart: %+v", err)
 	}
-	resp := &pb.PlaceOrderResponse{Order: orderResult}
-	return resp, nil
+	return &pb.ApplyPromotionsResponse{
+		Discounts: q.promotions.discounts,
+		Rejected:  q.promotions.rejected,
+		Tax:       q.tax}, nil
 }
 
-type orderPrep struct {
-	orderItems            []*pb.OrderItem
-	cartItems             []*pb.CartItem
-	shippingCostLocalized *pb.Money
+// orderQuote is a cart priced for checkout.
+type orderQuote struct {
+	items          *pricedItems
+	shippingOption *pb.ShippingOption
+	shippingCost   *pb.Money
+	promotions     *promotionResult
+	tax            *pb.TaxLine
+	// total is what the shopper pays: items, shipping and tax, less
+	// discounts.
+	total pb.Money
 }
 
-func (cs *checkoutService) prepareOrderItemsAndShippingQuoteFromCart(ctx context.Context, userID, userCurrency string, address *pb.Address) (orderPrep, error) {
-	var out orderPrep
-	cartItems, err := cs.getUserCart(ctx, userID)
+// quoteOrder prices cartItems in currency, shipped to address with the given
+// method (standard shipping if empty) and with the given promotion codes
+// applied. Codes that cannot be applied are listed in the quote rather than
+// failing it. It returns errUnknownShippingMethod if the method is not
+// offered.
+func (cs *checkoutService) quoteOrder(ctx context.Context, userID, currency string, cartItems []*pb.CartItem, address *pb.Address, methodID string, promotionCodes []string) (*orderQuote, error) {
+	priced, err := cs.prepOrderItems(ctx, cartItems, currency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare order: %w", err)
+	}
+	options, err := cs.quoteShipping(ctx, address, cartItems, priced.subtotalUSD)
 	if err != nil {
-		return out, fmt.Errorf("cart failure: %+v", err)
+		return nil, err
 	}
-	orderItems, err := cs.prepOrderItems(ctx, cartItems, userCurrency)
+	option, ok := pickShippingOption(options, methodID)
+	if !ok {
+		return nil, errUnknownShippingMethod
+	}
+	shippingCost, err := cs.convertCurrency(ctx, option.GetCostUsd(), currency)
 	if err != nil {
-		return out, fmt.Errorf("failed to prepare order: %+v", err)
+		return nil, fmt.Errorf("failed to convert shipping cost to currency: %w", err)
+	}
+	// Free shipping promotions waive the cost of standard shipping; faster
+	// methods still cost the difference.
+	waived := *shippingCost
+	if standard, ok := pickShippingOption(options, ""); ok && standard != option {
+		c, err := cs.convertCurrency(ctx, standard.GetCostUsd(), currency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert shipping cost to currency: %w", err)
+		}
+		if moneyLess(*c, waived) {
+			waived = *c
+		}
 	}
-	shippingUSD, err := cs.quoteShipping(ctx, address, cartItems)
+
+	promos, err := cs.promotions.apply(promotionCodes, &promotionCart{
+		userID:       userID,
+		currency:     currency,
+		items:        priced,
+		shippingCost: waived,
+		convert: func(m pb.Money) (pb.Money, error) {
+			c, err := cs.convertCurrency(ctx, &m, currency)
+			if err != nil {
+				return pb.Money{}, err
+			}
+			return *c, nil
+		},
+	}, cs.promotionUsage, time.Now())
 	if err != nil {
-		return out, fmt.Errorf("shipping quote failure: %+v", err)
+		return nil, fmt.Errorf("failed to apply promotions: %w", err)
 	}
-	shippingPrice, err := cs.convertCurrency(ctx, shippingUSD, userCurrency)
+	tax, err := cs.taxes.calculate(address, promos.lines, priced.categories, currency)
 	if err != nil {
-		return out, fmt.Errorf("failed to convert shipping cost to currency: %+v", err)
+		return nil, fmt.Errorf("failed to calculate tax: %w", err)
 	}
 
-	out.shippingCostLocalized = shippingPrice
-	out.cartItems = cartItems
-	out.orderItems = orderItems
-	return out, nil
+	total := pb.Money{CurrencyCode: currency}
+	amounts := append([]pb.Money{*shippingCost, *tax.GetAmount(), money.Negate(promos.total)}, priced.lines...)
+	for _, m := range amounts {
+		if total, err = money.Sum(total, m); err != nil {
+			return nil, fmt.Errorf("failed to total order: %w", err)
+		}
+	}
+	return &orderQuote{
+		items:          priced,
+		shippingOption: option,
+		shippingCost:   shippingCost,
+		promotions:     promos,
+		tax:            tax,
+		total:          total,
+	}, nil
 }
 
-func (cs *checkoutService) quoteShipping(ctx context.Context, address *pb.Address, items []*pb.CartItem) (*pb.Money, error) {
+// quoteShipping returns the shipping options for items.
+func (cs *checkoutService) quoteShipping(ctx context.Context, address *pb.Address, items []*pb.CartItem, subtotalUSD *pb.Money) ([]*pb.ShippingOption, error) {
 	shippingQuote, err := pb.NewShippingServiceClient(cs.shippingSvcConn).
 		GetQuote(ctx, &pb.GetQuoteRequest{
-			Address: address,
-			Items:   items})
+			Address:     address,
+			Items:       items,
+			SubtotalUsd: subtotalUSD})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get shipping quote: %+v", err)
+		return nil, fmt.Errorf("failed to get shipping quote: %w", err)
+	}
+	if len(shippingQuote.GetOptions()) == 0 {
+		// Shipping service without shipping methods.
+		return []*pb.ShippingOption{{MethodId: defaultShippingMethod, CostUsd: shippingQuote.GetCostUsd()}}, nil
+	}
+	return shippingQuote.GetOptions(), nil
+}
+
+// pickShippingOption returns the option for the given shipping method, or
+// for standard shipping if methodID is empty.
+func pickShippingOption(options []*pb.ShippingOption, methodID string) (*pb.ShippingOption, bool) {
+	if methodID == "" {
+		methodID = defaultShippingMethod
+	}
+	for _, o := range options {
+		if o.GetMethodId() == methodID {
+			return o, true
+		}
 	}
-	return shippingQuote.GetCostUsd(), nil
+	return nil, false
 }
 
 func (cs *checkoutService) getUserCart(ctx context.Context, userID string) ([]*pb.CartItem, error) {
 	cart, err := pb.NewCartServiceClient(cs.cartSvcConn).GetCart(ctx, &pb.GetCartRequest{UserId: userID})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user cart during checkout: %+v", err)
+		return nil, fmt.Errorf("failed to get user cart during checkout: %w", err)
 	}
 	return cart.GetItems(), nil
 }
 
 func (cs *checkoutService) emptyUserCart(ctx context.Context, userID string) error {
 	if _, err := pb.NewCartServiceClient(cs.cartSvcConn).EmptyCart(ctx, &pb.EmptyCartRequest{UserId: userID}); err != nil {
-		return fmt.Errorf("failed to empty user cart during checkout: %+v", err)
+		return fmt.Errorf("failed to empty user cart during checkout: %w", err)
 	}
 	return nil
 }
 
-func (cs *checkoutService) prepOrderItems(ctx context.Context, items []*pb.CartItem, userCurrency string) ([]*pb.OrderItem, error) {
-	out := make([]*pb.OrderItem, len(items))
-	cl := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn)
+// pricedItems are cart items priced in the shopper's currency.
+type pricedItems struct {
+	items []*pb.OrderItem
+	// lines holds the total price of each item (unit price times quantity).
+	lines []pb.Money
+	// categories and pricesUSD hold each item's product categories and
+	// unit price in USD.
+	categories  [][]string
+	pricesUSD   []*pb.Money
+	subtotalUSD *pb.Money
+}
+
+// prepOrderItems prices items in userCurrency. It also returns their total
+// value in USD. Each distinct product is looked up and its price converted
+// once, in one batch call each.
+func (cs *checkoutService) prepOrderItems(ctx context.Context, items []*pb.CartItem, userCurrency string) (*pricedItems, error) {
+	// ids holds each product once, in cart order; pos maps them back.
+	var ids []string
+	pos := make(map[string]int, len(items))
+	for _, item := range items {
+		if _, ok := pos[item.GetProductId()]; !ok {
+			pos[item.GetProductId()] = len(ids)
+			ids = append(ids, item.GetProductId())
+		}
+	}
+
+	products, err := cs.getProducts(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	unitPrices := make([]*pb.Money, len(products))
+	for i, product := range products {
+		unitPrices[i] = product.GetPriceUsd()
+	}
+	prices, err := cs.convertPrices(ctx, unitPrices, userCurrency)
+	if err != nil {
+		return nil, err
+	}
 
+	out := &pricedItems{
+		items:      make([]*pb.OrderItem, len(items)),
+		lines:      make([]pb.Money, len(items)),
+		categories: make([][]string, len(items)),
+		pricesUSD:  make([]*pb.Money, len(items)),
+	}
+	subtotalUSD := pb.Money{CurrencyCode: "USD"}
 	for i, item := range items {
-		product, err := cl.GetProduct(ctx, &pb.GetProductRequest{Id: item.GetProductId()})
-		if err != nil {
-			return nil, fmt.Errorf("failed to get product #%q", item.GetProductId())
+		product, price := products[pos[item.GetProductId()]], prices[pos[item.GetProductId()]]
+		out.items[i] = &pb.OrderItem{
+			Item: item,
+			Cost: price}
+		out.categories[i] = product.GetCategories()
+		out.pricesUSD[i] = product.GetPriceUsd()
+		if out.lines[i], err = money.Multiply(*price, int64(item.GetQuantity())); err != nil {
+			return nil, fmt.Errorf("failed to total price of %q: %w", item.GetProductId(), err)
+		}
+		linePrice, err := money.Multiply(*product.GetPriceUsd(), int64(item.GetQuantity()))
+		if err == nil {
+			subtotalUSD, err = money.Sum(subtotalUSD, linePrice)
 		}
-		price, err := cs.convertCurrency(ctx, product.GetPriceUsd(), userCurrency)
 		if err != nil {
-			return nil, fmt.Errorf("failed to convert price of %q to %s", item.GetProductId(), userCurrency)
+			return nil, fmt.Errorf("failed to total price of %q: %w", item.GetProductId(), err)
 		}
-		out[i] = &pb.OrderItem{
-			Item: item,
-			Cost: price}
+	}
+	out.subtotalUSD = &subtotalUSD
+	return out, nil
+}
+
+// getProducts returns the products with the given IDs, in the same order.
+// It falls back to looking them up one by one, with at most
+// maxPrepConcurrency in flight, if the catalog has no batch call.
+func (cs *checkoutService) getProducts(ctx context.Context, ids []string) ([]*pb.Product, error) {
+	cl := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn)
+	resp, err := cl.GetProducts(ctx, &pb.GetProductsRequest{Ids: ids})
+	if status.Code(err) == codes.Unimplemented {
+		return fanOut(ctx, ids, func(ctx context.Context, id string) (*pb.Product, error) {
+			product, err := cl.GetProduct(ctx, &pb.GetProductRequest{Id: id})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get product #%q: %w", id, err)
+			}
+			return product, nil
+		})
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get products: %w", err)
+	}
+	if len(resp.GetMissingIds()) > 0 {
+		return nil, fmt.Errorf("failed to get product #%q", resp.GetMissingIds()[0])
+	}
+	byID := make(map[string]*pb.Product, len(resp.GetProducts()))
+	for _, product := range resp.GetProducts() {
+		byID[product.GetId()] = product
+	}
+	products := make([]*pb.Product, len(ids))
+	for i, id := range ids {
+		if products[i] = byID[id]; products[i] == nil {
+			return nil, fmt.Errorf("failed to get product #%q", id)
+		}
+	}
+	return products, nil
+}
+
+// convertPrices converts amounts to currency, in the same order. It falls
+// back to converting them one by one if the currency service has no batch
+// call.
+func (cs *checkoutService) convertPrices(ctx context.Context, amounts []*pb.Money, currency string) ([]*pb.Money, error) {
+	resp, err := pb.NewCurrencyServiceClient(cs.currencySvcConn).ConvertBatch(ctx, &pb.ConvertBatchRequest{
+		From:   amounts,
+		ToCode: currency})
+	if status.Code(err) == codes.Unimplemented {
+		return fanOut(ctx, amounts, func(ctx context.Context, amount *pb.Money) (*pb.Money, error) {
+			price, err := cs.convertCurrency(ctx, amount, currency)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert prices to %s: %w", currency, err)
+			}
+			return price, nil
+		})
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to convert prices to %s: %w", currency, err)
+	}
+	if len(resp.GetResults()) != len(amounts) {
+		return nil, fmt.Errorf("failed to convert prices to %s: got %d results for %d amounts", currency, len(resp.GetResults()), len(amounts))
+	}
+	return resp.GetResults(), nil
+}
+
+// fanOut calls f for each input, with at most maxPrepConcurrency calls in
+// flight, and returns the results in input order. The first error cancels
+// the calls still running.
+func fanOut[In, Out any](ctx context.Context, inputs []In, f func(context.Context, In) (Out, error)) ([]Out, error) {
+	out := make([]Out, len(inputs))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(maxPrepConcurrency)
+	for i, in := range inputs {
+		g.Go(func() error {
+			var err error
+			out[i], err = f(gctx, in)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
 	}
 	return out, nil
 }
 
 func (cs *checkoutService) convertCurrency(ctx context.Context, from *pb.Money, toCurrency string) (*pb.Money, error) {
-	result, err := pb.NewCurrencyServiceClient(cs.currencySvcConn).Convert(context.TODO(), &pb.CurrencyConversionRequest{
+	result, err := pb.NewCurrencyServiceClient(cs.currencySvcConn).Convert(ctx, &pb.CurrencyConversionRequest{
 		From:   from,
 		ToCode: toCurrency})
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert currency: %+v", err)
+		return nil, fmt.Errorf("failed to convert currency: %w", err)
 	}
 	return result, err
 }
 
+// reserveStock holds the order's items in the product catalog. The order ID
+// doubles as the reservation ID so that retries reserve nothing more.
+func (cs *checkoutService) reserveStock(ctx context.Context, orderID string, items []*pb.CartItem) error {
+	_, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).ReserveStock(ctx, &pb.ReserveStockRequest{
+		ReservationId: orderID,
+		Items:         items})
+	return err
+}
+
+func (cs *checkoutService) commitStock(ctx context.Context, orderID string) error {
+	_, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).CommitReservation(ctx, &pb.CommitReservationRequest{
+		ReservationId: orderID})
+	return err
+}
+
+func (cs *checkoutService) releaseStock(ctx context.Context, orderID string) error {
+	_, err := pb.NewProductCatalogServiceClient(cs.productCatalogSvcConn).ReleaseReservation(ctx, &pb.ReleaseReservationRequest{
+		ReservationId: orderID})
+	if err != nil {
+		return fmt.Errorf("could not release stock reservation %s: %w", orderID, err)
+	}
+	return nil
+}
+
 func (cs *checkoutService) chargeCard(ctx context.Context, amount *pb.Money, paymentInfo *pb.CreditCardInfo) (string, error) {
 	paymentResp, err := pb.NewPaymentServiceClient(cs.paymentSvcConn).Charge(ctx, &pb.ChargeRequest{
 		Amount:     amount,
 		CreditCard: paymentInfo})
 	if err != nil {
-		return "", fmt.Errorf("could not charge the card: %+v", err)
+		return "", fmt.Errorf("could not charge the card: %w", err)
 	}
 	return paymentResp.GetTransactionId(), nil
 }
 
+func (cs *checkoutService) refundCharge(ctx context.Context, transactionID string, amount *pb.Money) (string, error) {
+	resp, err := pb.NewPaymentServiceClient(cs.paymentSvcConn).Refund(ctx, &pb.RefundRequest{
+		TransactionId: transactionID,
+		Amount:        amount})
+	if err != nil {
+		return "", fmt.Errorf("could not refund transaction %s: %w", transactionID, err)
+	}
+	return resp.GetRefundId(), nil
+}
+
 func (cs *checkoutService) sendOrderConfirmation(ctx context.Context, email string, order *pb.OrderResult) error {
 	_, err := pb.NewEmailServiceClient(cs.emailSvcConn).SendOrderConfirmation(ctx, &pb.SendOrderConfirmationRequest{
 		Email: email,
@@ -387,12 +729,13 @@ func (cs *checkoutService) sendOrderConfirmation(ctx context.Context, email stri
 	return err
 }
 
-func (cs *checkoutService) shipOrder(ctx context.Context, address *pb.Address, items []*pb.CartItem) (string, error) {
+func (cs *checkoutService) shipOrder(ctx context.Context, address *pb.Address, items []*pb.CartItem, methodID string) (string, error) {
 	resp, err := pb.NewShippingServiceClient(cs.shippingSvcConn).ShipOrder(ctx, &pb.ShipOrderRequest{
-		Address: address,
-		Items:   items})
+		Address:          address,
+		Items:            items,
+		ShippingMethodId: methodID})
 	if err != nil {
-		return "", fmt.Errorf("shipment failed: %+v", err)
+		return "", fmt.Errorf("shipment failed: %w", err)
 	}
 	return resp.GetTrackingId(), nil
 }
@@ -0,0 +1,222 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeCatalog serves products priced at $1 per letter of their ID, and
+// converts USD to other currencies one for one.
+type fakeCatalog struct {
+	pb.UnimplementedProductCatalogServiceServer
+	pb.UnimplementedCurrencyServiceServer
+
+	// batch enables GetProducts and ConvertBatch.
+	batch bool
+	// getProduct, if set, runs before each GetProduct answers.
+	getProduct func(ctx context.Context, id string) error
+
+	mu                    sync.Mutex
+	lookups               map[string]int
+	conversions           int
+	batchCalls            int
+	inFlight, maxInFlight int
+}
+
+func (f *fakeCatalog) GetProduct(ctx context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
+	f.mu.Lock()
+	f.lookups[req.Id]++
+	f.inFlight++
+	f.maxInFlight = max(f.maxInFlight, f.inFlight)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+
+	if f.getProduct != nil {
+		if err := f.getProduct(ctx, req.Id); err != nil {
+			return nil, err
+		}
+	}
+	return &pb.Product{Id: req.Id, Categories: []string{"test"},
+		PriceUsd: &pb.Money{CurrencyCode: "USD", Units: int64(len(req.Id))}}, nil
+}
+
+func (f *fakeCatalog) GetProducts(ctx context.Context, req *pb.GetProductsRequest) (*pb.GetProductsResponse, error) {
+	if !f.batch {
+		return f.UnimplementedProductCatalogServiceServer.GetProducts(ctx, req)
+	}
+	f.mu.Lock()
+	f.batchCalls++
+	f.mu.Unlock()
+	resp := &pb.GetProductsResponse{}
+	for _, id := range req.Ids {
+		if id == "MISSING" {
+			resp.MissingIds = append(resp.MissingIds, id)
+			continue
+		}
+		resp.Products = append(resp.Products, &pb.Product{Id: id, Categories: []string{"test"},
+			PriceUsd: &pb.Money{CurrencyCode: "USD", Units: int64(len(id))}})
+	}
+	return resp, nil
+}
+
+func (f *fakeCatalog) ConvertBatch(ctx context.Context, req *pb.ConvertBatchRequest) (*pb.ConvertBatchResponse, error) {
+	if !f.batch {
+		return f.UnimplementedCurrencyServiceServer.ConvertBatch(ctx, req)
+	}
+	f.mu.Lock()
+	f.batchCalls++
+	f.mu.Unlock()
+	resp := &pb.ConvertBatchResponse{}
+	for _, m := range req.From {
+		resp.Results = append(resp.Results, &pb.Money{CurrencyCode: req.ToCode, Units: m.Units, Nanos: m.Nanos})
+	}
+	return resp, nil
+}
+
+func (f *fakeCatalog) Convert(ctx context.Context, req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+	f.mu.Lock()
+	f.conversions++
+	f.mu.Unlock()
+	return &pb.Money{CurrencyCode: req.ToCode, Units: req.From.Units, Nanos: req.From.Nanos}, nil
+}
+
+// testCheckoutService returns a checkout service whose product catalog and
+// currency service are fake, connected to with opts.
+func testCheckoutService(t *testing.T, fake *fakeCatalog, opts ...grpc.DialOption) *checkoutService {
+	t.Helper()
+	fake.lookups = make(map[string]int)
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterProductCatalogServiceServer(srv, fake)
+	pb.RegisterCurrencyServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet", append([]grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &checkoutService{productCatalogSvcConn: conn, currencySvcConn: conn}
+}
+
+func TestPrepOrderItems(t *testing.T) {
+	for _, batch := range []bool{true, false} {
+		t.Run(fmt.Sprintf("batch=%v", batch), func(t *testing.T) {
+			fake := &fakeCatalog{batch: batch}
+			cs := testCheckoutService(t, fake)
+			items := []*pb.CartItem{
+				{ProductId: "AA", Quantity: 2},
+				{ProductId: "BBB", Quantity: 1},
+				{ProductId: "AA", Quantity: 3},
+			}
+			priced, err := cs.prepOrderItems(context.Background(), items, "EUR")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range []struct {
+				id   string
+				line int64
+			}{{"AA", 4}, {"BBB", 3}, {"AA", 6}} {
+				if got := priced.items[i].GetItem().GetProductId(); got != want.id {
+					t.Errorf("item %d is %s, want %s", i, got, want.id)
+				}
+				if got := priced.lines[i]; got.GetUnits() != want.line || got.GetCurrencyCode() != "EUR" {
+					t.Errorf("item %d costs %d %s, want %d EUR", i, got.GetUnits(), got.GetCurrencyCode(), want.line)
+				}
+			}
+			if got := priced.subtotalUSD.GetUnits(); got != 13 {
+				t.Errorf("got a subtotal of $%d, want $13", got)
+			}
+			if batch {
+				if fake.batchCalls != 2 || len(fake.lookups) != 0 || fake.conversions != 0 {
+					t.Errorf("got %d batch calls, lookups %v and %d conversions, want 2 batch calls only", fake.batchCalls, fake.lookups, fake.conversions)
+				}
+			} else if fake.lookups["AA"] != 1 || fake.lookups["BBB"] != 1 || fake.conversions != 2 {
+				t.Errorf("got lookups %v and %d conversions, want each product looked up and converted once", fake.lookups, fake.conversions)
+			}
+		})
+	}
+}
+
+func TestPrepOrderItemsMissingProduct(t *testing.T) {
+	cs := testCheckoutService(t, &fakeCatalog{batch: true})
+	items := []*pb.CartItem{{ProductId: "AA"}, {ProductId: "MISSING"}}
+	if _, err := cs.prepOrderItems(context.Background(), items, "USD"); err == nil {
+		t.Error("got no error for a missing product")
+	}
+}
+
+func TestPrepOrderItemsBoundsConcurrency(t *testing.T) {
+	fake := &fakeCatalog{getProduct: func(ctx context.Context, id string) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}}
+	cs := testCheckoutService(t, fake)
+	var items []*pb.CartItem
+	for i := 0; i < 3*maxPrepConcurrency; i++ {
+		items = append(items, &pb.CartItem{ProductId: string(rune('A'+i)) + "X", Quantity: 1})
+	}
+	if _, err := cs.prepOrderItems(context.Background(), items, "USD"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.maxInFlight > maxPrepConcurrency {
+		t.Errorf("got %d concurrent lookups, want at most %d", fake.maxInFlight, maxPrepConcurrency)
+	}
+	if fake.maxInFlight < 2 {
+		t.Errorf("lookups ran one at a time")
+	}
+}
+
+func TestPrepOrderItemsCancelsOnFailure(t *testing.T) {
+	fake := &fakeCatalog{getProduct: func(ctx context.Context, id string) error {
+		if id == "MISSING" {
+			return status.Error(codes.NotFound, "no such product")
+		}
+		// The other lookups only finish when they are cancelled.
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	cs := testCheckoutService(t, fake)
+	items := []*pb.CartItem{{ProductId: "SLOW1"}, {ProductId: "MISSING"}, {ProductId: "SLOW2"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cs.prepOrderItems(ctx, items, "USD"); err == nil {
+		t.Fatal("got no error for a missing product")
+	}
+	if ctx.Err() != nil {
+		t.Error("lookups were not cancelled after the first failure")
+	}
+}
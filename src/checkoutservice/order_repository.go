@@ -0,0 +1,228 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+// defaultOrderStorePath is on the volume the checkout image declares, so
+// that orders outlive the container.
+const defaultOrderStorePath = "/data/orders.jsonl"
+
+var errOrderNotFound = errors.New("order not found")
+
+// marshalProto and unmarshalProto convert the protobuf messages that are
+// stored, such as orders, to and from their JSON form. Fields this version
+// does not know are skipped so that records outlive schema changes.
+var (
+	marshalProto   = protojson.MarshalOptions{UseProtoNames: true}.Marshal
+	unmarshalProto = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal
+)
+
+// orderRepository stores placed orders so they can be looked up later.
+type orderRepository interface {
+	saveOrder(ctx context.Context, userID string, order *pb.OrderResult) error
+	// getOrder returns errOrderNotFound if there is no such order.
+	getOrder(ctx context.Context, orderID string) (*pb.OrderResult, error)
+	// listOrdersForUser returns the user's orders, most recent first.
+	listOrdersForUser(ctx context.Context, userID string) ([]*pb.OrderResult, error)
+	close()
+}
+
+// newOrderRepository selects the backend from ORDER_STORE: "file" (the
+// default) or "postgres".
+func newOrderRepository(ctx context.Context) (orderRepository, error) {
+	switch backend := os.Getenv("ORDER_STORE"); backend {
+	case "", "file":
+		path := os.Getenv("ORDER_STORE_PATH")
+		if path == "" {
+			path = defaultOrderStorePath
+		}
+		log.Infof("storing orders in file %q", path)
+		return newFileOrderRepository(path)
+	case "postgres":
+		log.Info("storing orders in Postgres")
+		return newPostgresOrderRepository(ctx, os.Getenv("ORDER_STORE_DSN"))
+	default:
+		return nil, fmt.Errorf("unknown ORDER_STORE %q", backend)
+	}
+}
+
+// storedOrder is an order as it is kept on disk, one per line.
+type storedOrder struct {
+	UserID   string
+	PlacedAt time.Time
+	Order    *pb.OrderResult
+}
+
+// storedOrderJSON is the JSON form of a storedOrder. The order is in the
+// protobuf JSON form.
+type storedOrderJSON struct {
+	UserID   string          `json:"user_id"`
+	PlacedAt time.Time       `json:"placed_at"`
+	Order    json.RawMessage `json:"order"`
+}
+
+func (so *storedOrder) MarshalJSON() ([]byte, error) {
+	order, err := marshalProto(so.Order)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(storedOrderJSON{UserID: so.UserID, PlacedAt: so.PlacedAt, Order: order})
+}
+
+func (so *storedOrder) UnmarshalJSON(b []byte) error {
+	var j storedOrderJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	order := new(pb.OrderResult)
+	if err := unmarshalProto(j.Order, order); err != nil {
+		return err
+	}
+	so.UserID, so.PlacedAt, so.Order = j.UserID, j.PlacedAt, order
+	return nil
+}
+
+// fileOrderRepository is an embedded store that appends orders to a JSON
+// lines file and serves reads from an in-memory index built at startup.
+type fileOrderRepository struct {
+	mu     sync.RWMutex
+	f      *os.File
+	byID   map[string]*storedOrder
+	byUser map[string][]*storedOrder
+}
+
+func newFileOrderRepository(path string) (*fileOrderRepository, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &fileOrderRepository{
+		f:      f,
+		byID:   make(map[string]*storedOrder),
+		byUser: make(map[string][]*storedOrder),
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		so := new(storedOrder)
+		if err := json.Unmarshal(sc.Bytes(), so); err != nil {
+			// A torn last line is expected after a crash mid-write.
+			log.Warnf("skipping unreadable order at %s:%d: %v", path, line, err)
+			continue
+		}
+		r.index(so)
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := terminateLastLine(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// terminateLastLine appends a newline if the file ends in a torn write, so
+// that the next order starts on a line of its own.
+func terminateLastLine(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = f.Write([]byte{'\n'})
+	return err
+}
+
+func (r *fileOrderRepository) index(so *storedOrder) {
+	id := so.Order.GetOrderId()
+	if _, ok := r.byID[id]; ok {
+		return
+	}
+	r.byID[id] = so
+	r.byUser[so.UserID] = append(r.byUser[so.UserID], so)
+}
+
+func (r *fileOrderRepository) saveOrder(_ context.Context, userID string, order *pb.OrderResult) error {
+	b, err := json.Marshal(&storedOrder{UserID: userID, PlacedAt: time.Now(), Order: order})
+	if err != nil {
+		return err
+	}
+	so := new(storedOrder)
+	if err := json.Unmarshal(b, so); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byID[order.GetOrderId()]; ok {
+		return nil
+	}
+	if _, err := r.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := r.f.Sync(); err != nil {
+		return err
+	}
+	r.index(so)
+	return nil
+}
+
+func (r *fileOrderRepository) getOrder(_ context.Context, orderID string) (*pb.OrderResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	so, ok := r.byID[orderID]
+	if !ok {
+		return nil, errOrderNotFound
+	}
+	return so.Order, nil
+}
+
+func (r *fileOrderRepository) listOrdersForUser(_ context.Context, userID string) ([]*pb.OrderResult, error) {
+	r.mu.RLock()
+	orders := append([]*storedOrder(nil), r.byUser[userID]...)
+	r.mu.RUnlock()
+
+	sort.SliceStable(orders, func(i, j int) bool { return orders[i].PlacedAt.After(orders[j].PlacedAt) })
+	out := make([]*pb.OrderResult, len(orders))
+	for i, so := range orders {
+		out[i] = so.Order
+	}
+	return out, nil
+}
+
+func (r *fileOrderRepository) close() { r.f.Close() }
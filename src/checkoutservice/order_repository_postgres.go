@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+const createOrdersTable = `
+CREATE TABLE IF NOT EXISTS orders (
+	order_id   TEXT PRIMARY KEY,
+	user_id    TEXT NOT NULL,
+	placed_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+	order_data JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS orders_user_id_placed_at ON orders (user_id, placed_at DESC);`
+
+// postgresOrderRepository stores orders in a Postgres "orders" table.
+type postgresOrderRepository struct {
+	pool *pgxpool.Pool
+}
+
+func newPostgresOrderRepository(ctx context.Context, dsn string) (*postgresOrderRepository, error) {
+	if dsn == "" {
+		return nil, errors.New("ORDER_STORE_DSN must be set for the postgres order store")
+	}
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, createOrdersTable); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &postgresOrderRepository{pool: pool}, nil
+}
+
+func (r *postgresOrderRepository) saveOrder(ctx context.Context, userID string, order *pb.OrderResult) error {
+	b, err := marshalProto(order)
+	if err != nil {
+		return err
+	}
+	_, err = r.pool.Exec(ctx,
+		"INSERT INTO orders (order_id, user_id, order_data) VALUES ($1, $2, $3) ON CONFLICT (order_id) DO NOTHING",
+		order.GetOrderId(), userID, b)
+	return err
+}
+
+func (r *postgresOrderRepository) getOrder(ctx context.Context, orderID string) (*pb.OrderResult, error) {
+	var b []byte
+	err := r.pool.QueryRow(ctx, "SELECT order_data FROM orders WHERE order_id = $1", orderID).Scan(&b)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errOrderNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	order := new(pb.OrderResult)
+	if err := unmarshalProto(b, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (r *postgresOrderRepository) listOrdersForUser(ctx context.Context, userID string) ([]*pb.OrderResult, error) {
+	rows, err := r.pool.Query(ctx,
+		"SELECT order_data FROM orders WHERE user_id = $1 ORDER BY placed_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*pb.OrderResult
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		order := new(pb.OrderResult)
+		if err := unmarshalProto(b, order); err != nil {
+			return nil, err
+		}
+		out = append(out, order)
+	}
+	return out, rows.Err()
+}
+
+func (r *postgresOrderRepository) close() { r.pool.Close() }
@@ -0,0 +1,181 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+func orderIDs(orders []*pb.OrderResult) []string {
+	ids := make([]string, len(orders))
+	for i, o := range orders {
+		ids[i] = o.GetOrderId()
+	}
+	return ids
+}
+
+func TestFileOrderRepository(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+	r, err := newFileOrderRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		user := "alice"
+		if id == "b" {
+			user = "bob"
+		}
+		order := &pb.OrderResult{OrderId: id, ShippingTrackingId: "track-" + id}
+		if err := r.saveOrder(ctx, user, order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Saving the same order twice is a no-op.
+	if err := r.saveOrder(ctx, "alice", &pb.OrderResult{OrderId: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	r.close()
+
+	// Reopen to check that orders survive a restart.
+	r, err = newFileOrderRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	order, err := r.getOrder(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := order.GetShippingTrackingId(), "track-a"; got != want {
+		t.Errorf("got tracking id %q, want %q", got, want)
+	}
+	if _, err := r.getOrder(ctx, "missing"); !errors.Is(err, errOrderNotFound) {
+		t.Errorf("got err %v, want %v", err, errOrderNotFound)
+	}
+
+	orders, err := r.listOrdersForUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := orderIDs(orders); len(got) != 2 || got[0] != "c" || got[1] != "a" {
+		t.Errorf("got orders %v, want [c a]", got)
+	}
+	if orders, _ := r.listOrdersForUser(ctx, "nobody"); len(orders) != 0 {
+		t.Errorf("got %d orders for unknown user, want 0", len(orders))
+	}
+}
+
+func TestFileOrderRepositorySkipsTornWrite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+	r, err := newFileOrderRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.saveOrder(ctx, "alice", &pb.OrderResult{OrderId: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	r.close()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"user_id":"alice","ord`)
+	f.Close()
+
+	r, err = newFileOrderRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.getOrder(ctx, "a"); err != nil {
+		t.Errorf("got err %v, want the order written before the torn line", err)
+	}
+	if err := r.saveOrder(ctx, "alice", &pb.OrderResult{OrderId: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	r.close()
+
+	r, err = newFileOrderRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	if _, err := r.getOrder(ctx, "b"); err != nil {
+		t.Errorf("got err %v, want the order written after the torn line", err)
+	}
+}
+
+func TestFileOrderRepositoryRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+	r, err := newFileOrderRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usd := func(units int64, nanos int32) *pb.Money {
+		return &pb.Money{CurrencyCode: "USD", Units: units, Nanos: nanos}
+	}
+	want := &pb.OrderResult{
+		OrderId:            "a",
+		ShippingTrackingId: "track-a",
+		ShippingCost:       usd(8, 990000000),
+		ShippingAddress:    &pb.Address{StreetAddress: "1600 Amphitheatre Parkway", City: "Mountain View", State: "CA", Country: "United States", ZipCode: 94043},
+		Items: []*pb.OrderItem{
+			{Item: &pb.CartItem{ProductId: "MUG", Quantity: 2}, Cost: usd(8, 990000000)},
+		},
+		ShippingOption: &pb.ShippingOption{MethodId: "standard", CostUsd: usd(8, 990000000), EarliestDeliveryDate: "2026-10-20"},
+		Tax:            &pb.TaxLine{Jurisdiction: "US-CA", Amount: usd(1, 850000000)},
+		Discounts: []*pb.DiscountLine{
+			{Code: "TEN", Description: "10% off", Amount: usd(1, 798000000)},
+		},
+	}
+	if err := r.saveOrder(ctx, "alice", want); err != nil {
+		t.Fatal(err)
+	}
+	r.close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"units":"8"`)) {
+		t.Errorf("stored order is not in the protobuf JSON form: %s", b)
+	}
+
+	r, err = newFileOrderRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	got, err := r.getOrder(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+const (
+	sagaRecoveryInterval = time.Minute
+
+	defaultShippingMethod = "standard"
+)
+
+var errUnknownShippingMethod = errors.New("unknown shipping method")
+
+// orderSaga holds the in-flight state of a single PlaceOrder call. Only the
+// fields on the saga record survive a restart.
+type orderSaga struct {
+	cs  *checkoutService
+	req *pb.PlaceOrderRequest
+	rec *sagaRecord
+
+	prep  orderPrep
+	total pb.Money
+}
+
+// newOrderSaga builds the PlaceOrder saga. Shipping is the pivot: once the
+// order has shipped the saga only moves forward. req is nil when the saga is
+// being recovered, in which case only compensations and retriable steps run.
+func (cs *checkoutService) newOrderSaga(rec *sagaRecord, req *pb.PlaceOrderRequest) *saga {
+	o := &orderSaga{cs: cs, req: req, rec: rec}
+	return &saga{rec: rec, store: cs.sagaStore, steps: []sagaStep{
+		{name: "get_cart", action: o.getCart},
+		{name: "price_order", action: o.priceOrder},
+		{name: "redeem_promotions", action: o.redeemPromotions, compensate: o.unredeemPromotions},
+		{name: "reserve_stock", action: o.reserveStock, compensate: o.releaseStock},
+		{name: "charge_card", action: o.chargeCard, compensate: o.refundCard},
+		{name: "commit_stock", action: o.commitStock, compensate: o.releaseStock},
+		{name: "ship_order", action: o.shipOrder},
+		{name: "record_order", action: o.recordOrder, retriable: true},
+		{name: "empty_cart", action: o.emptyCart, retriable: true},
+		{name: "send_confirmation", action: o.sendConfirmation, retriable: true},
+	}}
+}
+
+func (o *orderSaga) getCart(ctx context.Context) error {
+	cartItems, err := o.cs.getUserCart(ctx, o.req.UserId)
+	if err != nil {
+		return errorStatus(codes.Internal, err, "cart failure: %+v", err)
+	}
+	o.prep.cartItems = cartItems
+	return nil
+}
+
+func (o *orderSaga) priceOrder(ctx context.Context) error {
+	q, err := o.cs.quoteOrder(ctx, o.req.UserId, o.req.UserCurrency, o.prep.cartItems, o.req.Address, o.req.ShippingMethodId, o.req.PromotionCodes)
+	if errors.Is(err, errUnknownShippingMethod) {
+		return status.Errorf(codes.InvalidArgument, "shipping method %q is not available", o.req.ShippingMethodId)
+	} else if err != nil {
+		return errorStatus(codes.Internal, err, "failed to price order: %+v", err)
+	}
+	if rejected := q.promotions.rejected; len(rejected) > 0 {
+		return status.Errorf(codes.InvalidArgument, "promotion code %q cannot be applied: %s", rejected[0].GetCode(), rejected[0].GetReason())
+	}
+	o.prep.orderItems = q.items.items
+	o.prep.shippingOption = q.shippingOption
+	o.prep.shippingCostLocalized = q.shippingCost
+	o.prep.tax = q.tax
+	o.prep.promotions = q.promotions.applied
+	o.prep.discounts = q.promotions.discounts
+	o.total = q.total
+	return nil
+}
+
+// redeemPromotions counts the order against the usage limits of its
+// promotion codes.
+func (o *orderSaga) redeemPromotions(ctx context.Context) error {
+	if len(o.prep.promotions) == 0 {
+		return nil
+	}
+	err := o.cs.promotionUsage.redeem(o.rec.OrderID, o.rec.UserID, o.prep.promotions)
+	if errors.Is(err, errPromotionLimit) {
+		return status.Errorf(codes.FailedPrecondition, "a promotion code has reached its usage limit")
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "failed to redeem promotions: %+v", err)
+	}
+	return nil
+}
+
+func (o *orderSaga) unredeemPromotions(ctx context.Context) error {
+	return o.cs.promotionUsage.unredeem(o.rec.OrderID)
+}
+
+func (o *orderSaga) reserveStock(ctx context.Context) error {
+	err := o.cs.reserveStock(ctx, o.rec.OrderID, o.prep.cartItems)
+	if status.Code(err) == codes.FailedPrecondition {
+		return status.Errorf(codes.FailedPrecondition, "not enough stock: %s", status.Convert(err).Message())
+	} else if err != nil {
+		return errorStatus(codes.Internal, err, "failed to reserve stock: %+v", err)
+	}
+	return nil
+}
+
+// releaseStock gives back reserved items, and restocks them if the
+// reservation was already committed.
+func (o *orderSaga) releaseStock(ctx context.Context) error {
+	return o.cs.releaseStock(ctx, o.rec.OrderID)
+}
+
+func (o *orderSaga) commitStock(ctx context.Context) error {
+	if err := o.cs.commitStock(ctx, o.rec.OrderID); err != nil {
+		return errorStatus(codes.Internal, err, "failed to commit stock reservation: %+v", err)
+	}
+	return nil
+}
+
+func (o *orderSaga) chargeCard(ctx context.Context) error {
+	txID, err := o.cs.chargeCard(ctx, &o.total, o.req.CreditCard)
+	if err != nil {
+		return errorStatus(codes.Internal, err, "failed to charge card: %+v", err)
+	}
+	log.Infof("payment went through (transaction_id: %s)", txID)
+	o.rec.TransactionID = txID
+	o.rec.Charged = &o.total
+	return nil
+}
+
+func (o *orderSaga) refundCard(ctx context.Context) error {
+	refundID, err := o.cs.refundCharge(ctx, o.rec.TransactionID, o.rec.Charged)
+	if err != nil {
+		return err
+	}
+	log.Infof("payment refunded (transaction_id: %s, refund_id: %s)", o.rec.TransactionID, refundID)
+	return nil
+}
+
+func (o *orderSaga) shipOrder(ctx context.Context) error {
+	shippingTrackingID, err := o.cs.shipOrder(ctx, o.req.Address, o.prep.cartItems, o.prep.shippingOption.GetMethodId())
+	if err != nil {
+		return errorStatus(codes.Unavailable, err, "shipping error: %+v", err)
+	}
+	o.rec.Order = &pb.OrderResult{
+		OrderId:            o.rec.OrderID,
+		ShippingTrackingId: shippingTrackingID,
+		ShippingCost:       o.prep.shippingCostLocalized,
+		ShippingAddress:    o.req.Address,
+		Items:              o.prep.orderItems,
+		ShippingOption:     o.prep.shippingOption,
+		Tax:                o.prep.tax,
+		Discounts:          o.prep.discounts,
+	}
+	return nil
+}
+
+func (o *orderSaga) recordOrder(ctx context.Context) error {
+	return o.cs.orders.saveOrder(ctx, o.rec.UserID, o.rec.Order)
+}
+
+func (o *orderSaga) emptyCart(ctx context.Context) error {
+	return o.cs.emptyUserCart(ctx, o.rec.UserID)
+}
+
+func (o *orderSaga) sendConfirmation(ctx context.Context) error {
+	if err := o.cs.sendOrderConfirmation(ctx, o.rec.Email, o.rec.Order); err != nil {
+		return err
+	}
+	log.Infof("order confirmation email sent to %q", o.rec.Email)
+	return nil
+}
+
+// recoverSagas resumes or rolls back sagas left behind by a previous process
+// or by steps that ran out of retries.
+func (cs *checkoutService) recoverSagas(ctx context.Context) {
+	recs, err := cs.sagaStore.listIncomplete()
+	if err != nil {
+		log.Warnf("failed to list incomplete orders: %+v", err)
+		return
+	}
+	for _, rec := range recs {
+		if _, busy := cs.activeSagas.LoadOrStore(rec.OrderID, struct{}{}); busy {
+			continue
+		}
+		if err := cs.newOrderSaga(rec, nil).resume(ctx); err != nil {
+			log.Errorf("failed to recover order %s: %+v", rec.OrderID, err)
+		}
+		cs.activeSagas.Delete(rec.OrderID)
+	}
+}
+
+func (cs *checkoutService) runSagaRecovery(ctx context.Context) {
+	cs.recoverSagas(ctx)
+	ticker := time.NewTicker(sagaRecoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cs.recoverSagas(ctx)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+var errPromotionLimit = errors.New("promotion usage limit reached")
+
+// promotionLedger counts how many orders used each promotion code, overall
+// and per user. With a path it keeps the counts in a JSON file, otherwise
+// they are lost on restart.
+type promotionLedger struct {
+	mu   sync.Mutex
+	path string
+
+	Uses     map[string]int `json:"uses"`      // by code
+	UserUses map[string]int `json:"user_uses"` // by code + "/" + user ID
+	// Redemptions are the uses each order recorded, by order ID, so that
+	// redeeming or giving them back twice has no further effect.
+	Redemptions map[string]redemption `json:"redemptions"`
+}
+
+// redemption is the uses recorded for one order.
+type redemption struct {
+	UserID string   `json:"user_id"`
+	Codes  []string `json:"codes"`
+}
+
+func newPromotionLedger(path string) (*promotionLedger, error) {
+	l := &promotionLedger{
+		path:        path,
+		Uses:        make(map[string]int),
+		UserUses:    make(map[string]int),
+		Redemptions: make(map[string]redemption),
+	}
+	if path == "" {
+		return l, nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil, err
+	}
+	if l.Redemptions == nil {
+		l.Redemptions = make(map[string]redemption)
+	}
+	return l, nil
+}
+
+func userUseKey(code, userID string) string { return code + "/" + userID }
+
+// uses returns how many orders used code, in total and by the user.
+func (l *promotionLedger) uses(code, userID string) (total, byUser int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Uses[code], l.UserUses[userUseKey(code, userID)]
+}
+
+// redeem records one use of each promotion by the user for the order. It
+// returns errPromotionLimit, and records nothing, if any of them is used up.
+// Redeeming for an order that already has its uses recorded does nothing.
+func (l *promotionLedger) redeem(orderID, userID string, promos []*promotion) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.Redemptions[orderID]; ok {
+		return nil
+	}
+	for _, p := range promos {
+		if (p.MaxUses > 0 && l.Uses[p.Code] >= p.MaxUses) ||
+			(p.MaxUsesPerUser > 0 && l.UserUses[userUseKey(p.Code, userID)] >= p.MaxUsesPerUser) {
+			return errPromotionLimit
+		}
+	}
+	r := redemption{UserID: userID}
+	for _, p := range promos {
+		r.Codes = append(r.Codes, p.Code)
+	}
+	l.record(orderID, r)
+	if err := l.saveLocked(); err != nil {
+		l.release(orderID)
+		return err
+	}
+	return nil
+}
+
+// unredeem gives back the uses redeem recorded for the order, e.g. when the
+// order fails. It does nothing if the order has none.
+func (l *promotionLedger) unredeem(orderID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r, ok := l.Redemptions[orderID]
+	if !ok {
+		return nil
+	}
+	l.release(orderID)
+	if err := l.saveLocked(); err != nil {
+		l.record(orderID, r)
+		return err
+	}
+	return nil
+}
+
+func (l *promotionLedger) record(orderID string, r redemption) {
+	for _, code := range r.Codes {
+		l.Uses[code]++
+		l.UserUses[userUseKey(code, r.UserID)]++
+	}
+	l.Redemptions[orderID] = r
+}
+
+func (l *promotionLedger) release(orderID string) {
+	r := l.Redemptions[orderID]
+	for _, code := range r.Codes {
+		if l.Uses[code] > 1 {
+			l.Uses[code]--
+		} else {
+			delete(l.Uses, code)
+		}
+		k := userUseKey(code, r.UserID)
+		if l.UserUses[k] > 1 {
+			l.UserUses[k]--
+		} else {
+			delete(l.UserUses, k)
+		}
+	}
+	delete(l.Redemptions, orderID)
+}
+
+func (l *promotionLedger) saveLocked() error {
+	if l.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a torn file.
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
@@ -0,0 +1,443 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/money"
+)
+
+// defaultPromotionsJSON is used when PROMOTIONS_PATH is not set.
+//
+//go:embed promotions.json
+var defaultPromotionsJSON []byte
+
+type promotionType string
+
+const (
+	promotionPercentOff   promotionType = "percent_off"
+	promotionAmountOff    promotionType = "amount_off"
+	promotionBuyXGetY     promotionType = "buy_x_get_y"
+	promotionFreeShipping promotionType = "free_shipping"
+)
+
+// promotion is a discount unlocked by a code. Amounts and percentages are
+// decimal strings, e.g. "5.00" or "12.5".
+type promotion struct {
+	Code        string        `json:"code"`
+	Description string        `json:"description"`
+	Type        promotionType `json:"type"`
+
+	// Percent is the discount for percent_off promotions.
+	Percent string `json:"percent"`
+	// AmountUSD is the discount for amount_off promotions, converted to the
+	// shopper's currency.
+	AmountUSD string `json:"amount_usd"`
+	// Buy and Get configure buy_x_get_y promotions: for every Buy+Get
+	// eligible units, the Get cheapest ones are free.
+	Buy int `json:"buy"`
+	Get int `json:"get"`
+
+	// Categories limits the promotion to products in any of the categories.
+	// Empty means every product is eligible.
+	Categories []string `json:"categories"`
+	// MinSpendUSD is the least the eligible items must be worth.
+	MinSpendUSD string `json:"min_spend_usd"`
+
+	// StartsAt and ExpiresAt bound when the code can be used. Zero means no
+	// bound.
+	StartsAt  time.Time `json:"starts_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxUses and MaxUsesPerUser limit how many orders can use the code.
+	// Zero means no limit.
+	MaxUses        int `json:"max_uses"`
+	MaxUsesPerUser int `json:"max_uses_per_user"`
+
+	percent     *big.Rat
+	amountUSD   pb.Money
+	minSpendUSD pb.Money
+}
+
+// promotionRules holds the promotions that can be redeemed, by code.
+type promotionRules struct {
+	Promotions []*promotion `json:"promotions"`
+
+	byCode map[string]*promotion
+}
+
+// loadPromotions reads the promotions at path, or the built-in promotions if
+// path is empty.
+func loadPromotions(path string) (*promotionRules, error) {
+	if path == "" {
+		return parsePromotions(defaultPromotionsJSON)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePromotions(b)
+}
+
+func parsePromotions(b []byte) (*promotionRules, error) {
+	r := new(promotionRules)
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("failed to parse promotions: %w", err)
+	}
+	r.byCode = make(map[string]*promotion)
+	for _, p := range r.Promotions {
+		if err := p.init(); err != nil {
+			return nil, fmt.Errorf("promotion %q: %w", p.Code, err)
+		}
+		if _, ok := r.byCode[p.Code]; ok {
+			return nil, fmt.Errorf("duplicate promotion %q", p.Code)
+		}
+		r.byCode[p.Code] = p
+	}
+	return r, nil
+}
+
+func (p *promotion) init() error {
+	p.Code = normalizePromotionCode(p.Code)
+	if p.Code == "" {
+		return fmt.Errorf("code must be set")
+	}
+	if p.MaxUses < 0 || p.MaxUsesPerUser < 0 {
+		return fmt.Errorf("usage limits must not be negative")
+	}
+	var err error
+	if p.MinSpendUSD != "" {
+		if p.minSpendUSD, err = parseUSD(p.MinSpendUSD); err != nil {
+			return err
+		}
+	}
+	switch p.Type {
+	case promotionPercentOff:
+		r, ok := new(big.Rat).SetString(p.Percent)
+		if !ok || r.Sign() <= 0 || r.Cmp(big.NewRat(100, 1)) > 0 {
+			return fmt.Errorf("percent %q must be a decimal between 0 and 100", p.Percent)
+		}
+		p.percent = r.Quo(r, big.NewRat(100, 1))
+	case promotionAmountOff:
+		if p.amountUSD, err = parseUSD(p.AmountUSD); err != nil {
+			return err
+		}
+		if !money.IsPositive(p.amountUSD) {
+			return fmt.Errorf("amount_usd must be positive")
+		}
+	case promotionBuyXGetY:
+		if p.Buy < 1 || p.Get < 1 {
+			return fmt.Errorf("buy and get must be at least 1")
+		}
+	case promotionFreeShipping:
+	default:
+		return fmt.Errorf("unknown type %q", p.Type)
+	}
+	return nil
+}
+
+// parseUSD parses a non-negative decimal amount of dollars.
+func parseUSD(s string) (pb.Money, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || r.Sign() < 0 {
+		return pb.Money{}, fmt.Errorf("amount %q must be a non-negative decimal", s)
+	}
+	nanos := new(big.Rat).Mul(r, big.NewRat(1e9, 1))
+	if !nanos.IsInt() || !nanos.Num().IsInt64() {
+		return pb.Money{}, fmt.Errorf("amount %q is out of range", s)
+	}
+	n := nanos.Num().Int64()
+	return pb.Money{CurrencyCode: usdCurrency, Units: n / 1e9, Nanos: int32(n % 1e9)}, nil
+}
+
+func normalizePromotionCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// promotionCart is a priced cart to apply promotions to.
+type promotionCart struct {
+	userID   string
+	currency string
+	items    *pricedItems
+	// shippingCost is what the promotion waives for free_shipping, in
+	// currency.
+	shippingCost pb.Money
+	// convert converts USD amounts to currency.
+	convert func(pb.Money) (pb.Money, error)
+}
+
+// promotionResult is the outcome of applying promotion codes to a cart.
+type promotionResult struct {
+	applied   []*promotion
+	discounts []*pb.DiscountLine
+	rejected  []*pb.RejectedPromotion
+	// lines holds each item's total after discounts.
+	lines []pb.Money
+	// total is the sum of the discounts.
+	total pb.Money
+}
+
+// promotionRejection is a reason, shown to the shopper, why a promotion does
+// not apply.
+type promotionRejection string
+
+func (r promotionRejection) Error() string { return string(r) }
+
+// apply applies codes to cart in order. Each promotion discounts what is left
+// after the ones before it, so items never go below zero. Codes that do not
+// apply are reported in the result rather than as an error.
+func (r *promotionRules) apply(codes []string, cart *promotionCart, usage *promotionLedger, now time.Time) (*promotionResult, error) {
+	res := &promotionResult{
+		lines: append([]pb.Money(nil), cart.items.lines...),
+		total: pb.Money{CurrencyCode: cart.currency},
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		code = normalizePromotionCode(code)
+		if code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+
+		p, ok := r.byCode[code]
+		if !ok {
+			res.reject(code, "This code is not valid.")
+			continue
+		}
+		discounts, err := p.discounts(cart, res.lines, usage, now)
+		if rejection, ok := err.(promotionRejection); ok {
+			res.reject(code, string(rejection))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		line := &pb.DiscountLine{Code: p.Code, Description: p.Description}
+		amount := pb.Money{CurrencyCode: cart.currency}
+		for i, d := range discounts {
+			if i < len(res.lines) {
+				if res.lines[i], err = money.Sum(res.lines[i], money.Negate(d)); err != nil {
+					return nil, err
+				}
+			}
+			if amount, err = money.Sum(amount, d); err != nil {
+				return nil, err
+			}
+		}
+		if res.total, err = money.Sum(res.total, amount); err != nil {
+			return nil, err
+		}
+		line.Amount = &amount
+		res.applied = append(res.applied, p)
+		res.discounts = append(res.discounts, line)
+	}
+	return res, nil
+}
+
+func (res *promotionResult) reject(code, reason string) {
+	res.rejected = append(res.rejected, &pb.RejectedPromotion{Code: code, Reason: reason})
+}
+
+// discounts returns how much p takes off each item given what is left of
+// the item totals in lines. For free_shipping the shipping discount is
+// returned as an extra element after the items. It returns a
+// promotionRejection if p cannot be applied.
+func (p *promotion) discounts(cart *promotionCart, lines []pb.Money, usage *promotionLedger, now time.Time) ([]pb.Money, error) {
+	if !p.StartsAt.IsZero() && now.Before(p.StartsAt) {
+		return nil, promotionRejection("This code is not active yet.")
+	}
+	if !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt) {
+		return nil, promotionRejection("This code has expired.")
+	}
+	total, byUser := usage.uses(p.Code, cart.userID)
+	if p.MaxUses > 0 && total >= p.MaxUses {
+		return nil, promotionRejection("This code has reached its usage limit.")
+	}
+	if p.MaxUsesPerUser > 0 && byUser >= p.MaxUsesPerUser {
+		return nil, promotionRejection("You have already used this code.")
+	}
+
+	items := cart.items
+	var eligible []int
+	spentUSD := pb.Money{CurrencyCode: usdCurrency}
+	for i, it := range items.items {
+		if !p.covers(items.categories[i]) {
+			continue
+		}
+		eligible = append(eligible, i)
+		line, err := money.Multiply(*items.pricesUSD[i], int64(it.GetItem().GetQuantity()))
+		if err == nil {
+			spentUSD, err = money.Sum(spentUSD, line)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(eligible) == 0 {
+		return nil, promotionRejection("No items in your cart qualify for this code.")
+	}
+	if p.MinSpendUSD != "" && moneyLess(spentUSD, p.minSpendUSD) {
+		return nil, promotionRejection(fmt.Sprintf("Spend at least $%s on qualifying items to use this code.", money.Format(p.minSpendUSD)))
+	}
+
+	decimals := money.MinorUnits(cart.currency)
+	out := make([]pb.Money, len(lines))
+	for i := range out {
+		out[i] = pb.Money{CurrencyCode: cart.currency}
+	}
+	var err error
+	switch p.Type {
+	case promotionPercentOff:
+		for _, i := range eligible {
+			d, err := money.MultiplyDecimal(lines[i], p.percent.RatString(), money.RoundHalfEven)
+			if err == nil {
+				d, err = money.Round(d, decimals, money.RoundHalfEven)
+			}
+			if err != nil {
+				return nil, err
+			}
+			out[i] = d
+		}
+	case promotionAmountOff:
+		amount := p.amountUSD
+		if cart.currency != usdCurrency {
+			if amount, err = cart.convert(amount); err != nil {
+				return nil, err
+			}
+		}
+		if amount, err = money.Round(amount, decimals, money.RoundHalfEven); err != nil {
+			return nil, err
+		}
+		if out, err = allocateDiscount(amount, lines, eligible, decimals); err != nil {
+			return nil, err
+		}
+	case promotionBuyXGetY:
+		type unit struct {
+			item  int
+			price pb.Money
+		}
+		var units []unit
+		for _, i := range eligible {
+			for n := int32(0); n < items.items[i].GetItem().GetQuantity(); n++ {
+				units = append(units, unit{i, *items.items[i].GetCost()})
+			}
+		}
+		sort.SliceStable(units, func(a, b int) bool { return moneyLess(units[b].price, units[a].price) })
+		group := p.Buy + p.Get
+		for g := 0; g+group <= len(units); g += group {
+			for _, u := range units[g+p.Buy : g+group] {
+				if out[u.item], err = money.Sum(out[u.item], u.price); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, i := range eligible {
+			if out[i], err = money.Round(out[i], decimals, money.RoundHalfEven); err != nil {
+				return nil, err
+			}
+			if moneyLess(lines[i], out[i]) {
+				out[i] = lines[i]
+			}
+		}
+	case promotionFreeShipping:
+		if !money.IsPositive(cart.shippingCost) {
+			return nil, promotionRejection("Shipping is already free.")
+		}
+		return append(out, cart.shippingCost), nil
+	}
+
+	for _, d := range out {
+		if money.IsPositive(d) {
+			return out, nil
+		}
+	}
+	if p.Type == promotionBuyXGetY {
+		return nil, promotionRejection(fmt.Sprintf("Add %d qualifying items to your cart to use this code.", p.Buy+p.Get))
+	}
+	return nil, promotionRejection("This code does not reduce your order.")
+}
+
+// covers reports whether a product in categories is eligible for p.
+func (p *promotion) covers(categories []string) bool {
+	if len(p.Categories) == 0 {
+		return true
+	}
+	for _, c := range categories {
+		if containsFold(p.Categories, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateDiscount spreads amount over the eligible lines in proportion to
+// their value, taking at most the whole of each line.
+func allocateDiscount(amount pb.Money, lines []pb.Money, eligible []int, decimals int) ([]pb.Money, error) {
+	out := make([]pb.Money, len(lines))
+	for i := range out {
+		out[i] = pb.Money{CurrencyCode: amount.GetCurrencyCode()}
+	}
+	left := pb.Money{CurrencyCode: amount.GetCurrencyCode()}
+	ratios := make([]int64, len(eligible))
+	for n, i := range eligible {
+		var err error
+		if left, err = money.Sum(left, lines[i]); err != nil {
+			return nil, err
+		}
+		minor, err := money.Round(lines[i], decimals, money.RoundDown)
+		if err != nil {
+			return nil, err
+		}
+		ratios[n] = minor.GetUnits()*pow10(decimals) + int64(minor.GetNanos())/pow10(9-decimals)
+	}
+	if !moneyLess(amount, left) {
+		// The discount covers everything.
+		for _, i := range eligible {
+			out[i] = lines[i]
+		}
+		return out, nil
+	}
+	parts, err := money.Allocate(amount, ratios, decimals)
+	if err != nil {
+		return nil, err
+	}
+	for n, i := range eligible {
+		out[i] = parts[n]
+	}
+	return out, nil
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
+// moneyLess reports whether a is less than b. Both must be valid and in the
+// same currency.
+func moneyLess(a, b pb.Money) bool {
+	d, err := money.Sum(a, money.Negate(b))
+	return err == nil && money.IsNegative(d)
+}
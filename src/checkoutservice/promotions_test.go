@@ -0,0 +1,233 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+const testPromotions = `{"promotions": [
+	{"code": "TEN", "description": "10% off", "type": "percent_off", "percent": "10"},
+	{"code": "five", "description": "$5 off", "type": "amount_off", "amount_usd": "5", "min_spend_usd": "50"},
+	{"code": "KITCHEN", "description": "25% off kitchen", "type": "percent_off", "percent": "25", "categories": ["kitchen"]},
+	{"code": "B2G1", "description": "Buy 2 get 1", "type": "buy_x_get_y", "buy": 2, "get": 1},
+	{"code": "SHIP", "description": "Free shipping", "type": "free_shipping"},
+	{"code": "OLD", "description": "Expired", "type": "percent_off", "percent": "50", "expires_at": "2024-01-01T00:00:00Z"},
+	{"code": "ONCE", "description": "Once", "type": "percent_off", "percent": "5", "max_uses_per_user": 1},
+	{"code": "HUNDRED", "description": "All of it", "type": "amount_off", "amount_usd": "100"}
+]}`
+
+func usd(units int64, nanos int32) pb.Money {
+	return pb.Money{CurrencyCode: "USD", Units: units, Nanos: nanos}
+}
+
+// testCart has 2 mugs at $8.50 and a shirt at $40.
+func testCart() *promotionCart {
+	mug, shirt := usd(8, 500000000), usd(40, 0)
+	return &promotionCart{
+		userID:   "alice",
+		currency: "USD",
+		items: &pricedItems{
+			items: []*pb.OrderItem{
+				{Item: &pb.CartItem{ProductId: "mug", Quantity: 2}, Cost: &mug},
+				{Item: &pb.CartItem{ProductId: "shirt", Quantity: 1}, Cost: &shirt},
+			},
+			lines:      []pb.Money{usd(17, 0), usd(40, 0)},
+			categories: [][]string{{"kitchen"}, {"clothing"}},
+			pricesUSD:  []*pb.Money{&mug, &shirt},
+		},
+		shippingCost: usd(7, 990000000),
+		convert:      func(m pb.Money) (pb.Money, error) { return m, nil },
+	}
+}
+
+func TestApplyPromotions(t *testing.T) {
+	rules, err := parsePromotions([]byte(testPromotions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, _ := newPromotionLedger("")
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		codes     []string
+		want      pb.Money   // total discount
+		wantLines []pb.Money // item totals after discounts
+		rejected  int
+	}{
+		{"percent", []string{"ten"}, usd(5, 700000000), []pb.Money{usd(15, 300000000), usd(36, 0)}, 0},
+		{"amount spread by value", []string{"FIVE"}, usd(5, 0), []pb.Money{usd(15, 500000000), usd(36, 500000000)}, 0},
+		{"category", []string{"KITCHEN"}, usd(4, 250000000), []pb.Money{usd(12, 750000000), usd(40, 0)}, 0},
+		{"buy x get y", []string{"B2G1"}, usd(8, 500000000), []pb.Money{usd(8, 500000000), usd(40, 0)}, 0},
+		{"free shipping", []string{"SHIP"}, usd(7, 990000000), []pb.Money{usd(17, 0), usd(40, 0)}, 0},
+		// 10% of the remaining 12.75 and 40 after the kitchen discount.
+		{"stacked", []string{"KITCHEN", "TEN", "ten"}, usd(9, 530000000), []pb.Money{usd(11, 470000000), usd(36, 0)}, 0},
+		{"capped at item totals", []string{"HUNDRED", "TEN"}, usd(57, 0), []pb.Money{usd(0, 0), usd(0, 0)}, 1},
+		{"unknown and expired", []string{"NOPE", "OLD"}, usd(0, 0), []pb.Money{usd(17, 0), usd(40, 0)}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := rules.apply(tt.codes, testCart(), usage, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.total.GetUnits() != tt.want.GetUnits() || res.total.GetNanos() != tt.want.GetNanos() {
+				t.Errorf("got discount %v, want %v", &res.total, &tt.want)
+			}
+			for i, l := range res.lines {
+				if l.GetUnits() != tt.wantLines[i].GetUnits() || l.GetNanos() != tt.wantLines[i].GetNanos() {
+					t.Errorf("line %d: got %v, want %v", i, &l, &tt.wantLines[i])
+				}
+			}
+			if len(res.rejected) != tt.rejected {
+				t.Errorf("got %d rejected codes (%v), want %d", len(res.rejected), res.rejected, tt.rejected)
+			}
+			if len(res.discounts) != len(res.applied) {
+				t.Errorf("got %d discount lines for %d promotions", len(res.discounts), len(res.applied))
+			}
+		})
+	}
+}
+
+func TestPromotionMinimumSpend(t *testing.T) {
+	rules, err := parsePromotions([]byte(testPromotions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, _ := newPromotionLedger("")
+	cart := testCart()
+	cart.items.items = cart.items.items[:1]
+	cart.items.lines = cart.items.lines[:1]
+	res, err := rules.apply([]string{"FIVE"}, cart, usage, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.rejected) != 1 || res.rejected[0].GetReason() != "Spend at least $50.00 on qualifying items to use this code." {
+		t.Errorf("got rejected %v, want the minimum spend reason", res.rejected)
+	}
+}
+
+func TestPromotionUsageLimits(t *testing.T) {
+	rules, err := parsePromotions([]byte(testPromotions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "usage.json")
+	usage, err := newPromotionLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	once := rules.byCode["ONCE"]
+	if err := usage.redeem("order-1", "alice", []*promotion{once}); err != nil {
+		t.Fatal(err)
+	}
+	if err := usage.redeem("order-2", "alice", []*promotion{once}); err != errPromotionLimit {
+		t.Errorf("second redeem: got %v, want errPromotionLimit", err)
+	}
+
+	// Usage survives a restart.
+	usage, err = newPromotionLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := rules.apply([]string{"ONCE"}, testCart(), usage, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.rejected) != 1 {
+		t.Errorf("got %d rejected codes, want 1", len(res.rejected))
+	}
+	bob := testCart()
+	bob.userID = "bob"
+	if res, _ := rules.apply([]string{"ONCE"}, bob, usage, time.Now()); len(res.applied) != 1 {
+		t.Errorf("other users should still be able to use the code, got %v", res.rejected)
+	}
+
+	// Giving the use back makes the code available again.
+	if err := usage.unredeem("order-1"); err != nil {
+		t.Fatal(err)
+	}
+	if total, byUser := usage.uses("ONCE", "alice"); total != 0 || byUser != 0 {
+		t.Errorf("got %d uses (%d by alice) after unredeem, want 0", total, byUser)
+	}
+}
+
+// TestPromotionUnredeemOnlyGivesBackTheOrdersUses checks that retried or
+// repeated compensations do not erase other orders' uses.
+func TestPromotionUnredeemOnlyGivesBackTheOrdersUses(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ledger")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := newPromotionLedger(filepath.Join(dir, "usage.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := &promotion{Code: "SAVE"}
+	for _, order := range []string{"order-1", "order-2"} {
+		if err := usage.redeem(order, "alice", []*promotion{code}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := usage.redeem("order-1", "alice", []*promotion{code}); err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := usage.uses("SAVE", "alice"); total != 2 {
+		t.Errorf("got %d uses after redeeming an order twice, want 2", total)
+	}
+
+	// A failed save leaves the uses in place, so that a retry gives them
+	// back once.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := usage.unredeem("order-1"); err == nil {
+		t.Fatal("unredeem succeeded without a ledger directory")
+	}
+	if total, _ := usage.uses("SAVE", "alice"); total != 2 {
+		t.Errorf("got %d uses after a failed unredeem, want 2", total)
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := usage.unredeem("order-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total, byUser := usage.uses("SAVE", "alice"); total != 1 || byUser != 1 {
+		t.Errorf("got %d uses (%d by alice), want order-2's use left", total, byUser)
+	}
+}
+
+func TestParsePromotionsRejectsBadConfig(t *testing.T) {
+	for _, promos := range []string{
+		`{"promotions": [{"code": "X", "type": "percent_off", "percent": "150"}]}`,
+		`{"promotions": [{"code": "X", "type": "amount_off", "amount_usd": "0"}]}`,
+		`{"promotions": [{"code": "X", "type": "buy_x_get_y", "buy": 1}]}`,
+		`{"promotions": [{"code": "X", "type": "bogus"}]}`,
+		`{"promotions": [{"code": "X", "type": "free_shipping"}, {"code": "x", "type": "free_shipping"}]}`,
+	} {
+		if _, err := parsePromotions([]byte(promos)); err == nil {
+			t.Errorf("parsePromotions(%s) succeeded, want error", promos)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+const (
+	sagaStepRetries  = 3
+	sagaRetryBackoff = 200 * time.Millisecond
+)
+
+// sagaStatus is the overall state of a saga.
+type sagaStatus string
+
+const (
+	sagaRunning     sagaStatus = "RUNNING"
+	sagaCompleted   sagaStatus = "COMPLETED"
+	sagaCompensated sagaStatus = "COMPENSATED"
+	// sagaFailed means a compensation could not be applied, or the outcome of
+	// a step is unknown, and the order needs manual reconciliation.
+	sagaFailed sagaStatus = "FAILED"
+)
+
+// stepStatus is the state of a single step within a saga.
+type stepStatus string
+
+const (
+	stepPending     stepStatus = ""
+	stepStarted     stepStatus = "STARTED"
+	stepDone        stepStatus = "DONE"
+	stepFailed      stepStatus = "FAILED"
+	stepCompensated stepStatus = "COMPENSATED"
+)
+
+// sagaRecord is the persisted state of a saga. It only holds what is needed
+// to compensate or resume the saga after a restart (no payment details).
+type sagaRecord struct {
+	OrderID   string                `json:"order_id"`
+	Status    sagaStatus            `json:"status"`
+	Steps     map[string]stepStatus `json:"steps"`
+	UpdatedAt time.Time             `json:"updated_at"`
+
+	UserID        string          `json:"user_id"`
+	Email         string          `json:"email"`
+	TransactionID string          `json:"transaction_id,omitempty"`
+	Charged       *pb.Money       `json:"charged,omitempty"`
+	Order         *pb.OrderResult `json:"order,omitempty"`
+}
+
+func newSagaRecord(orderID, userID, email string) *sagaRecord {
+	return &sagaRecord{
+		OrderID: orderID,
+		Status:  sagaRunning,
+		Steps:   make(map[string]stepStatus),
+		UserID:  userID,
+		Email:   email,
+	}
+}
+
+func (r *sagaRecord) stepStatus(name string) stepStatus { return r.Steps[name] }
+
+// sagaStep is a single unit of work in a saga together with the action that
+// undoes it.
+type sagaStep struct {
+	name   string
+	action func(ctx context.Context) error
+
+	// compensate reverses a completed action. nil means there is nothing to
+	// undo (e.g. read-only steps).
+	compensate func(ctx context.Context) error
+
+	// retriable steps come after the pivot of the saga: once the pivot has
+	// succeeded the saga can only move forward, so these steps are retried
+	// (and resumed after a restart) instead of being compensated.
+	retriable bool
+}
+
+// saga runs an ordered list of steps and persists the state of each one, so
+// a failure partway through is either compensated or resumed.
+type saga struct {
+	rec   *sagaRecord
+	steps []sagaStep
+	store sagaStore
+}
+
+// run executes all steps that have not completed yet. If a non-retriable step
+// fails, the steps completed before it are compensated in reverse order and
+// the error of the failed step is returned. If the failed step may still
+// have taken effect, because it is the pivot or its error does not say, the
+// saga is left for manual reconciliation instead.
+func (s *saga) run(ctx context.Context) error {
+	if err := s.store.save(s.rec); err != nil {
+		return fmt.Errorf("failed to persist order state: %+v", err)
+	}
+	for i, step := range s.steps {
+		if s.rec.stepStatus(step.name) == stepDone {
+			continue
+		}
+		if step.retriable {
+			s.runWithRetry(ctx, step)
+			continue
+		}
+		s.setStep(step.name, stepStarted)
+		if err := step.action(ctx); err != nil {
+			if i == s.pivot() || (step.compensate != nil && outcomeUnknown(err)) {
+				// The step may have taken effect, so it stays started and
+				// nothing is undone.
+				log.Errorf("[saga %s] outcome of step %q is unknown, manual reconciliation required: %+v", s.rec.OrderID, step.name, err)
+				s.rec.Status = sagaFailed
+				s.persist()
+				return err
+			}
+			log.Warnf("[saga %s] step %q failed, compensating: %+v", s.rec.OrderID, step.name, err)
+			s.setStep(step.name, stepFailed)
+			s.compensate(ctx, i-1)
+			return err
+		}
+		s.setStep(step.name, stepDone)
+	}
+	s.finish()
+	return nil
+}
+
+// resume continues a saga that was interrupted, e.g. by a restart. A saga
+// that got past its pivot is driven forward; anything else is rolled back
+// since the steps before the pivot cannot be replayed. If a step with side
+// effects was interrupted, including the pivot, whether it took effect is
+// unknown, so the saga is left for manual reconciliation instead.
+func (s *saga) resume(ctx context.Context) error {
+	pivot := s.pivot()
+	if s.rec.stepStatus(s.steps[pivot].name) == stepDone {
+		log.Infof("[saga %s] resuming", s.rec.OrderID)
+		return s.run(ctx)
+	}
+
+	for i, step := range s.steps[:pivot+1] {
+		// The pivot cannot be compensated, so if it may have happened the
+		// steps before it must not be either.
+		inDoubt := step.compensate != nil || i == pivot
+		if inDoubt && s.rec.stepStatus(step.name) == stepStarted {
+			s.rec.Status = sagaFailed
+			s.persist()
+			return fmt.Errorf("saga %s: outcome of step %q is unknown, manual reconciliation required",
+				s.rec.OrderID, step.name)
+		}
+	}
+	log.Infof("[saga %s] rolling back interrupted saga", s.rec.OrderID)
+	if !s.compensate(ctx, pivot) {
+		return fmt.Errorf("saga %s: compensation failed", s.rec.OrderID)
+	}
+	return nil
+}
+
+// compensate undoes the completed steps at indices [0, from] in reverse
+// order. It reports whether all compensations succeeded.
+func (s *saga) compensate(ctx context.Context, from int) bool {
+	// Compensations must run even if the caller has gone away.
+	ctx = context.WithoutCancel(ctx)
+	for i := from; i >= 0; i-- {
+		step := s.steps[i]
+		if step.compensate == nil || s.rec.stepStatus(step.name) != stepDone {
+			continue
+		}
+		if err := retry(ctx, step.compensate); err != nil {
+			log.Errorf("[saga %s] failed to compensate step %q: %+v", s.rec.OrderID, step.name, err)
+			s.rec.Status = sagaFailed
+			s.persist()
+			return false
+		}
+		s.setStep(step.name, stepCompensated)
+	}
+	s.rec.Status = sagaCompensated
+	s.persist()
+	return true
+}
+
+// runWithRetry runs a retriable step. On failure the step is left pending so
+// that a later resume picks it up.
+func (s *saga) runWithRetry(ctx context.Context, step sagaStep) {
+	s.setStep(step.name, stepStarted)
+	if err := retry(ctx, step.action); err != nil {
+		log.Warnf("[saga %s] step %q failed, will be resumed later: %+v", s.rec.OrderID, step.name, err)
+		s.setStep(step.name, stepFailed)
+		return
+	}
+	s.setStep(step.name, stepDone)
+}
+
+// finish marks the saga completed once every step is done.
+func (s *saga) finish() {
+	for _, step := range s.steps {
+		if s.rec.stepStatus(step.name) != stepDone {
+			return
+		}
+	}
+	s.rec.Status = sagaCompleted
+	s.persist()
+}
+
+// pivot returns the index of the last non-retriable step.
+func (s *saga) pivot() int {
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		if !s.steps[i].retriable {
+			return i
+		}
+	}
+	return 0
+}
+
+func (s *saga) setStep(name string, st stepStatus) {
+	s.rec.Steps[name] = st
+	s.persist()
+}
+
+func (s *saga) persist() {
+	s.rec.UpdatedAt = time.Now()
+	if err := s.store.save(s.rec); err != nil {
+		log.Warnf("[saga %s] failed to persist state: %+v", s.rec.OrderID, err)
+	}
+}
+
+// outcomeUnknown reports whether err leaves open whether the call that
+// returned it took effect.
+func outcomeUnknown(err error) bool {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded, codes.Unavailable, codes.Canceled:
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// retry calls fn up to sagaStepRetries times with exponential backoff.
+func retry(ctx context.Context, fn func(context.Context) error) error {
+	var err error
+	backoff := sagaRetryBackoff
+	for i := 0; i < sagaStepRetries; i++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if i == sagaStepRetries-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
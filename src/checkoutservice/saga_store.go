@@ -0,0 +1,187 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+// sagaStore persists saga records. Records that reached a terminal state
+// other than sagaFailed are dropped, so the store only holds sagas that still
+// need attention.
+type sagaStore interface {
+	save(rec *sagaRecord) error
+	listIncomplete() ([]*sagaRecord, error)
+}
+
+func isTerminal(st sagaStatus) bool {
+	return st == sagaCompleted || st == sagaCompensated
+}
+
+// sagaRecordJSON is the JSON form of a sagaRecord. Its protobuf fields are
+// in the protobuf JSON form, and take the place of the record's own.
+type sagaRecordJSON struct {
+	*sagaRecordFields
+	Charged json.RawMessage `json:"charged,omitempty"`
+	Order   json.RawMessage `json:"order,omitempty"`
+}
+
+// sagaRecordFields is a sagaRecord without its JSON methods.
+type sagaRecordFields sagaRecord
+
+func (r *sagaRecord) MarshalJSON() ([]byte, error) {
+	j := sagaRecordJSON{sagaRecordFields: (*sagaRecordFields)(r)}
+	var err error
+	if r.Charged != nil {
+		if j.Charged, err = marshalProto(r.Charged); err != nil {
+			return nil, err
+		}
+	}
+	if r.Order != nil {
+		if j.Order, err = marshalProto(r.Order); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(j)
+}
+
+func (r *sagaRecord) UnmarshalJSON(b []byte) error {
+	j := sagaRecordJSON{sagaRecordFields: (*sagaRecordFields)(r)}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Charged != nil {
+		r.Charged = new(pb.Money)
+		if err := unmarshalProto(j.Charged, r.Charged); err != nil {
+			return err
+		}
+	}
+	if j.Order != nil {
+		r.Order = new(pb.OrderResult)
+		if err := unmarshalProto(j.Order, r.Order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memorySagaStore keeps saga records in memory. State does not survive a
+// restart, but interrupted retriable steps are still resumed.
+type memorySagaStore struct {
+	mu      sync.Mutex
+	records map[string][]byte
+}
+
+func newMemorySagaStore() *memorySagaStore {
+	return &memorySagaStore{records: make(map[string][]byte)}
+}
+
+func (m *memorySagaStore) save(rec *sagaRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if isTerminal(rec.Status) {
+		delete(m.records, rec.OrderID)
+	} else {
+		m.records[rec.OrderID] = b
+	}
+	return nil
+}
+
+func (m *memorySagaStore) listIncomplete() ([]*sagaRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*sagaRecord
+	for _, b := range m.records {
+		rec := new(sagaRecord)
+		if err := json.Unmarshal(b, rec); err != nil {
+			return nil, err
+		}
+		if rec.Status == sagaRunning {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+// fileSagaStore keeps one JSON file per saga in a directory.
+type fileSagaStore struct {
+	dir string
+}
+
+func newFileSagaStore(dir string) (*fileSagaStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileSagaStore{dir: dir}, nil
+}
+
+func (f *fileSagaStore) path(orderID string) string {
+	return filepath.Join(f.dir, orderID+".json")
+}
+
+func (f *fileSagaStore) save(rec *sagaRecord) error {
+	if isTerminal(rec.Status) {
+		if err := os.Remove(f.path(rec.OrderID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a torn record.
+	tmp := f.path(rec.OrderID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path(rec.OrderID))
+}
+
+func (f *fileSagaStore) listIncomplete() ([]*sagaRecord, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []*sagaRecord
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(f.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		rec := new(sagaRecord)
+		if err := json.Unmarshal(b, rec); err != nil {
+			log.Warnf("skipping unreadable saga record %s: %v", e.Name(), err)
+			continue
+		}
+		if rec.Status == sagaRunning {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,332 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// recordingSaga builds a saga whose steps append to calls. Steps listed in
+// failing return an error.
+func recordingSaga(store sagaStore, rec *sagaRecord, calls *[]string, failing map[string]bool) *saga {
+	step := func(name string, compensable, retriable bool) sagaStep {
+		s := sagaStep{name: name, retriable: retriable}
+		s.action = func(context.Context) error {
+			*calls = append(*calls, name)
+			if failing[name] {
+				return errors.New(name + " failed")
+			}
+			return nil
+		}
+		if compensable {
+			s.compensate = func(context.Context) error {
+				*calls = append(*calls, "undo "+name)
+				return nil
+			}
+		}
+		return s
+	}
+	return &saga{rec: rec, store: store, steps: []sagaStep{
+		step("reserve", true, false),
+		step("charge", true, false),
+		step("ship", false, false),
+		step("notify", false, true),
+	}}
+}
+
+func TestSagaCompletes(t *testing.T) {
+	store := newMemorySagaStore()
+	rec := newSagaRecord("order-1", "user", "a@example.com")
+	var calls []string
+	if err := recordingSaga(store, rec, &calls, nil).run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"reserve", "charge", "ship", "notify"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+	if got, want := rec.Status, sagaCompleted; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+	if recs, _ := store.listIncomplete(); len(recs) != 0 {
+		t.Errorf("got %d incomplete sagas, want 0", len(recs))
+	}
+}
+
+func TestSagaCompensatesCompletedSteps(t *testing.T) {
+	rec := newSagaRecord("order-1", "user", "a@example.com")
+	var calls []string
+	err := recordingSaga(newMemorySagaStore(), rec, &calls, map[string]bool{"charge": true}).run(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := []string{"reserve", "charge", "undo reserve"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+	if got, want := rec.Status, sagaCompensated; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+}
+
+func TestSagaResumesRetriableStep(t *testing.T) {
+	store := newMemorySagaStore()
+	rec := newSagaRecord("order-1", "user", "a@example.com")
+	var calls []string
+	failing := map[string]bool{"notify": true}
+	if err := recordingSaga(store, rec, &calls, failing).run(context.Background()); err != nil {
+		t.Fatalf("retriable failure should not fail the saga: %v", err)
+	}
+	if got, want := rec.Status, sagaRunning; got != want {
+		t.Fatalf("got status %s, want %s", got, want)
+	}
+
+	recs, err := store.listIncomplete()
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("got %d incomplete sagas (err=%v), want 1", len(recs), err)
+	}
+	calls = nil
+	delete(failing, "notify")
+	if err := recordingSaga(store, recs[0], &calls, failing).resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"notify"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+	if got, want := recs[0].Status, sagaCompleted; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+}
+
+func TestSagaResumeBeforePivotRollsBack(t *testing.T) {
+	store, err := newFileSagaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newSagaRecord("order-1", "user", "a@example.com")
+	rec.Steps["reserve"] = stepDone
+	rec.Steps["charge"] = stepDone
+	rec.Steps["ship"] = stepFailed
+	if err := store.save(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := store.listIncomplete()
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("got %d incomplete sagas (err=%v), want 1", len(recs), err)
+	}
+	var calls []string
+	if err := recordingSaga(store, recs[0], &calls, nil).resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"undo charge", "undo reserve"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+	if recs, _ := store.listIncomplete(); len(recs) != 0 {
+		t.Errorf("got %d incomplete sagas, want 0", len(recs))
+	}
+}
+
+func TestSagaResumeWithUnknownOutcomeFails(t *testing.T) {
+	rec := newSagaRecord("order-1", "user", "a@example.com")
+	rec.Steps["reserve"] = stepDone
+	rec.Steps["charge"] = stepStarted
+	var calls []string
+	if err := recordingSaga(newMemorySagaStore(), rec, &calls, nil).resume(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(calls) != 0 {
+		t.Errorf("got calls %v, want none", calls)
+	}
+	if got, want := rec.Status, sagaFailed; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+}
+
+// TestSagaResumeWithUnknownPivotOutcomeFails checks that an order that may
+// have shipped is neither refunded nor restocked.
+func TestSagaResumeWithUnknownPivotOutcomeFails(t *testing.T) {
+	rec := newSagaRecord("order-1", "user", "a@example.com")
+	rec.Steps["reserve"] = stepDone
+	rec.Steps["charge"] = stepDone
+	rec.Steps["ship"] = stepStarted
+	var calls []string
+	if err := recordingSaga(newMemorySagaStore(), rec, &calls, nil).resume(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(calls) != 0 {
+		t.Errorf("got calls %v, want none", calls)
+	}
+	if got, want := rec.Status, sagaFailed; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+}
+
+func TestFileSagaStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileSagaStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newSagaRecord("order-1", "user", "a@example.com")
+	rec.Steps["charge_card"] = stepDone
+	rec.Steps["ship_order"] = stepDone
+	rec.TransactionID = "tx-1"
+	rec.Charged = &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}
+	rec.Order = &pb.OrderResult{
+		OrderId:            "order-1",
+		ShippingTrackingId: "track-1",
+		Tax:                &pb.TaxLine{Jurisdiction: "US-CA", Amount: &pb.Money{CurrencyCode: "USD", Units: 1, Nanos: 650000000}},
+		Discounts:          []*pb.DiscountLine{{Code: "TEN", Amount: &pb.Money{CurrencyCode: "USD", Units: 2}}},
+	}
+	if err := store.save(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "order-1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"units":"19"`)) {
+		t.Errorf("saga record is not in the protobuf JSON form: %s", b)
+	}
+	recs, err := store.listIncomplete()
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("got %d incomplete sagas (err=%v), want 1", len(recs), err)
+	}
+	got := recs[0]
+	if got.TransactionID != rec.TransactionID || !reflect.DeepEqual(got.Steps, rec.Steps) {
+		t.Errorf("got record %+v, want %+v", got, rec)
+	}
+	if !proto.Equal(got.Charged, rec.Charged) || !proto.Equal(got.Order, rec.Order) {
+		t.Errorf("got charged %v and order %v, want %v and %v", got.Charged, got.Order, rec.Charged, rec.Order)
+	}
+}
+
+// fakeFulfillment is a product catalog, payment and shipping service that
+// records the calls it gets. Its ShipOrder fails with shipErr.
+type fakeFulfillment struct {
+	pb.UnimplementedProductCatalogServiceServer
+	pb.UnimplementedPaymentServiceServer
+	pb.UnimplementedShippingServiceServer
+
+	shipErr error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeFulfillment) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeFulfillment) ReserveStock(context.Context, *pb.ReserveStockRequest) (*pb.ReserveStockResponse, error) {
+	f.record("ReserveStock")
+	return &pb.ReserveStockResponse{}, nil
+}
+
+func (f *fakeFulfillment) CommitReservation(context.Context, *pb.CommitReservationRequest) (*pb.Empty, error) {
+	f.record("CommitReservation")
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeFulfillment) ReleaseReservation(context.Context, *pb.ReleaseReservationRequest) (*pb.Empty, error) {
+	f.record("ReleaseReservation")
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeFulfillment) Charge(context.Context, *pb.ChargeRequest) (*pb.ChargeResponse, error) {
+	f.record("Charge")
+	return &pb.ChargeResponse{TransactionId: "tx-1"}, nil
+}
+
+func (f *fakeFulfillment) Refund(context.Context, *pb.RefundRequest) (*pb.RefundResponse, error) {
+	f.record("Refund")
+	return &pb.RefundResponse{RefundId: "refund-1"}, nil
+}
+
+func (f *fakeFulfillment) ShipOrder(context.Context, *pb.ShipOrderRequest) (*pb.ShipOrderResponse, error) {
+	f.record("ShipOrder")
+	return nil, f.shipErr
+}
+
+// TestOrderSagaShipDeadlineIsNotCompensated checks that an order whose
+// shipment timed out, and so may have shipped, is neither refunded nor
+// restocked.
+func TestOrderSagaShipDeadlineIsNotCompensated(t *testing.T) {
+	fake := &fakeFulfillment{shipErr: status.Error(codes.DeadlineExceeded, "shipping timed out")}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterProductCatalogServiceServer(srv, fake)
+	pb.RegisterPaymentServiceServer(srv, fake)
+	pb.RegisterShippingServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ledger, err := newPromotionLedger("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &checkoutService{
+		productCatalogSvcConn: conn,
+		paymentSvcConn:        conn,
+		shippingSvcConn:       conn,
+		sagaStore:             newMemorySagaStore(),
+		promotionUsage:        ledger,
+	}
+	rec := newSagaRecord("order-1", "user", "a@example.com")
+	// Start at the first step with side effects; the cart and prices are
+	// not needed for it.
+	rec.Steps["get_cart"] = stepDone
+	rec.Steps["price_order"] = stepDone
+	err = cs.newOrderSaga(rec, &pb.PlaceOrderRequest{UserId: "user"}).run(context.Background())
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got error %v, want DeadlineExceeded", err)
+	}
+
+	want := []string{"ReserveStock", "Charge", "CommitReservation", "ShipOrder"}
+	if !reflect.DeepEqual(fake.calls, want) {
+		t.Errorf("got calls %v, want %v", fake.calls, want)
+	}
+	if got, want := rec.Status, sagaFailed; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+	if got, want := rec.stepStatus("ship_order"), stepStarted; got != want {
+		t.Errorf("got ship_order status %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/money"
+)
+
+// defaultTaxRulesJSON is used when TAX_RULES_PATH is not set.
+//
+//go:embed tax_rules.json
+var defaultTaxRulesJSON []byte
+
+// jurisdiction is a place with its own sales tax rate. Rates are decimal
+// strings, e.g. "0.0725" for 7.25%.
+type jurisdiction struct {
+	Name string `json:"name"`
+	// Countries are matched case-insensitively against Address.country and
+	// may be either ISO codes or names.
+	Countries []string `json:"countries"`
+	// State and ZipPrefixes narrow the jurisdiction down when set. Zip
+	// codes are compared as five digits with leading zeros.
+	State       string   `json:"state"`
+	ZipPrefixes []string `json:"zip_prefixes"`
+
+	Rate string `json:"rate"`
+	// CategoryRates override Rate for products in a category. A product in
+	// several listed categories gets the lowest of their rates.
+	CategoryRates map[string]string `json:"category_rates"`
+
+	rate          *big.Rat
+	categoryRates map[string]*big.Rat
+}
+
+// taxRules decides which jurisdiction's rates apply to an address.
+type taxRules struct {
+	// EstimateAddress is used for addresses without a country, e.g. for
+	// the estimate shown on the cart page.
+	EstimateAddress struct {
+		Country string `json:"country"`
+		State   string `json:"state"`
+		ZipCode int32  `json:"zip_code"`
+	} `json:"estimate_address"`
+	Jurisdictions []*jurisdiction `json:"jurisdictions"`
+}
+
+// loadTaxRules reads the rules at path, or the built-in rules if path is
+// empty.
+func loadTaxRules(path string) (*taxRules, error) {
+	if path == "" {
+		return parseTaxRules(defaultTaxRulesJSON)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTaxRules(b)
+}
+
+func parseTaxRules(b []byte) (*taxRules, error) {
+	t := new(taxRules)
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, fmt.Errorf("failed to parse tax rules: %w", err)
+	}
+	for _, j := range t.Jurisdictions {
+		var err error
+		if j.rate, err = parseTaxRate(j.Rate); err != nil {
+			return nil, fmt.Errorf("jurisdiction %q: %w", j.Name, err)
+		}
+		j.categoryRates = make(map[string]*big.Rat, len(j.CategoryRates))
+		for c, r := range j.CategoryRates {
+			if j.categoryRates[strings.ToLower(c)], err = parseTaxRate(r); err != nil {
+				return nil, fmt.Errorf("jurisdiction %q, category %q: %w", j.Name, c, err)
+			}
+		}
+	}
+	return t, nil
+}
+
+func parseTaxRate(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || r.Sign() < 0 || r.Cmp(big.NewRat(1, 1)) >= 0 {
+		return nil, fmt.Errorf("tax rate %q must be a decimal between 0 and 1", s)
+	}
+	return r, nil
+}
+
+// jurisdictionFor returns the most specific jurisdiction that covers
+// address, or nil if none does.
+func (t *taxRules) jurisdictionFor(address *pb.Address) *jurisdiction {
+	country, state, zip := address.GetCountry(), address.GetState(), address.GetZipCode()
+	if strings.TrimSpace(country) == "" {
+		e := t.EstimateAddress
+		country, state, zip = e.Country, e.State, e.ZipCode
+	}
+	var best *jurisdiction
+	bestScore := -1
+	for _, j := range t.Jurisdictions {
+		if score, ok := j.matches(country, state, fmt.Sprintf("%05d", zip)); ok && score > bestScore {
+			best, bestScore = j, score
+		}
+	}
+	return best
+}
+
+// matches reports whether the address is in j, and how specifically.
+func (j *jurisdiction) matches(country, state, zip string) (int, bool) {
+	score := 0
+	if !containsFold(j.Countries, country) {
+		return 0, false
+	}
+	if j.State != "" {
+		if !strings.EqualFold(j.State, strings.TrimSpace(state)) {
+			return 0, false
+		}
+		score++
+	}
+	if len(j.ZipPrefixes) > 0 {
+		found := false
+		for _, p := range j.ZipPrefixes {
+			found = found || strings.HasPrefix(zip, p)
+		}
+		if !found {
+			return 0, false
+		}
+		score += 2
+	}
+	return score, true
+}
+
+// rateFor returns the rate for a product in the given categories.
+func (j *jurisdiction) rateFor(categories []string) *big.Rat {
+	var rate *big.Rat
+	for _, c := range categories {
+		if r, ok := j.categoryRates[strings.ToLower(c)]; ok && (rate == nil || r.Cmp(rate) < 0) {
+			rate = r
+		}
+	}
+	if rate == nil {
+		return j.rate
+	}
+	return rate
+}
+
+// calculate returns the tax due on items shipped to address. lines holds the
+// total price of each item after discounts, and categories each item's
+// product categories. Tax is worked out per item and the total rounded half
+// to even to the currency's minor units.
+func (t *taxRules) calculate(address *pb.Address, lines []pb.Money, categories [][]string, currencyCode string) (*pb.TaxLine, error) {
+	total := pb.Money{CurrencyCode: currencyCode}
+	j := t.jurisdictionFor(address)
+	if j == nil {
+		return &pb.TaxLine{Amount: &total}, nil
+	}
+	for i, line := range lines {
+		var cats []string
+		if i < len(categories) {
+			cats = categories[i]
+		}
+		tax, err := money.MultiplyDecimal(line, j.rateFor(cats).RatString(), money.RoundHalfEven)
+		if err != nil {
+			return nil, err
+		}
+		if total, err = money.Sum(total, tax); err != nil {
+			return nil, err
+		}
+	}
+	total, err := money.Round(total, money.MinorUnits(currencyCode), money.RoundHalfEven)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.TaxLine{Jurisdiction: j.Name, Amount: &total}, nil
+}
+
+func containsFold(list []string, s string) bool {
+	s = strings.TrimSpace(s)
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
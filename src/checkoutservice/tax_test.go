@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+func TestTaxCalculation(t *testing.T) {
+	rules, err := loadTaxRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []pb.Money{
+		{CurrencyCode: "USD", Units: 39, Nanos: 980000000},
+		{CurrencyCode: "USD", Units: 10},
+	}
+	categories := [][]string{{"clothing", "tops"}, {"kitchen"}}
+
+	tests := []struct {
+		name             string
+		address          *pb.Address
+		wantJurisdiction string
+		wantUnits        int64
+		wantNanos        int32
+	}{
+		// 49.98 * 7.25% = 3.62355
+		{"state", &pb.Address{Country: "United States", State: "ca", ZipCode: 90210}, "California", 3, 620000000},
+		// 49.98 * 9.125% = 4.560675
+		{"zip prefix", &pb.Address{Country: "US", State: "CA", ZipCode: 94043}, "Mountain View, CA", 4, 560000000},
+		// Clothing is exempt: 10 * 4%
+		{"category rate", &pb.Address{Country: "USA", State: "NY", ZipCode: 12207}, "New York", 0, 400000000},
+		// 49.98 * 5% = 2.499
+		{"country", &pb.Address{Country: "Canada", State: "BC"}, "Canada", 2, 500000000},
+		{"no tax", &pb.Address{Country: "Nowhere"}, "", 0, 0},
+		{"estimate", &pb.Address{}, "Mountain View, CA", 4, 560000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rules.calculate(tt.address, lines, categories, "USD")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.GetJurisdiction() != tt.wantJurisdiction {
+				t.Errorf("got jurisdiction %q, want %q", got.GetJurisdiction(), tt.wantJurisdiction)
+			}
+			if a := got.GetAmount(); a.GetUnits() != tt.wantUnits || a.GetNanos() != tt.wantNanos || a.GetCurrencyCode() != "USD" {
+				t.Errorf("got tax %v, want %d.%09d USD", a, tt.wantUnits, tt.wantNanos)
+			}
+		})
+	}
+}
+
+func TestTaxRoundsToMinorUnits(t *testing.T) {
+	rules, err := loadTaxRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1234 JPY * 10% = 123.4 JPY, which has no minor units.
+	got, err := rules.calculate(&pb.Address{Country: "JP"}, []pb.Money{{CurrencyCode: "JPY", Units: 1234}}, nil, "JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := got.GetAmount(); a.GetUnits() != 123 || a.GetNanos() != 0 {
+		t.Errorf("got tax %v, want 123 JPY", a)
+	}
+}
+
+func TestParseTaxRulesRejectsBadRates(t *testing.T) {
+	for _, rules := range []string{
+		`{"jurisdictions": [{"name": "x", "countries": ["US"], "rate": "7%"}]}`,
+		`{"jurisdictions": [{"name": "x", "countries": ["US"], "rate": "-0.1"}]}`,
+		`{"jurisdictions": [{"name": "x", "countries": ["US"], "rate": "0.1", "category_rates": {"a": "1.5"}}]}`,
+	} {
+		if _, err := parseTaxRules([]byte(rules)); err == nil {
+			t.Errorf("parseTaxRules(%s) succeeded, want error", rules)
+		}
+	}
+}
@@ -133,6 +133,30 @@ function getSupportedCurrencies(call, callback) {
   });
 }
 
+/**
+ * Converts an amount of money to another currency, using the given rates
+ */
+function _convert(data, from, toCode) {
+  // Convert: from_currency --> EUR
+  const euros = _carry({
+    units: from.units / data[from.currency_code],
+    nanos: from.nanos / data[from.currency_code],
+  });
+
+  euros.nanos = Math.round(euros.nanos);
+
+  // Convert: EUR --> to_currency
+  const result = _carry({
+    units: euros.units * data[toCode],
+    nanos: euros.nanos * data[toCode],
+  });
+
+  result.units = Math.floor(result.units);
+  result.nanos = Math.floor(result.nanos);
+  result.currency_code = toCode;
+  return result;
+}
+
 /**
  * Converts between currencies
  */
@@ -140,25 +164,7 @@ function convert(call, callback) {
   try {
     _getCurrencyData((data) => {
       const request = call.request;
-
-      // Convert: from_currency --> EUR
-      const from = request.from;
-      const euros = _carry({
-        units: from.units / data[from.currency_code],
-        nanos: from.nanos / data[from.currency_code],
-      });
-
-      euros.nanos = Math.round(euros.nanos);
-
-      // Convert: EUR --> to_currency
-      const result = _carry({
-        units: euros.units * data[request.to_code],
-        nanos: euros.nanos * data[request.to_code],
-      });
-
-      result.units = Math.floor(result.units);
-      result.nanos = Math.floor(result.nanos);
-      result.currency_code = request.to_code;
+      const result = _convert(data, request.from, request.to_code);
 
       logger.info(`conversion request successful`);
       callback(null, result);
@@ -169,6 +175,26 @@ function convert(call, callback) {
   }
 }
 
+/**
+ * Converts several amounts to the same currency
+ */
+function convertBatch(call, callback) {
+  try {
+    _getCurrencyData((data) => {
+      const request = call.request;
+      const results = request.from.map((from) =>
+        _convert(data, from, request.to_code),
+      );
+
+      logger.info(`batch conversion request successful (${results.length} amounts)`);
+      callback(null, { results });
+    });
+  } catch (err) {
+    logger.error(`batch conversion request failed: ${err}`);
+    callback(err.message);
+  }
+}
+
 /**
  * Endpoint for health checks
  */
@@ -186,6 +212,7 @@ function main() {
   server.addService(shopProto.CurrencyService.service, {
     getSupportedCurrencies,
     convert,
+    convertBatch,
   });
   server.addService(healthProto.Health.service, { check });
 
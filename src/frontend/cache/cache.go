@@ -0,0 +1,274 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache is a size-bounded in-memory cache whose entries expire after
+// a fixed TTL. Concurrent loads of the same key share one call.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"golang.org/x/sync/singleflight"
+)
+
+// loadTimeout bounds a shared load, which outlives the caller that started
+// it if that caller gives up first.
+const loadTimeout = 10 * time.Second
+
+// Cache maps string keys to values of type V. The zero TTL disables it:
+// every Get then calls through to its loader, though concurrent calls are
+// still deduplicated.
+type Cache[V any] struct {
+	name       string
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	// gen counts invalidations, so that a load that was in flight during
+	// one does not cache what it loaded.
+	gen uint64
+
+	group   singleflight.Group
+	lookups metric.Int64Counter
+}
+
+type entry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// New returns an empty cache. name labels its metrics; maxEntries bounds
+// it, evicting the least recently used entry first, and is unbounded if
+// not positive.
+func New[V any](name string, ttl time.Duration, maxEntries int) *Cache[V] {
+	lookups, err := otel.Meter("frontend").Int64Counter("frontend.cache.lookups",
+		metric.WithDescription("Cache lookups, by cache and result (hit or miss)."))
+	if err != nil {
+		otel.Handle(err)
+		lookups, _ = noop.Meter{}.Int64Counter("frontend.cache.lookups")
+	}
+	return &Cache[V]{
+		name:       name,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		lookups:    lookups,
+	}
+}
+
+// Get returns the cached value for key, calling load to fill it on a miss.
+// Errors are returned but not cached.
+func (c *Cache[V]) Get(ctx context.Context, key string, load func(context.Context) (V, error)) (V, error) {
+	if v, ok := c.lookup(key); ok {
+		c.record(ctx, true, 1)
+		return v, nil
+	}
+	c.record(ctx, false, 1)
+	v, err := c.do(ctx, key, func(ctx context.Context) (any, error) {
+		gen := c.generation()
+		v, err := load(ctx)
+		if err == nil {
+			c.setSince(gen, key, v)
+		}
+		return v, err
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return v.(V), nil
+}
+
+// GetMany returns the cached values for keys, calling load once with the
+// missing keys, sorted and without duplicates. Keys that load leaves out
+// are left out of the result and are not cached.
+func (c *Cache[V]) GetMany(ctx context.Context, keys []string, load func(context.Context, []string) (map[string]V, error)) (map[string]V, error) {
+	out := make(map[string]V, len(keys))
+	missing := make(map[string]bool)
+	for _, k := range keys {
+		if v, ok := c.lookup(k); ok {
+			out[k] = v
+		} else {
+			missing[k] = true
+		}
+	}
+	c.record(ctx, true, len(out))
+	c.record(ctx, false, len(missing))
+	if len(missing) == 0 {
+		return out, nil
+	}
+	ks := make([]string, 0, len(missing))
+	for k := range missing {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	loaded, err := c.do(ctx, "\x00"+strings.Join(ks, "\x00"), func(ctx context.Context) (any, error) {
+		gen := c.generation()
+		m, err := load(ctx, ks)
+		if err == nil {
+			for k, v := range m {
+				if missing[k] {
+					c.setSince(gen, k, v)
+				}
+			}
+		}
+		return m, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range loaded.(map[string]V) {
+		if missing[k] {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// Set caches value under key, replacing any earlier value.
+func (c *Cache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(key, value)
+}
+
+// setSince caches value under key unless the cache was invalidated after
+// generation gen.
+func (c *Cache[V]) setSince(gen uint64, key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen {
+		c.setLocked(key, value)
+	}
+}
+
+func (c *Cache[V]) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+func (c *Cache[V]) setLocked(key string, value V) {
+	if c.ttl <= 0 {
+		return
+	}
+	e := &entry[V]{key: key, value: value, expires: c.now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate drops the entries for keys. Loads in flight when it is called
+// are not cached.
+func (c *Cache[V]) Invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, k := range keys {
+		if el, ok := c.entries[k]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// InvalidateAll empties the cache. Loads in flight when it is called are
+// not cached.
+func (c *Cache[V]) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Len returns how many entries the cache holds, including expired entries
+// that have not been looked up since they expired.
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache[V]) lookup(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	el, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	e := el.Value.(*entry[V])
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return zero, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *Cache[V]) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*entry[V]).key)
+}
+
+// do runs load once for all concurrent callers with the same key. The load
+// is detached from the caller's cancellation so that a caller giving up
+// does not fail the others; each caller still returns when its own context
+// is done.
+func (c *Cache[V]) do(ctx context.Context, key string, load func(context.Context) (any, error)) (any, error) {
+	ch := c.group.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), loadTimeout)
+		defer cancel()
+		return load(ctx)
+	})
+	select {
+	case res := <-ch:
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Cache[V]) record(ctx context.Context, hit bool, n int) {
+	if n == 0 {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	c.lookups.Add(ctx, int64(n), metric.WithAttributes(
+		attribute.String("cache", c.name), attribute.String("result", result)))
+}
@@ -0,0 +1,327 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// reader collects the metrics of every cache the tests create.
+var reader = sdkmetric.NewManualReader()
+
+func TestMain(m *testing.M) {
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	os.Exit(m.Run())
+}
+
+// fakeClock is a settable clock for testing expiry.
+type fakeClock struct{ t time.Time }
+
+func (f *fakeClock) now() time.Time { return f.t }
+
+var testCaches atomic.Int32
+
+// newTestCache returns a cache with a name of its own, so that lookups
+// counts only its lookups.
+func newTestCache(ttl time.Duration, maxEntries int) (*Cache[string], *fakeClock) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	c := New[string](fmt.Sprintf("test-%d", testCaches.Add(1)), ttl, maxEntries)
+	c.now = clock.now
+	return c, clock
+}
+
+// lookups returns the hits and misses c has reported to the
+// frontend.cache.lookups metric.
+func lookups(t *testing.T, c *Cache[string]) (hits, misses int64) {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "frontend.cache.lookups" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				if name, _ := dp.Attributes.Value("cache"); name.AsString() != c.name {
+					continue
+				}
+				switch result, _ := dp.Attributes.Value("result"); result.AsString() {
+				case "hit":
+					hits = dp.Value
+				case "miss":
+					misses = dp.Value
+				}
+			}
+		}
+	}
+	return hits, misses
+}
+
+// loader returns a load function that yields value and counts its calls.
+func loader(value string, calls *atomic.Int32) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		calls.Add(1)
+		return value, nil
+	}
+}
+
+func TestGetCachesUntilExpiry(t *testing.T) {
+	ctx := context.Background()
+	c, clock := newTestCache(time.Minute, 0)
+	var calls atomic.Int32
+
+	for i := 0; i < 3; i++ {
+		if v, err := c.Get(ctx, "k", loader("v1", &calls)); err != nil || v != "v1" {
+			t.Fatalf("Get = %q, %v; want v1", v, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loaded %d times before expiry, want 1", n)
+	}
+	if hits, misses := lookups(t, c); hits != 2 || misses != 1 {
+		t.Errorf("got %d hits and %d misses, want 2 and 1", hits, misses)
+	}
+
+	clock.t = clock.t.Add(time.Minute)
+	if v, _ := c.Get(ctx, "k", loader("v2", &calls)); v != "v2" {
+		t.Errorf("Get after expiry = %q, want v2", v)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("loaded %d times after expiry, want 2", n)
+	}
+}
+
+func TestGetDoesNotCacheErrors(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(time.Minute, 0)
+	errLoad := errors.New("unavailable")
+
+	_, err := c.Get(ctx, "k", func(context.Context) (string, error) { return "", errLoad })
+	if !errors.Is(err, errLoad) {
+		t.Fatalf("Get error = %v, want %v", err, errLoad)
+	}
+	var calls atomic.Int32
+	if v, err := c.Get(ctx, "k", loader("v", &calls)); err != nil || v != "v" {
+		t.Errorf("Get after error = %q, %v; want v", v, err)
+	}
+}
+
+func TestZeroTTLDisablesCaching(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(0, 0)
+	var calls atomic.Int32
+	c.Get(ctx, "k", loader("v", &calls))
+	c.Get(ctx, "k", loader("v", &calls))
+	if n := calls.Load(); n != 2 {
+		t.Errorf("loaded %d times, want 2", n)
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+}
+
+func TestSizeBoundEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(time.Minute, 2)
+	var calls atomic.Int32
+	c.Get(ctx, "a", loader("a", &calls))
+	c.Get(ctx, "b", loader("b", &calls))
+	c.Get(ctx, "a", loader("a", &calls)) // a is now more recent than b
+	c.Get(ctx, "c", loader("c", &calls))
+
+	if n := c.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+	if _, ok := c.lookup("b"); ok {
+		t.Error("b was kept, want it evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.lookup(k); !ok {
+			t.Errorf("%s was evicted, want it kept", k)
+		}
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(time.Minute, 0)
+	var calls atomic.Int32
+	for _, k := range []string{"a", "b", "c"} {
+		c.Get(ctx, k, loader(k, &calls))
+	}
+
+	c.Invalidate("a", "missing")
+	if _, ok := c.lookup("a"); ok {
+		t.Error("a survived Invalidate")
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("Len() after Invalidate = %d, want 2", n)
+	}
+	c.InvalidateAll()
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len() after InvalidateAll = %d, want 0", n)
+	}
+}
+
+func TestInvalidateDuringLoad(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(time.Minute, 0)
+	v, err := c.Get(ctx, "a", func(context.Context) (string, error) {
+		c.Invalidate("a")
+		return "stale", nil
+	})
+	if err != nil || v != "stale" {
+		t.Fatalf("Get() = %q, %v, want the loaded value", v, err)
+	}
+	if _, ok := c.lookup("a"); ok {
+		t.Error("a value loaded before Invalidate was cached")
+	}
+
+	m, err := c.GetMany(ctx, []string{"b"}, func(context.Context, []string) (map[string]string, error) {
+		c.InvalidateAll()
+		return map[string]string{"b": "stale"}, nil
+	})
+	if err != nil || m["b"] != "stale" {
+		t.Fatalf("GetMany() = %v, %v, want the loaded value", m, err)
+	}
+	if _, ok := c.lookup("b"); ok {
+		t.Error("a value loaded before InvalidateAll was cached")
+	}
+
+	if _, err := c.Get(ctx, "a", func(context.Context) (string, error) { return "fresh", nil }); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := c.lookup("a"); !ok || v != "fresh" {
+		t.Errorf("lookup(a) = %q, %v, want a later load cached", v, ok)
+	}
+}
+
+func TestGetDeduplicatesConcurrentLoads(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(time.Minute, 0)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	load := func(context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "v", nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get(ctx, "k", load); err != nil || v != "v" {
+				t.Errorf("Get = %q, %v; want v", v, err)
+			}
+		}()
+	}
+	// Wait for every caller to miss before letting the load finish.
+	for _, misses := lookups(t, c); misses < callers; _, misses = lookups(t, c) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loaded %d times, want 1", n)
+	}
+}
+
+func TestGetReturnsWhenCallerGivesUp(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 0)
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := c.Get(ctx, "k", func(ctx context.Context) (string, error) {
+		<-release
+		return "v", ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Get error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(time.Minute, 0)
+	c.Set("a", "cached-a")
+
+	var requested [][]string
+	load := func(_ context.Context, keys []string) (map[string]string, error) {
+		requested = append(requested, keys)
+		out := make(map[string]string)
+		for _, k := range keys {
+			if k != "unknown" {
+				out[k] = "loaded-" + k
+			}
+		}
+		return out, nil
+	}
+
+	got, err := c.GetMany(ctx, []string{"c", "a", "b", "unknown", "c"}, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "cached-a", "b": "loaded-b", "c": "loaded-c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMany = %v, want %v", got, want)
+	}
+	if want := [][]string{{"b", "c", "unknown"}}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("loaded %v, want %v", requested, want)
+	}
+	if hits, misses := lookups(t, c); hits != 1 || misses != 3 {
+		t.Errorf("got %d hits and %d misses, want 1 and 3", hits, misses)
+	}
+
+	// Everything but the unknown key is now cached.
+	requested = nil
+	if _, err := c.GetMany(ctx, []string{"a", "b", "c"}, load); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 0 {
+		t.Errorf("loaded %v for cached keys, want no load", requested)
+	}
+}
+
+func TestGetManyError(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 0)
+	_, err := c.GetMany(context.Background(), []string{"a"}, func(context.Context, []string) (map[string]string, error) {
+		return nil, fmt.Errorf("unavailable")
+	})
+	if err == nil {
+		t.Error("GetMany succeeded, want the load error")
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+}
@@ -24,17 +24,21 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
-	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
 	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/money"
 )
 
 type platformDetails struct {
@@ -59,16 +63,54 @@ var validEnvs = []string{"local", "gcp", "azure", "aws", "onprem", "alibaba"}
 func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.WithField("currency", currentCurrency(r)).Info("home")
+	fe.renderProductList(w, r, log, "")
+}
+
+func (fe *frontendServer) categoryHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	category := mux.Vars(r)["name"]
+	log.WithField("category", category).WithField("currency", currentCurrency(r)).Info("category")
+	fe.renderProductList(w, r, log, category)
+}
+
+// renderProductList renders a page of the products in category, or of all
+// products if category is empty.
+func (fe *frontendServer) renderProductList(w http.ResponseWriter, r *http.Request, log logrus.FieldLogger, category string) {
+	payload := validator.ListProductsPayload{
+		Category:  category,
+		PageToken: r.URL.Query().Get("page_token"),
+	}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
 	currencies, err := fe.getCurrencies(r.Context())
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
-	products, err := fe.getProducts(r.Context())
-	if err != nil {
+	categories := fe.categoryNav(r.Context(), log)
+	if category != "" && categories != nil {
+		c := findCategory(categories, category)
+		if c == nil {
+			renderHTTPError(log, r, w, errors.Errorf("no category named %q", category), http.StatusNotFound)
+			return
+		}
+		category = c.GetName()
+	}
+	resp, err := fe.listProducts(r.Context(), &pb.ListProductsRequest{
+		PageSize:  homePageSize,
+		PageToken: payload.PageToken,
+		Category:  payload.Category,
+	})
+	if status.Code(err) == codes.InvalidArgument {
+		renderHTTPError(log, r, w, errors.Wrap(err, "invalid page"), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
 		return
 	}
+	products := resp.GetProducts()
 	cart, err := fe.getCart(r.Context(), sessionID(r))
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
@@ -79,14 +121,29 @@ func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 		Item  *pb.Product
 		Price *pb.Money
 	}
+	prices, err := fe.convertCurrencies(r.Context(), productPrices(products), currentCurrency(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to do currency conversion for products"), http.StatusInternalServerError)
+		return
+	}
 	ps := make([]productView, len(products))
 	for i, p := range products {
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId()), http.StatusInternalServerError)
-			return
+		ps[i] = productView{p, prices[i]}
+	}
+
+	var nextPage, firstPage string
+	if resp.GetNextPageToken() != "" {
+		next := r.URL.Query()
+		next.Set("page_token", resp.GetNextPageToken())
+		nextPage = r.URL.EscapedPath() + "?" + next.Encode()
+	}
+	if payload.PageToken != "" {
+		first := r.URL.Query()
+		first.Del("page_token")
+		firstPage = r.URL.EscapedPath()
+		if len(first) > 0 {
+			firstPage += "?" + first.Encode()
 		}
-		ps[i] = productView{p, price}
 	}
 
 	// Set ENV_PLATFORM (default to local if not set; use env var if set; otherwise detect GCP, which overrides env)_
@@ -111,9 +168,13 @@ func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 		"show_currency": true,
 		"currencies":    currencies,
 		"products":      ps,
+		"category":      category,
+		"category_nav":  categories,
+		"next_page":     nextPage,
+		"first_page":    firstPage,
 		"cart_size":     cartSize(cart),
 		"banner_color":  os.Getenv("BANNER_COLOR"), // illustrates canary deployments
-		"ad":            fe.chooseAd(r.Context(), []string{}, log),
+		"ad":            fe.chooseAd(r.Context(), categoryContext(category), log),
 	})); err != nil {
 		log.Error(err)
 	}
@@ -185,6 +246,14 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 		Price *pb.Money
 	}{p, price}
 
+	// Only offer quantities that are in stock.
+	var quantities []int32
+	for _, q := range []int32{1, 2, 3, 4, 5, 10} {
+		if inStock(p, uint64(q)) {
+			quantities = append(quantities, q)
+		}
+	}
+
 	// Fetch packaging info (weight/dimensions) of the product
 	// The packaging service is an optional microservice you can run as part of a Google Cloud demo.
 	var packagingInfo *PackagingInfo = nil
@@ -197,9 +266,13 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 
 	if err := templates.ExecuteTemplate(w, "product", injectCommonTemplateData(r, map[string]interface{}{
 		"ad":              fe.chooseAd(r.Context(), p.Categories, log),
+		"category_nav":    fe.categoryNav(r.Context(), log),
 		"show_currency":   true,
 		"currencies":      currencies,
 		"product":         product,
+		"quantities":      quantities,
+		"out_of_stock":    !inStock(p, 1),
+		"low_stock":       p.Stock != nil && p.GetStock() <= lowStockThreshold,
 		"recommendations": recommendations,
 		"cart_size":       cartSize(cart),
 		"packagingInfo":   packagingInfo,
@@ -208,6 +281,139 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+var searchSorts = map[string]pb.ProductSort{
+	"":           pb.ProductSort_SORT_RELEVANCE,
+	"relevance":  pb.ProductSort_SORT_RELEVANCE,
+	"price_asc":  pb.ProductSort_SORT_PRICE_ASCENDING,
+	"price_desc": pb.ProductSort_SORT_PRICE_DESCENDING,
+	"name":       pb.ProductSort_SORT_NAME,
+}
+
+func (fe *frontendServer) searchHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	params := r.URL.Query()
+	payload := validator.SearchPayload{
+		Query:     strings.TrimSpace(params.Get("q")),
+		Category:  params.Get("category"),
+		MinPrice:  params.Get("min_price"),
+		MaxPrice:  params.Get("max_price"),
+		Sort:      params.Get("sort"),
+		PageToken: params.Get("page_token"),
+	}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	log.WithField("query", payload.Query).WithField("category", payload.Category).Debug("searching products")
+
+	req := &pb.SearchProductsRequest{
+		Query:     payload.Query,
+		Sort:      searchSorts[payload.Sort],
+		PageSize:  searchPageSize,
+		PageToken: payload.PageToken,
+	}
+	if payload.Category != "" {
+		req.Categories = []string{payload.Category}
+	}
+	// Price bounds are entered in the shopper's currency and filtered in USD.
+	var bounds []*pb.Money
+	var targets []**pb.Money
+	for _, bound := range []struct {
+		value  string
+		target **pb.Money
+	}{{payload.MinPrice, &req.MinPriceUsd}, {payload.MaxPrice, &req.MaxPriceUsd}} {
+		if bound.value == "" {
+			continue
+		}
+		m, err := money.Parse(bound.value, currentCurrency(r))
+		if err != nil {
+			renderHTTPError(log, r, w, errors.Errorf("invalid price %q", bound.value), http.StatusUnprocessableEntity)
+			return
+		}
+		bounds, targets = append(bounds, &m), append(targets, bound.target)
+	}
+	boundsUSD, err := fe.convertCurrencies(r.Context(), bounds, "USD")
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to convert currency"), http.StatusInternalServerError)
+		return
+	}
+	for i, target := range targets {
+		*target = boundsUSD[i]
+	}
+
+	resp, err := fe.searchProducts(r.Context(), req)
+	if status.Code(err) == codes.InvalidArgument {
+		renderHTTPError(log, r, w, errors.Wrap(err, "invalid search"), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not search products"), http.StatusInternalServerError)
+		return
+	}
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+	cart, err := fe.getCart(r.Context(), sessionID(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		return
+	}
+
+	type productView struct {
+		Item  *pb.Product
+		Price *pb.Money
+	}
+	prices, err := fe.convertCurrencies(r.Context(), productPrices(resp.GetResults()), currentCurrency(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to do currency conversion for products"), http.StatusInternalServerError)
+		return
+	}
+	ps := make([]productView, len(resp.GetResults()))
+	// Categories of the results, to narrow the search down.
+	var categories []string
+	seen := make(map[string]bool)
+	for i, p := range resp.GetResults() {
+		ps[i] = productView{p, prices[i]}
+		for _, c := range p.GetCategories() {
+			if !seen[c] {
+				seen[c] = true
+				categories = append(categories, c)
+			}
+		}
+	}
+	sort.Strings(categories)
+
+	var nextPage string
+	if resp.GetNextPageToken() != "" {
+		next := r.URL.Query()
+		next.Set("page_token", resp.GetNextPageToken())
+		nextPage = baseUrl + "/search?" + next.Encode()
+	}
+	var firstPage string
+	if payload.PageToken != "" {
+		first := r.URL.Query()
+		first.Del("page_token")
+		firstPage = baseUrl + "/search?" + first.Encode()
+	}
+
+	if err := templates.ExecuteTemplate(w, "search", injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency": true,
+		"category_nav":  fe.categoryNav(r.Context(), log),
+		"currencies":    currencies,
+		"cart_size":     cartSize(cart),
+		"search":        payload,
+		"search_query":  payload.Query,
+		"products":      ps,
+		"total":         resp.GetTotalSize(),
+		"categories":    categories,
+		"next_page":     nextPage,
+		"first_page":    firstPage,
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
 func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	quantity, _ := strconv.ParseUint(r.FormValue("quantity"), 10, 32)
@@ -227,6 +433,18 @@ func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Reques
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
 		return
 	}
+	if !inStock(p, payload.Quantity) {
+		// The cached stock level may be stale; check it again before refusing.
+		fe.invalidateProducts(p.GetId())
+		if p, err = fe.getProduct(r.Context(), payload.ProductID); err != nil {
+			renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !inStock(p, payload.Quantity) {
+		renderHTTPError(log, r, w, errors.Errorf("only %d of %s left in stock", p.GetStock(), p.GetName()), http.StatusConflict)
+		return
+	}
 
 	if err := fe.insertCart(r.Context(), sessionID(r), p.GetId(), int32(payload.Quantity)); err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to add to cart"), http.StatusInternalServerError)
@@ -248,6 +466,45 @@ func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Reques
 	w.WriteHeader(http.StatusFound)
 }
 
+func (fe *frontendServer) applyPromotionHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	payload := validator.ApplyPromotionPayload{Code: strings.TrimSpace(r.FormValue("code"))}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	code := strings.ToUpper(payload.Code)
+	log.WithField("code", code).Debug("applying promotion code")
+
+	codes := currentPromotions(r)
+	found := false
+	for _, c := range codes {
+		found = found || c == code
+	}
+	if !found && len(codes) < maxPromotionCodes {
+		codes = append(codes, code)
+	}
+	setPromotions(w, codes)
+	w.Header().Set("location", baseUrl + "/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+func (fe *frontendServer) removePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
+	log.WithField("code", code).Debug("removing promotion code")
+
+	var codes []string
+	for _, c := range currentPromotions(r) {
+		if c != code {
+			codes = append(codes, c)
+		}
+	}
+	setPromotions(w, codes)
+	w.Header().Set("location", baseUrl + "/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
 func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("view user cart")
@@ -268,50 +525,134 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		log.WithField("error", err).Warn("failed to get product recommendations")
 	}
 
-	shippingCost, err := fe.getShippingQuote(r.Context(), cart, currentCurrency(r))
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get shipping quote"), http.StatusInternalServerError)
-		return
-	}
-
 	type cartItemView struct {
 		Item     *pb.Product
 		Quantity int32
 		Price    *pb.Money
 	}
+	products, err := fe.getProducts(r.Context(), cartIDs(cart))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
+		return
+	}
+	cartProducts := make([]*pb.Product, len(cart))
+	for i, item := range cart {
+		if cartProducts[i] = products[item.GetProductId()]; cartProducts[i] == nil {
+			renderHTTPError(log, r, w, errors.Errorf("could not retrieve product #%s", item.GetProductId()), http.StatusInternalServerError)
+			return
+		}
+	}
+	prices, err := fe.convertCurrencies(r.Context(), productPrices(cartProducts), currentCurrency(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not convert currency for products"), http.StatusInternalServerError)
+		return
+	}
+
 	items := make([]cartItemView, len(cart))
 	totalPrice := pb.Money{CurrencyCode: currentCurrency(r)}
+	subtotalUSD := pb.Money{CurrencyCode: "USD"}
 	for i, item := range cart {
-		p, err := fe.getProduct(r.Context(), item.GetProductId())
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId()), http.StatusInternalServerError)
-			return
+		p, price := cartProducts[i], prices[i]
+		multPrice, err := lineTotal(price, item.GetQuantity())
+		if err == nil {
+			totalPrice, err = addMoney(totalPrice, &multPrice)
+		}
+		var multPriceUSD pb.Money
+		if err == nil {
+			multPriceUSD, err = lineTotal(p.GetPriceUsd(), item.GetQuantity())
+		}
+		if err == nil {
+			subtotalUSD, err = addMoney(subtotalUSD, &multPriceUSD)
 		}
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
 		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId()), http.StatusInternalServerError)
+			renderHTTPError(log, r, w, errors.Wrapf(err, "failed to price product #%s", p.GetId()), http.StatusInternalServerError)
 			return
 		}
-
-		multPrice := money.MultiplySlow(*price, uint32(item.GetQuantity()))
 		items[i] = cartItemView{
 			Item:     p,
 			Quantity: item.GetQuantity(),
 			Price:    &multPrice}
-		totalPrice = money.Must(money.Sum(totalPrice, multPrice))
 	}
-	totalPrice = money.Must(money.Sum(totalPrice, *shippingCost))
+
+	shippingOptions, err := fe.getShippingOptions(r.Context(), defaultAddress, cart, &subtotalUSD)
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get shipping quote"), http.StatusInternalServerError)
+		return
+	}
+
+	promotions, err := fe.applyPromotions(r.Context(), sessionID(r), defaultAddress, cart, currentCurrency(r), currentPromotions(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to apply promotions"), http.StatusInternalServerError)
+		return
+	}
+	tax := promotions.GetTax()
+	totalBeforeShipping, err := addMoney(totalPrice, tax.GetAmount())
+	if err == nil {
+		totalBeforeShipping, err = subtractDiscounts(totalBeforeShipping, promotions.GetDiscounts())
+	}
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to total cart"), http.StatusInternalServerError)
+		return
+	}
+
+	type shippingOptionView struct {
+		*pb.ShippingOption
+		Cost     *pb.Money
+		Total    pb.Money
+		Selected bool
+	}
+	costsUSD := make([]*pb.Money, len(shippingOptions))
+	for i, o := range shippingOptions {
+		costsUSD[i] = o.GetCostUsd()
+	}
+	costs, err := fe.convertCurrencies(r.Context(), costsUSD, currentCurrency(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to convert currency for shipping cost"), http.StatusInternalServerError)
+		return
+	}
+	options := make([]shippingOptionView, len(shippingOptions))
+	var selected *shippingOptionView
+	for i, o := range shippingOptions {
+		cost := costs[i]
+		total, err := addMoney(totalBeforeShipping, cost)
+		if err != nil {
+			renderHTTPError(log, r, w, errors.Wrapf(err, "failed to total cart with %s shipping", o.GetMethodId()), http.StatusInternalServerError)
+			return
+		}
+		options[i] = shippingOptionView{
+			ShippingOption: o,
+			Cost:           cost,
+			Total:          total}
+		if selected == nil || o.GetMethodId() == defaultShippingMethod {
+			selected = &options[i]
+		}
+	}
+	selected.Selected = true
 	year := time.Now().Year()
 
+	// Each rendered checkout form gets its own key so that resubmitting it
+	// (double-click, browser retry) cannot place the order twice.
+	idempotencyKey, err := uuid.NewRandom()
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to generate idempotency key"), http.StatusInternalServerError)
+		return
+	}
+
 	if err := templates.ExecuteTemplate(w, "cart", injectCommonTemplateData(r, map[string]interface{}{
 		"currencies":       currencies,
 		"recommendations":  recommendations,
 		"cart_size":        cartSize(cart),
-		"shipping_cost":    shippingCost,
+		"shipping_options": options,
+		"shipping_cost":    selected.Cost,
+		"tax":              tax,
+		"discounts":        promotions.GetDiscounts(),
+		"rejected_codes":   promotions.GetRejected(),
 		"show_currency":    true,
-		"total_cost":       totalPrice,
+		"total_cost":       selected.Total,
+		"address":          defaultAddress,
 		"items":            items,
 		"expiration_years": []int{year, year + 1, year + 2, year + 3, year + 4},
+		"idempotency_key":  idempotencyKey.String(),
 	})); err != nil {
 		log.Println(err)
 	}
@@ -322,29 +663,35 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 	log.Debug("placing order")
 
 	var (
-		email         = r.FormValue("email")
-		streetAddress = r.FormValue("street_address")
-		zipCode, _    = strconv.ParseInt(r.FormValue("zip_code"), 10, 32)
-		city          = r.FormValue("city")
-		state         = r.FormValue("state")
-		country       = r.FormValue("country")
-		ccNumber      = r.FormValue("credit_card_number")
-		ccMonth, _    = strconv.ParseInt(r.FormValue("credit_card_expiration_month"), 10, 32)
-		ccYear, _     = strconv.ParseInt(r.FormValue("credit_card_expiration_year"), 10, 32)
-		ccCVV, _      = strconv.ParseInt(r.FormValue("credit_card_cvv"), 10, 32)
+		email          = r.FormValue("email")
+		streetAddress  = r.FormValue("street_address")
+		zipCode, _     = strconv.ParseInt(r.FormValue("zip_code"), 10, 32)
+		city           = r.FormValue("city")
+		state          = r.FormValue("state")
+		country        = r.FormValue("country")
+		ccNumber       = r.FormValue("credit_card_number")
+		ccMonth, _     = strconv.ParseInt(r.FormValue("credit_card_expiration_month"), 10, 32)
+		ccYear, _      = strconv.ParseInt(r.FormValue("credit_card_expiration_year"), 10, 32)
+		ccCVV, _       = strconv.ParseInt(r.FormValue("credit_card_cvv"), 10, 32)
+		idempotencyKey = r.FormValue("idempotency_key")
+		shippingMethod = r.FormValue("shipping_method")
+		promotionCodes = currentPromotions(r)
 	)
 
 	payload := validator.PlaceOrderPayload{
-		Email:         email,
-		StreetAddress: streetAddress,
-		ZipCode:       zipCode,
-		City:          city,
-		State:         state,
-		Country:       country,
-		CcNumber:      ccNumber,
-		CcMonth:       ccMonth,
-		CcYear:        ccYear,
-		CcCVV:         ccCVV,
+		Email:          email,
+		StreetAddress:  streetAddress,
+		ZipCode:        zipCode,
+		City:           city,
+		State:          state,
+		Country:        country,
+		CcNumber:       ccNumber,
+		CcMonth:        ccMonth,
+		CcYear:         ccYear,
+		CcCVV:          ccCVV,
+		IdempotencyKey: idempotencyKey,
+		ShippingMethod: shippingMethod,
+		PromotionCodes: promotionCodes,
 	}
 	if err := payload.Validate(); err != nil {
 		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
@@ -367,21 +714,33 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 				State:         payload.State,
 				ZipCode:       int32(payload.ZipCode),
 				Country:       payload.Country},
+			IdempotencyKey:   payload.IdempotencyKey,
+			ShippingMethodId: payload.ShippingMethod,
+			PromotionCodes:   payload.PromotionCodes,
 		})
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to complete the order"), http.StatusInternalServerError)
 		return
 	}
 	log.WithField("order", order.GetOrder().GetOrderId()).Info("order placed")
+	setPromotions(w, nil)
+
+	// The order took the ordered products out of stock.
+	ordered := make([]string, 0, len(order.GetOrder().GetItems()))
+	for _, v := range order.GetOrder().GetItems() {
+		ordered = append(ordered, v.GetItem().GetProductId())
+	}
+	fe.invalidateProducts(ordered...)
 
 	order.GetOrder().GetItems()
 	recommendations, _ := fe.getRecommendations(r.Context(), sessionID(r), nil)
 
-	totalPaid := *order.GetOrder().GetShippingCost()
-	for _, v := range order.GetOrder().GetItems() {
-		multPrice := money.MultiplySlow(*v.GetCost(), uint32(v.GetItem().GetQuantity()))
-		totalPaid = money.Must(money.Sum(totalPaid, multPrice))
+	totalPaid, err := orderTotal(order.GetOrder())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to total the order"), http.StatusInternalServerError)
+		return
 	}
+	fe.orders.record(sessionID(r), order.GetOrder(), &totalPaid)
 
 	currencies, err := fe.getCurrencies(r.Context())
 	if err != nil {
@@ -400,6 +759,92 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+func (fe *frontendServer) orderHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "orders", injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency": false,
+		"currencies":    currencies,
+		"orders":        fe.orders.list(sessionID(r)),
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
+func (fe *frontendServer) orderDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	id := mux.Vars(r)["id"]
+	order, ok := fe.orders.get(sessionID(r), id)
+	if !ok {
+		renderHTTPError(log, r, w, errors.Errorf("order %q not found", id), http.StatusNotFound)
+		return
+	}
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "order_details", injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency": false,
+		"currencies":    currencies,
+		"order":         order.Order,
+		"total_paid":    order.TotalPaid,
+		"placed_at":     order.PlacedAt,
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
+func (fe *frontendServer) trackShipmentHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	id := mux.Vars(r)["id"]
+	payload := validator.TrackShipmentPayload{TrackingID: id}
+	if err := payload.Validate(); err != nil {
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		return
+	}
+	id, _ = validator.CanonicalTrackingID(payload.TrackingID)
+	shipment, err := fe.trackShipment(r.Context(), id)
+	if status.Code(err) == codes.NotFound {
+		renderHTTPError(log, r, w, errors.Errorf("no shipment with tracking ID %q", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not track shipment"), http.StatusInternalServerError)
+		return
+	}
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+
+	type eventView struct {
+		*pb.ShipmentEvent
+		Time time.Time
+	}
+	events := make([]eventView, len(shipment.GetEvents()))
+	for i, e := range shipment.GetEvents() {
+		// Most recent first.
+		events[len(events)-1-i] = eventView{e, time.Unix(e.GetTimeUnix(), 0).UTC()}
+	}
+
+	if err := templates.ExecuteTemplate(w, "track", injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency": false,
+		"currencies":    currencies,
+		"shipment":      shipment,
+		"delivered":     shipment.GetStatus() == pb.ShipmentStatus_SHIPMENT_STATUS_DELIVERED,
+		"events":        events,
+	})); err != nil {
+		log.Println(err)
+	}
+}
+
 func (fe *frontendServer) assistantHandler(w http.ResponseWriter, r *http.Request) {
 	currencies, err := fe.getCurrencies(r.Context())
 	if err != nil {
@@ -533,6 +978,106 @@ func (fe *frontendServer) chooseAd(ctx context.Context, ctxKeys []string, log lo
 	return ads[rand.Intn(len(ads))]
 }
 
+// productPrices returns the USD prices of products.
+func productPrices(products []*pb.Product) []*pb.Money {
+	prices := make([]*pb.Money, len(products))
+	for i, p := range products {
+		prices[i] = p.GetPriceUsd()
+	}
+	return prices
+}
+
+// lineTotal returns the price of quantity units.
+func lineTotal(price *pb.Money, quantity int32) (pb.Money, error) {
+	if price == nil {
+		return pb.Money{}, errors.New("missing price")
+	}
+	return money.Multiply(*price, int64(quantity))
+}
+
+// addMoney adds amounts to total. Missing amounts count as zero.
+func addMoney(total pb.Money, amounts ...*pb.Money) (pb.Money, error) {
+	for _, a := range amounts {
+		if a == nil {
+			continue
+		}
+		var err error
+		if total, err = money.Sum(total, *a); err != nil {
+			return pb.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// subtractDiscounts takes discounts off total. Discounts without an amount
+// are skipped.
+func subtractDiscounts(total pb.Money, discounts []*pb.DiscountLine) (pb.Money, error) {
+	for _, d := range discounts {
+		if d.GetAmount() == nil {
+			continue
+		}
+		discount := money.Negate(*d.GetAmount())
+		var err error
+		if total, err = addMoney(total, &discount); err != nil {
+			return pb.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// orderTotal returns what was paid for order: its items and shipping, plus
+// tax, less discounts.
+func orderTotal(order *pb.OrderResult) (pb.Money, error) {
+	if order.GetShippingCost() == nil {
+		return pb.Money{}, errors.New("missing shipping cost")
+	}
+	total, err := addMoney(*order.GetShippingCost(), order.GetTax().GetAmount())
+	if err != nil {
+		return pb.Money{}, err
+	}
+	if total, err = subtractDiscounts(total, order.GetDiscounts()); err != nil {
+		return pb.Money{}, err
+	}
+	for _, v := range order.GetItems() {
+		cost, err := lineTotal(v.GetCost(), v.GetItem().GetQuantity())
+		if err != nil {
+			return pb.Money{}, errors.Wrapf(err, "item %s", v.GetItem().GetProductId())
+		}
+		if total, err = addMoney(total, &cost); err != nil {
+			return pb.Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// categoryNav returns the categories for the header navigation, or nil if
+// they could not be retrieved.
+func (fe *frontendServer) categoryNav(ctx context.Context, log logrus.FieldLogger) []*pb.Category {
+	categories, err := fe.getCategories(ctx)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to retrieve categories")
+		return nil
+	}
+	return categories
+}
+
+func findCategory(categories []*pb.Category, name string) *pb.Category {
+	for _, c := range categories {
+		if strings.EqualFold(c.GetName(), name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// categoryContext returns category as ad context, if set.
+func categoryContext(category string) []string {
+	if category == "" {
+		return []string{}
+	}
+	return []string{category}
+}
+
 func renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, code int) {
 	log.WithField("error", err).Error("request error")
 	errMsg := fmt.Sprintf("%+v", err)
@@ -578,6 +1123,32 @@ func currentCurrency(r *http.Request) string {
 	return defaultCurrency
 }
 
+// currentPromotions returns the promotion codes the shopper has entered, in
+// the order they were entered.
+func currentPromotions(r *http.Request) []string {
+	c, _ := r.Cookie(cookiePromotions)
+	if c == nil || c.Value == "" {
+		return nil
+	}
+	codes := strings.Split(c.Value, ",")
+	if len(codes) > maxPromotionCodes {
+		codes = codes[:maxPromotionCodes]
+	}
+	return codes
+}
+
+func setPromotions(w http.ResponseWriter, codes []string) {
+	cookie := &http.Cookie{
+		Name:   cookiePromotions,
+		Value:  strings.Join(codes, ","),
+		MaxAge: cookieMaxAge,
+	}
+	if len(codes) == 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
 func sessionID(r *http.Request) string {
 	v := r.Context().Value(ctxKeySessionID{})
 	if v != nil {
@@ -594,6 +1165,12 @@ func cartIDs(c []*pb.CartItem) []string {
 	return out
 }
 
+// inStock reports whether quantity of p can be ordered. Products without a
+// stock level are not tracked, so any quantity can be ordered.
+func inStock(p *pb.Product, quantity uint64) bool {
+	return p.Stock == nil || uint64(p.GetStock()) >= quantity
+}
+
 // get total # of items in cart
 func cartSize(c []*pb.CartItem) int {
 	cartSize := 0
@@ -603,9 +1180,8 @@ func cartSize(c []*pb.CartItem) int {
 	return cartSize
 }
 
-func renderMoney(money pb.Money) string {
-	currencyLogo := renderCurrencyLogo(money.GetCurrencyCode())
-	return fmt.Sprintf("%s%d.%02d", currencyLogo, money.GetUnits(), money.GetNanos()/10000000)
+func renderMoney(m pb.Money) string {
+	return renderCurrencyLogo(m.GetCurrencyCode()) + money.Format(m)
 }
 
 func renderCurrencyLogo(currencyCode string) string {
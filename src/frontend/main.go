@@ -19,9 +19,14 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/profiler"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/grpcclient"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
@@ -29,8 +34,10 @@ import (
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"google.golang.org/grpc"
 )
@@ -40,9 +47,31 @@ const (
 	defaultCurrency = "USD"
 	cookieMaxAge    = 60 * 60 * 48
 
-	cookiePrefix    = "shop_"
-	cookieSessionID = cookiePrefix + "session-id"
-	cookieCurrency  = cookiePrefix + "currency"
+	defaultShippingMethod = "standard"
+
+	cookiePrefix     = "shop_"
+	cookieSessionID  = cookiePrefix + "session-id"
+	cookieCurrency   = cookiePrefix + "currency"
+	cookiePromotions = cookiePrefix + "promotions"
+
+	// maxPromotionCodes is how many codes a shopper can apply at once.
+	maxPromotionCodes = 5
+
+	// homePageSize and searchPageSize are how many products a page of the
+	// home page and of search results show.
+	homePageSize   = 12
+	searchPageSize = 12
+
+	// lowStockThreshold is the stock level at which product pages start
+	// showing how many units are left.
+	lowStockThreshold = 10
+
+	// Defaults for CATALOG_CACHE_TTL, CURRENCY_CACHE_TTL and
+	// CACHE_MAX_ENTRIES. Catalog entries expire sooner since they carry
+	// stock levels.
+	defaultCatalogCacheTTL  = 30 * time.Second
+	defaultCurrencyCacheTTL = 10 * time.Minute
+	defaultCacheMaxEntries  = 10000
 )
 
 var (
@@ -55,6 +84,16 @@ var (
 		"TRY": true,
 	}
 
+	// defaultAddress prefills the checkout form, and is where the cart page
+	// estimates shipping and tax for.
+	defaultAddress = &pb.Address{
+		StreetAddress: "1600 Amphitheatre Parkway",
+		City:          "Mountain View",
+		State:         "CA",
+		Country:       "United States",
+		ZipCode:       94043,
+	}
+
 	baseUrl = ""
 )
 
@@ -86,6 +125,9 @@ type frontendServer struct {
 	collectorConn *grpc.ClientConn
 
 	shoppingAssistantSvcAddr string
+
+	orders *orderHistory
+	caches *rpcCaches
 }
 
 func main() {
@@ -105,6 +147,8 @@ func main() {
 	log.Out = os.Stdout
 
 	svc := new(frontendServer)
+	svc.orders = newOrderHistory()
+	initCaches(log, svc)
 
 	otel.SetTextMapPropagator(
 		propagation.NewCompositeTextMapPropagator(
@@ -119,6 +163,13 @@ func main() {
 		log.Info("Tracing disabled.")
 	}
 
+	if os.Getenv("ENABLE_STATS") == "1" {
+		log.Info("Stats enabled.")
+		initStats(log, ctx, svc)
+	} else {
+		log.Info("Stats disabled.")
+	}
+
 	if os.Getenv("ENABLE_PROFILER") == "1" {
 		log.Info("Profiling enabled.")
 		go initProfiling(log, "frontend", "1.0.0")
@@ -140,23 +191,30 @@ func main() {
 	mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
 	mustMapEnv(&svc.shoppingAssistantSvcAddr, "SHOPPING_ASSISTANT_SERVICE_ADDR")
 
-	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
-	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
-	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
-	mustConnGRPC(ctx, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
-	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
-	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
-	mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
+	mustConnGRPC(log, &svc.currencySvcConn, svc.currencySvcAddr)
+	mustConnGRPC(log, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
+	mustConnGRPC(log, &svc.cartSvcConn, svc.cartSvcAddr)
+	mustConnGRPC(log, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
+	mustConnGRPC(log, &svc.shippingSvcConn, svc.shippingSvcAddr)
+	mustConnGRPC(log, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
+	mustConnGRPC(log, &svc.adSvcConn, svc.adSvcAddr)
 
 	r := mux.NewRouter()
 	r.HandleFunc(baseUrl+"/", svc.homeHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(baseUrl+"/category/{name}", svc.categoryHandler).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc(baseUrl+"/product/{id}", svc.productHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(baseUrl+"/search", svc.searchHandler).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc(baseUrl+"/cart", svc.viewCartHandler).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc(baseUrl+"/cart", svc.addToCartHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl+"/cart/empty", svc.emptyCartHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/cart/promotions", svc.applyPromotionHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/cart/promotions/remove", svc.removePromotionHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl+"/setCurrency", svc.setCurrencyHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl+"/logout", svc.logoutHandler).Methods(http.MethodGet)
 	r.HandleFunc(baseUrl+"/cart/checkout", svc.placeOrderHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/orders", svc.orderHistoryHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(baseUrl+"/orders/{id}", svc.orderDetailsHandler).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(baseUrl+"/track/{id}", svc.trackShipmentHandler).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc(baseUrl+"/assistant", svc.assistantHandler).Methods(http.MethodGet)
 	r.PathPrefix(baseUrl + "/static/").Handler(http.StripPrefix(baseUrl+"/static/", http.FileServer(http.Dir("./static/"))))
 	r.HandleFunc(baseUrl+"/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
@@ -172,13 +230,69 @@ func main() {
 	log.Infof("starting server on " + addr + ":" + srvPort)
 	log.Fatal(http.ListenAndServe(addr+":"+srvPort, handler))
 }
-func initStats(log logrus.FieldLogger) {
-	// TODO(arbrown) Implement OpenTelemtry stats
+
+// initCaches sets up the RPC caches from CATALOG_CACHE_TTL,
+// CURRENCY_CACHE_TTL and CACHE_MAX_ENTRIES, and empties them whenever the
+// process receives SIGUSR1.
+func initCaches(log logrus.FieldLogger, svc *frontendServer) {
+	catalogTTL, currencyTTL := defaultCatalogCacheTTL, defaultCurrencyCacheTTL
+	for env, ttl := range map[string]*time.Duration{
+		"CATALOG_CACHE_TTL":  &catalogTTL,
+		"CURRENCY_CACHE_TTL": &currencyTTL,
+	} {
+		if s := os.Getenv(env); s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil {
+				log.Fatalf("failed to parse %s (%s) as time.Duration: %+v", env, s, err)
+			}
+			*ttl = v
+		}
+	}
+	maxEntries := defaultCacheMaxEntries
+	if s := os.Getenv("CACHE_MAX_ENTRIES"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			log.Fatalf("failed to parse CACHE_MAX_ENTRIES (%s) as an integer: %+v", s, err)
+		}
+		maxEntries = v
+	}
+	svc.caches = newRPCCaches(catalogTTL, currencyTTL, maxEntries)
+	log.Infof("caching catalog data for %v and currency data for %v", catalogTTL, currencyTTL)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for sig := range sigs {
+			log.Infof("received %s, emptying caches", sig)
+			svc.invalidateCaches()
+		}
+	}()
+}
+
+// initStats exports metrics, such as cache hit rates and circuit breaker
+// states, to the collector every minute.
+func initStats(log logrus.FieldLogger, ctx context.Context, svc *frontendServer) (*sdkmetric.MeterProvider, error) {
+	if svc.collectorConn == nil {
+		mustMapEnv(&svc.collectorAddr, "COLLECTOR_SERVICE_ADDR")
+		mustConnGRPC(log, &svc.collectorConn, svc.collectorAddr)
+	}
+	exporter, err := otlpmetricgrpc.New(
+		ctx,
+		otlpmetricgrpc.WithGRPCConn(svc.collectorConn))
+	if err != nil {
+		log.Warnf("warn: Failed to create metric exporter: %v", err)
+		return nil, err
+	}
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)))
+	otel.SetMeterProvider(mp)
+
+	return mp, nil
 }
 
 func initTracing(log logrus.FieldLogger, ctx context.Context, svc *frontendServer) (*sdktrace.TracerProvider, error) {
 	mustMapEnv(&svc.collectorAddr, "COLLECTOR_SERVICE_ADDR")
-	mustConnGRPC(ctx, &svc.collectorConn, svc.collectorAddr)
+	mustConnGRPC(log, &svc.collectorConn, svc.collectorAddr)
 	exporter, err := otlptracegrpc.New(
 		ctx,
 		otlptracegrpc.WithGRPCConn(svc.collectorConn))
@@ -224,12 +338,9 @@ func mustMapEnv(target *string, envKey string) {
 	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
+func mustConnGRPC(log logrus.FieldLogger, conn **grpc.ClientConn, addr string) {
 	var err error
-	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
-	defer cancel()
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
+	*conn, err = grpcclient.Dial(addr, log,
 		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
 		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()))
 	if err != nil {
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+const (
+	maxOrdersPerSession = 50
+	orderHistoryTTL     = cookieMaxAge * time.Second
+)
+
+// placedOrder is an order as it was shown to the shopper at checkout, with
+// prices in the currency they paid in.
+type placedOrder struct {
+	Order     *pb.OrderResult
+	TotalPaid *pb.Money
+	PlacedAt  time.Time
+}
+
+type sessionOrders struct {
+	orders   []*placedOrder // most recent first
+	lastSeen time.Time
+}
+
+// orderHistory keeps the orders placed in each session in memory. Sessions
+// are forgotten once their cookie would have expired.
+type orderHistory struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionOrders
+	now      func() time.Time
+}
+
+func newOrderHistory() *orderHistory {
+	return &orderHistory{
+		sessions: make(map[string]*sessionOrders),
+		now:      time.Now,
+	}
+}
+
+// record adds an order to the session's history. An order that is already
+// there, e.g. because a double-submitted checkout form was answered with
+// the stored result, is replaced where it is rather than added again.
+func (h *orderHistory) record(sessionID string, order *pb.OrderResult, totalPaid *pb.Money) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	h.expireLocked(now)
+
+	s, ok := h.sessions[sessionID]
+	if !ok {
+		s = new(sessionOrders)
+		h.sessions[sessionID] = s
+	}
+	s.lastSeen = now
+	for i, o := range s.orders {
+		if o.Order.GetOrderId() == order.GetOrderId() {
+			s.orders[i] = &placedOrder{Order: order, TotalPaid: totalPaid, PlacedAt: o.PlacedAt}
+			return
+		}
+	}
+	s.orders = append([]*placedOrder{{Order: order, TotalPaid: totalPaid, PlacedAt: now}}, s.orders...)
+	if len(s.orders) > maxOrdersPerSession {
+		s.orders = s.orders[:maxOrdersPerSession]
+	}
+}
+
+// list returns the session's orders, most recent first.
+func (h *orderHistory) list(sessionID string) []*placedOrder {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[sessionID]
+	if !ok || h.now().Sub(s.lastSeen) > orderHistoryTTL {
+		return nil
+	}
+	return append([]*placedOrder(nil), s.orders...)
+}
+
+// get returns the order with the given ID if it was placed in the session.
+func (h *orderHistory) get(sessionID, orderID string) (*placedOrder, bool) {
+	for _, o := range h.list(sessionID) {
+		if o.Order.GetOrderId() == orderID {
+			return o, true
+		}
+	}
+	return nil, false
+}
+
+func (h *orderHistory) expireLocked(now time.Time) {
+	for id, s := range h.sessions {
+		if now.Sub(s.lastSeen) > orderHistoryTTL {
+			delete(h.sessions, id)
+		}
+	}
+}
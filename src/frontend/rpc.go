@@ -16,42 +16,146 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"time"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/cache"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
 
 	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
 	avoidNoopCurrencyConversionRPC = false
 )
 
+// rpcCaches holds the catalog and currency data that nearly every page
+// reads but that rarely changes. Cached messages are shared between
+// requests and must not be modified.
+type rpcCaches struct {
+	currencies   *cache.Cache[[]string]
+	categories   *cache.Cache[[]*pb.Category]
+	products     *cache.Cache[*pb.Product]
+	productLists *cache.Cache[*pb.ListProductsResponse]
+	conversions  *cache.Cache[*pb.Money]
+}
+
+// newRPCCaches returns caches that keep catalog data for catalogTTL and
+// currency data for currencyTTL, each holding at most maxEntries entries.
+// A zero TTL turns caching off.
+func newRPCCaches(catalogTTL, currencyTTL time.Duration, maxEntries int) *rpcCaches {
+	return &rpcCaches{
+		currencies:   cache.New[[]string]("currencies", currencyTTL, 1),
+		categories:   cache.New[[]*pb.Category]("categories", catalogTTL, 1),
+		products:     cache.New[*pb.Product]("products", catalogTTL, maxEntries),
+		productLists: cache.New[*pb.ListProductsResponse]("product_lists", catalogTTL, maxEntries),
+		conversions:  cache.New[*pb.Money]("conversions", currencyTTL, maxEntries),
+	}
+}
+
+// invalidateProducts drops the cached products with the given IDs, and
+// the cached product listings and categories, which may count them.
+func (fe *frontendServer) invalidateProducts(ids ...string) {
+	fe.caches.products.Invalidate(ids...)
+	fe.caches.productLists.InvalidateAll()
+	fe.caches.categories.InvalidateAll()
+}
+
+// invalidateCaches empties every cache.
+func (fe *frontendServer) invalidateCaches() {
+	fe.caches.currencies.InvalidateAll()
+	fe.caches.categories.InvalidateAll()
+	fe.caches.products.InvalidateAll()
+	fe.caches.productLists.InvalidateAll()
+	fe.caches.conversions.InvalidateAll()
+}
+
 func (fe *frontendServer) getCurrencies(ctx context.Context) ([]string, error) {
-	currs, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
-		GetSupportedCurrencies(ctx, &pb.Empty{})
+	return fe.caches.currencies.Get(ctx, "", func(ctx context.Context) ([]string, error) {
+		currs, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
+			GetSupportedCurrencies(ctx, &pb.Empty{})
+		if err != nil {
+			return nil, err
+		}
+		var out []string
+		for _, c := range currs.CurrencyCodes {
+			if _, ok := whitelistedCurrencies[c]; ok {
+				out = append(out, c)
+			}
+		}
+		return out, nil
+	})
+}
+
+func (fe *frontendServer) listProducts(ctx context.Context, req *pb.ListProductsRequest) (*pb.ListProductsResponse, error) {
+	key, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
-	var out []string
-	for _, c := range currs.CurrencyCodes {
-		if _, ok := whitelistedCurrencies[c]; ok {
-			out = append(out, c)
-		}
-	}
-	return out, nil
+	return fe.caches.productLists.Get(ctx, string(key), func(ctx context.Context) (*pb.ListProductsResponse, error) {
+		return pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).ListProducts(ctx, req)
+	})
 }
 
-func (fe *frontendServer) getProducts(ctx context.Context) ([]*pb.Product, error) {
-	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
-		ListProducts(ctx, &pb.Empty{})
-	return resp.GetProducts(), err
+func (fe *frontendServer) getCategories(ctx context.Context) ([]*pb.Category, error) {
+	return fe.caches.categories.Get(ctx, "", func(ctx context.Context) ([]*pb.Category, error) {
+		resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
+			ListCategories(ctx, &pb.Empty{})
+		return resp.GetCategories(), err
+	})
 }
 
 func (fe *frontendServer) getProduct(ctx context.Context, id string) (*pb.Product, error) {
-	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
+	return fe.caches.products.Get(ctx, id, func(ctx context.Context) (*pb.Product, error) {
+		return fe.fetchProduct(ctx, id)
+	})
+}
+
+func (fe *frontendServer) fetchProduct(ctx context.Context, id string) (*pb.Product, error) {
+	return pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
 		GetProduct(ctx, &pb.GetProductRequest{Id: id})
-	return resp, err
+}
+
+// getProducts returns the products with the given IDs, keyed by ID. IDs
+// with no product are left out.
+func (fe *frontendServer) getProducts(ctx context.Context, ids []string) (map[string]*pb.Product, error) {
+	if len(ids) == 0 {
+		return map[string]*pb.Product{}, nil
+	}
+	return fe.caches.products.GetMany(ctx, ids, fe.fetchProducts)
+}
+
+// fetchProducts is getProducts without the cache. It looks the products up
+// one by one if the catalog has no batch call.
+func (fe *frontendServer) fetchProducts(ctx context.Context, ids []string) (map[string]*pb.Product, error) {
+	out := make(map[string]*pb.Product, len(ids))
+	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
+		GetProducts(ctx, &pb.GetProductsRequest{Ids: ids})
+	if status.Code(err) == codes.Unimplemented {
+		for _, id := range ids {
+			p, err := fe.fetchProduct(ctx, id)
+			if status.Code(err) == codes.NotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			out[id] = p
+		}
+		return out, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, p := range resp.GetProducts() {
+		out[p.GetId()] = p
+	}
+	return out, nil
+}
+
+func (fe *frontendServer) searchProducts(ctx context.Context, req *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
+	return pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).SearchProducts(ctx, req)
 }
 
 func (fe *frontendServer) getCart(ctx context.Context, userID string) ([]*pb.CartItem, error) {
@@ -74,26 +178,124 @@ func (fe *frontendServer) insertCart(ctx context.Context, userID, productID stri
 	return err
 }
 
+// conversionKey identifies the conversion of amount to currency in the
+// conversions cache.
+func conversionKey(amount *pb.Money, currency string) string {
+	return fmt.Sprintf("%s %d %d %s", amount.GetCurrencyCode(), amount.GetUnits(), amount.GetNanos(), currency)
+}
+
 func (fe *frontendServer) convertCurrency(ctx context.Context, money *pb.Money, currency string) (*pb.Money, error) {
 	if avoidNoopCurrencyConversionRPC && money.GetCurrencyCode() == currency {
 		return money, nil
 	}
+	return fe.caches.conversions.Get(ctx, conversionKey(money, currency), func(ctx context.Context) (*pb.Money, error) {
+		return fe.fetchConversion(ctx, money, currency)
+	})
+}
+
+func (fe *frontendServer) fetchConversion(ctx context.Context, money *pb.Money, currency string) (*pb.Money, error) {
 	return pb.NewCurrencyServiceClient(fe.currencySvcConn).
 		Convert(ctx, &pb.CurrencyConversionRequest{
 			From:   money,
 			ToCode: currency})
 }
 
-func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.CartItem, currency string) (*pb.Money, error) {
+// convertCurrencies converts amounts to currency, in the same order.
+func (fe *frontendServer) convertCurrencies(ctx context.Context, amounts []*pb.Money, currency string) ([]*pb.Money, error) {
+	noop := avoidNoopCurrencyConversionRPC
+	for _, m := range amounts {
+		noop = noop && m.GetCurrencyCode() == currency
+	}
+	if noop || len(amounts) == 0 {
+		return amounts, nil
+	}
+	keys := make([]string, len(amounts))
+	byKey := make(map[string]*pb.Money, len(amounts))
+	for i, m := range amounts {
+		keys[i] = conversionKey(m, currency)
+		byKey[keys[i]] = m
+	}
+	converted, err := fe.caches.conversions.GetMany(ctx, keys, func(ctx context.Context, keys []string) (map[string]*pb.Money, error) {
+		missing := make([]*pb.Money, len(keys))
+		for i, k := range keys {
+			missing[i] = byKey[k]
+		}
+		results, err := fe.fetchConversions(ctx, missing, currency)
+		if err != nil {
+			return nil, err
+		}
+		out := make(map[string]*pb.Money, len(keys))
+		for i, k := range keys {
+			out[k] = results[i]
+		}
+		return out, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*pb.Money, len(amounts))
+	for i, k := range keys {
+		out[i] = converted[k]
+	}
+	return out, nil
+}
+
+// fetchConversions is convertCurrencies without the cache. It converts the
+// amounts one by one if the currency service has no batch call.
+func (fe *frontendServer) fetchConversions(ctx context.Context, amounts []*pb.Money, currency string) ([]*pb.Money, error) {
+	resp, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
+		ConvertBatch(ctx, &pb.ConvertBatchRequest{
+			From:   amounts,
+			ToCode: currency})
+	if status.Code(err) == codes.Unimplemented {
+		out := make([]*pb.Money, len(amounts))
+		for i, m := range amounts {
+			if out[i], err = fe.fetchConversion(ctx, m, currency); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(resp.GetResults()) != len(amounts) {
+		return nil, errors.Errorf("got %d conversions for %d amounts", len(resp.GetResults()), len(amounts))
+	}
+	return resp.GetResults(), nil
+}
+
+// getShippingOptions returns the available shipping methods, cheapest first.
+// It is never empty.
+func (fe *frontendServer) getShippingOptions(ctx context.Context, address *pb.Address, items []*pb.CartItem, subtotalUSD *pb.Money) ([]*pb.ShippingOption, error) {
 	quote, err := pb.NewShippingServiceClient(fe.shippingSvcConn).GetQuote(ctx,
 		&pb.GetQuoteRequest{
-			Address: nil,
-			Items:   items})
+			Address:     address,
+			Items:       items,
+			SubtotalUsd: subtotalUSD})
 	if err != nil {
 		return nil, err
 	}
-	localized, err := fe.convertCurrency(ctx, quote.GetCostUsd(), currency)
-	return localized, errors.Wrap(err, "failed to convert currency for shipping cost")
+	if len(quote.GetOptions()) == 0 {
+		return []*pb.ShippingOption{{MethodId: defaultShippingMethod, CostUsd: quote.GetCostUsd()}}, nil
+	}
+	return quote.GetOptions(), nil
+}
+
+// applyPromotions prices items for shipping to address with the promotion
+// codes applied, returning the discounts and the tax due after them.
+func (fe *frontendServer) applyPromotions(ctx context.Context, userID string, address *pb.Address, items []*pb.CartItem, currency string, codes []string) (*pb.ApplyPromotionsResponse, error) {
+	return pb.NewCheckoutServiceClient(fe.checkoutSvcConn).ApplyPromotions(ctx,
+		&pb.ApplyPromotionsRequest{
+			UserId:         userID,
+			UserCurrency:   currency,
+			Items:          items,
+			PromotionCodes: codes,
+			Address:        address})
+}
+
+func (fe *frontendServer) trackShipment(ctx context.Context, trackingID string) (*pb.TrackShipmentResponse, error) {
+	return pb.NewShippingServiceClient(fe.shippingSvcConn).TrackShipment(ctx,
+		&pb.TrackShipmentRequest{TrackingId: trackingID})
 }
 
 func (fe *frontendServer) getRecommendations(ctx context.Context, userID string, productIDs []string) ([]*pb.Product, error) {
@@ -102,18 +304,21 @@ func (fe *frontendServer) getRecommendations(ctx context.Context, userID string,
 	if err != nil {
 		return nil, err
 	}
-	out := make([]*pb.Product, len(resp.GetProductIds()))
-	for i, v := range resp.GetProductIds() {
-		p, err := fe.getProduct(ctx, v)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get recommended product info (#%s)", v)
-		}
-		out[i] = p
+	ids := resp.GetProductIds()
+	if len(ids) > 4 {
+		ids = ids[:4] // take only first four to fit the UI
 	}
-	if len(out) > 4 {
-		out = out[:4] // take only first four to fit the UI
+	products, err := fe.getProducts(ctx, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get recommended product info")
+	}
+	out := make([]*pb.Product, 0, len(ids))
+	for _, id := range ids {
+		if p, ok := products[id]; ok {
+			out = append(out, p)
+		}
 	}
-	return out, err
+	return out, nil
 }
 
 func (fe *frontendServer) getAd(ctx context.Context, ctxKeys []string) ([]*pb.Ad, error) {
@@ -0,0 +1,33 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/tracking"
+	"github.com/go-playground/validator/v10"
+)
+
+// CanonicalTrackingID returns the canonical form of a tracking ID, or false
+// if it is malformed or fails its check digit, so typos are rejected without
+// a round trip to the shipping service. Case, dashes and spaces are ignored.
+func CanonicalTrackingID(id string) (string, bool) {
+	canonical, err := tracking.Validate(id)
+	return canonical, err == nil
+}
+
+func isTrackingID(fl validator.FieldLevel) bool {
+	_, ok := CanonicalTrackingID(fl.Field().String())
+	return ok
+}
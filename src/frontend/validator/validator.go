@@ -28,6 +28,7 @@ var validate *validator.Validate
 // benefit of caching struct info and validations.
 func init() {
 	validate = validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterValidation("tracking_id", isTrackingID)
 }
 
 type Payload interface {
@@ -40,22 +41,47 @@ type AddToCartPayload struct {
 }
 
 type PlaceOrderPayload struct {
-	Email         string `validate:"required,email"`
-	StreetAddress string `validate:"required,max=512"`
-	ZipCode       int64  `validate:"required"`
-	City          string `validate:"required,max=128"`
-	State         string `validate:"required,max=128"`
-	Country       string `validate:"required,max=128"`
-	CcNumber      string `validate:"required,credit_card"`
-	CcMonth       int64  `validate:"required,gte=1,lte=12"`
-	CcYear        int64  `validate:"required"`
-	CcCVV         int64  `validate:"required"`
+	Email          string   `validate:"required,email"`
+	StreetAddress  string   `validate:"required,max=512"`
+	ZipCode        int64    `validate:"required"`
+	City           string   `validate:"required,max=128"`
+	State          string   `validate:"required,max=128"`
+	Country        string   `validate:"required,max=128"`
+	CcNumber       string   `validate:"required,credit_card"`
+	CcMonth        int64    `validate:"required,gte=1,lte=12"`
+	CcYear         int64    `validate:"required"`
+	CcCVV          int64    `validate:"required"`
+	IdempotencyKey string   `validate:"omitempty,uuid"`
+	ShippingMethod string   `validate:"omitempty,alpha,max=32"`
+	PromotionCodes []string `validate:"max=5,dive,alphanum,max=32"`
 }
 
 type SetCurrencyPayload struct {
 	Currency string `validate:"required,iso4217"`
 }
 
+type ApplyPromotionPayload struct {
+	Code string `validate:"required,alphanum,max=32"`
+}
+
+type ListProductsPayload struct {
+	Category  string `validate:"omitempty,max=64"`
+	PageToken string `validate:"omitempty,max=256"`
+}
+
+type SearchPayload struct {
+	Query     string `validate:"max=128"`
+	Category  string `validate:"omitempty,max=64"`
+	MinPrice  string `validate:"omitempty,numeric,max=16"`
+	MaxPrice  string `validate:"omitempty,numeric,max=16"`
+	Sort      string `validate:"omitempty,oneof=relevance price_asc price_desc name"`
+	PageToken string `validate:"omitempty,max=256"`
+}
+
+type TrackShipmentPayload struct {
+	TrackingID string `validate:"required,tracking_id"`
+}
+
 // Implementations of the 'Payload' interface.
 func (ad *AddToCartPayload) Validate() error {
 	return validate.Struct(ad)
@@ -69,6 +95,22 @@ func (sc *SetCurrencyPayload) Validate() error {
 	return validate.Struct(sc)
 }
 
+func (ap *ApplyPromotionPayload) Validate() error {
+	return validate.Struct(ap)
+}
+
+func (lp *ListProductsPayload) Validate() error {
+	return validate.Struct(lp)
+}
+
+func (sp *SearchPayload) Validate() error {
+	return validate.Struct(sp)
+}
+
+func (ts *TrackShipmentPayload) Validate() error {
+	return validate.Struct(ts)
+}
+
 // Reusable error response function.
 func ValidationErrorResponse(err error) error {
 	validationErrs, ok := err.(validator.ValidationErrors)
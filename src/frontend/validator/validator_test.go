@@ -183,3 +183,159 @@ func TestSetCurrencyFailsValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestPlaceOrderIdempotencyKeyValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"no key", "", false},
+		{"valid key", "6f1c3a8e-2b7d-4c1e-9a4f-0d2e5b6c7a81", false},
+		{"invalid key", "not-a-uuid", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := PlaceOrderPayload{
+				Email:          "test@example.com",
+				StreetAddress:  "12345 example street",
+				ZipCode:        10004,
+				City:           "New York",
+				State:          "New York",
+				Country:        "United States",
+				CcNumber:       "5272940000751666",
+				CcMonth:        4,
+				CcYear:         2024,
+				CcCVV:          584,
+				IdempotencyKey: tt.key,
+			}
+			if err := payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() with key %q = %v, wantErr %v", tt.key, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlaceOrderShippingMethodValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		wantErr bool
+	}{
+		{"default method", "", false},
+		{"express", "express", false},
+		{"not a method id", "<script>", true},
+		{"too long", "overnightovernightovernightovernight", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := PlaceOrderPayload{
+				Email:          "test@example.com",
+				StreetAddress:  "12345 example street",
+				ZipCode:        10004,
+				City:           "New York",
+				State:          "New York",
+				Country:        "United States",
+				CcNumber:       "5272940000751666",
+				CcMonth:        4,
+				CcYear:         2024,
+				CcCVV:          584,
+				ShippingMethod: tt.method,
+			}
+			if err := payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() with method %q = %v, wantErr %v", tt.method, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrackShipmentValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		wantErr bool
+	}{
+		{"valid", "0C9N4-K7R2M-1QT6", false},
+		{"lower case without dashes", "0c9n4k7r2m1qt6", false},
+		{"empty", "", true},
+		{"wrong check digit", "0C9N4-K7R2M-1QT7", true},
+		{"mistyped digit", "0C9N4-K7R3M-1QT6", true},
+		{"not base32", "0C9N4-K7R2M-1QU6", true},
+		{"too short", "0C9N4-K7R2M", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := TrackShipmentPayload{TrackingID: tt.id}
+			if err := payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() with tracking ID %q = %v, wantErr %v", tt.id, err, tt.wantErr)
+			}
+		})
+	}
+	if got, _ := CanonicalTrackingID("0c9n4k7r2m1qt6"); got != "0C9N4-K7R2M-1QT6" {
+		t.Errorf("CanonicalTrackingID() = %q, want %q", got, "0C9N4-K7R2M-1QT6")
+	}
+}
+
+func TestApplyPromotionValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		wantErr bool
+	}{
+		{"valid", "WELCOME10", false},
+		{"lower case", "save5", false},
+		{"empty", "", true},
+		{"punctuation", "SAVE-5", true},
+		{"separator", "SAVE5,FREESHIP", true},
+		{"too long", "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := ApplyPromotionPayload{Code: tt.code}
+			if err := payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() with code %q = %v, wantErr %v", tt.code, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSearchValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload SearchPayload
+		wantErr bool
+	}{
+		{"empty", SearchPayload{}, false},
+		{"everything", SearchPayload{Query: "mug", Category: "kitchen", MinPrice: "5", MaxPrice: "19.99", Sort: "price_asc"}, false},
+		{"long query", SearchPayload{Query: strings.Repeat("a", 129)}, true},
+		{"price not a number", SearchPayload{MinPrice: "5 dollars"}, true},
+		{"unknown sort", SearchPayload{Sort: "random"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListProductsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload ListProductsPayload
+		wantErr bool
+	}{
+		{"empty", ListProductsPayload{}, false},
+		{"category and page", ListProductsPayload{Category: "kitchen", PageToken: "abc123"}, false},
+		{"long category", ListProductsPayload{Category: strings.Repeat("a", 65)}, true},
+		{"long page token", ListProductsPayload{PageToken: strings.Repeat("a", 257)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.payload.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
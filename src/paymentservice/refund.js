@@ -0,0 +1,49 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+const { v4: uuidv4 } = require('uuid');
+const pino = require('pino');
+
+const logger = pino({
+  name: 'paymentservice-refund',
+  messageKey: 'message',
+  formatters: {
+    level (logLevelString, logLevelNum) {
+      return { severity: logLevelString }
+    }
+  }
+});
+
+class RefundError extends Error {
+  constructor (message) {
+    super(message);
+    this.code = 400; // Invalid argument error
+  }
+}
+
+/**
+ * (Pretend) refunds a previous charge.
+ *
+ * @param {*} request
+ * @return refund_id - a random uuid.
+ */
+module.exports = function refund (request) {
+  const { transaction_id: transactionId, amount } = request;
+  if (!transactionId) { throw new RefundError('Refund requires the transaction_id of the original charge'); }
+
+  logger.info(`Refund processed: transaction ${transactionId} \
+    Amount: ${amount.currency_code}${amount.units}.${amount.nanos}`);
+
+  return { refund_id: uuidv4() };
+};
@@ -17,6 +17,7 @@ const grpc = require("@grpc/grpc-js");
 const protoLoader = require("@grpc/proto-loader");
 
 const charge = require("./charge");
+const refund = require("./refund");
 
 const logger = require("./logger");
 
@@ -53,6 +54,24 @@ class HipsterShopServer {
     }
   }
 
+  /**
+   * Handler for PaymentService.Refund.
+   * @param {*} call  { RefundRequest }
+   * @param {*} callback  fn(err, RefundResponse)
+   */
+  static RefundServiceHandler(call, callback) {
+    try {
+      logger.info(
+        `PaymentService#Refund invoked with request ${JSON.stringify(call.request)}`,
+      );
+      const response = refund(call.request);
+      callback(null, response);
+    } catch (err) {
+      console.warn(err);
+      callback(err);
+    }
+  }
+
   static CheckHandler(call, callback) {
     callback(null, { status: "SERVING" });
   }
@@ -87,6 +106,7 @@ class HipsterShopServer {
 
     this.server.addService(hipsterShopPackage.PaymentService.service, {
       charge: HipsterShopServer.ChargeServiceHandler.bind(this),
+      refund: HipsterShopServer.RefundServiceHandler.bind(this),
     });
 
     this.server.addService(healthPackage.Health.service, {
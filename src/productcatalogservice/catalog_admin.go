@@ -0,0 +1,242 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/money"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// productPicturePrefix is where the frontend serves product pictures from.
+const productPicturePrefix = "/static/img/products/"
+
+const (
+	maxProductNameLength  = 128
+	maxDescriptionLength  = 2048
+	maxProductCategories  = 10
+	maxCategoryNameLength = 64
+)
+
+var (
+	errUnauthenticated = errors.New("missing or invalid admin token")
+
+	productIDPattern   = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	pictureNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*\.(jpg|jpeg|png|webp)$`)
+)
+
+// catalogAdmin makes authenticated changes to the catalog through its store,
+// and records them in an audit log.
+type catalogAdmin struct {
+	store CatalogStore
+	// watcher swaps in the catalog once a change is saved.
+	watcher *catalogWatcher
+	// tokens maps admin tokens to the names of their holders.
+	tokens map[string]string
+	// pictureDir, if set, holds the frontend's product pictures; a product
+	// picture must be one of its files.
+	pictureDir string
+	audit      *auditLog
+
+	// mu makes each change and the reload that follows it atomic.
+	mu sync.Mutex
+}
+
+func newCatalogAdmin(store CatalogStore, watcher *catalogWatcher, tokens map[string]string, pictureDir string, audit *auditLog) *catalogAdmin {
+	return &catalogAdmin{store: store, watcher: watcher, tokens: tokens, pictureDir: pictureDir, audit: audit}
+}
+
+// parseAdminTokens parses a comma-separated list of name:token pairs, as in
+// CATALOG_ADMIN_TOKENS.
+func parseAdminTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || len(token) < 16 {
+			return nil, fmt.Errorf("admin token for %q must be given as name:token, with at least 16 characters of token", name)
+		}
+		if _, dup := tokens[token]; dup {
+			return nil, fmt.Errorf("admin token for %q is already in use", name)
+		}
+		tokens[token] = name
+	}
+	return tokens, nil
+}
+
+// authenticate returns the name of the admin whose token is in ctx's
+// "authorization" metadata.
+func (a *catalogAdmin) authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(v, "Bearer ")
+		if !ok {
+			continue
+		}
+		for t, name := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return name, nil
+			}
+		}
+	}
+	return "", errUnauthenticated
+}
+
+// validateProduct checks a product sent to the admin API, and normalizes its
+// categories to lower case.
+func (a *catalogAdmin) validateProduct(p *pb.Product) error {
+	switch {
+	case !productIDPattern.MatchString(p.GetId()):
+		return errors.New("product ID must be 1 to 64 letters, digits, dashes or underscores")
+	case strings.TrimSpace(p.GetName()) == "" || len(p.GetName()) > maxProductNameLength:
+		return fmt.Errorf("product name must be 1 to %d characters", maxProductNameLength)
+	case len(p.GetDescription()) > maxDescriptionLength:
+		return fmt.Errorf("product description must be at most %d characters", maxDescriptionLength)
+	case p.GetPriceUsd() == nil:
+		return errors.New("product price is required")
+	case p.GetPriceUsd().GetCurrencyCode() != "USD":
+		return errors.New("product price must be in USD")
+	case !money.IsValid(*p.GetPriceUsd()) || money.IsNegative(*p.GetPriceUsd()):
+		return errors.New("product price must be a valid, non-negative amount")
+	case p.GetStock() < 0:
+		return errors.New("product stock must not be negative")
+	case len(p.GetCategories()) > maxProductCategories:
+		return fmt.Errorf("a product can have at most %d categories", maxProductCategories)
+	}
+	for i, c := range p.GetCategories() {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" || len(c) > maxCategoryNameLength || strings.Contains(c, ",") {
+			return fmt.Errorf("category %q must be 1 to %d characters without commas", p.Categories[i], maxCategoryNameLength)
+		}
+		p.Categories[i] = c
+	}
+	return a.validatePicture(p.GetPicture())
+}
+
+// validatePicture checks that picture is a product picture the frontend
+// serves.
+func (a *catalogAdmin) validatePicture(picture string) error {
+	name, ok := strings.CutPrefix(picture, productPicturePrefix)
+	if !ok || !pictureNamePattern.MatchString(name) || path.Clean(picture) != picture {
+		return fmt.Errorf("product picture must be an image under %s", productPicturePrefix)
+	}
+	if a.pictureDir == "" {
+		return nil
+	}
+	if fi, err := os.Stat(filepath.Join(a.pictureDir, name)); err != nil || !fi.Mode().IsRegular() {
+		return fmt.Errorf("unknown product picture %s", picture)
+	}
+	return nil
+}
+
+// auditLog records catalog changes as JSON lines, or in the service log if
+// it has no writer.
+type auditLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{w: w, now: time.Now}
+}
+
+// auditEntry is a record of one change. Before is unset for creations and
+// After for deletions.
+type auditEntry struct {
+	Time      time.Time       `json:"time"`
+	Admin     string          `json:"admin"`
+	Action    string          `json:"action"`
+	ProductID string          `json:"product_id"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+func (l *auditLog) record(admin, action, id string, before, after *pb.Product) {
+	entry := auditEntry{
+		Time:      l.now().UTC(),
+		Admin:     admin,
+		Action:    action,
+		ProductID: id,
+		Before:    auditProduct(before),
+		After:     auditProduct(after),
+	}
+	if l.w == nil {
+		log.WithField("audit", entry).Infof("catalog change: %s %s by %s", action, id, admin)
+		return
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("failed to encode audit log entry: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		log.WithField("audit", entry).Errorf("failed to write audit log entry: %v", err)
+	}
+}
+
+func auditProduct(p *pb.Product) json.RawMessage {
+	if p == nil {
+		return nil
+	}
+	b, err := protojson.Marshal(p)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// apply makes a change through the store, swaps in the reloaded catalog and
+// records the change against admin. after is the product as changed, or nil
+// for a deletion.
+func (a *catalogAdmin) apply(ctx context.Context, catalog *productCatalog, admin, action, id string, after *pb.Product, change func() error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	before, _ := catalog.snapshot().product(id)
+	if err := change(); err != nil {
+		return err
+	}
+	if err := a.watcher.reloadNow(ctx); err != nil {
+		// The change is saved; the watcher picks it up once the catalog
+		// loads again.
+		log.Errorf("failed to reload catalog after %s of %s: %v", action, id, err)
+	}
+	if after != nil {
+		after = proto.Clone(after).(*pb.Product)
+	}
+	a.audit.record(admin, action, id, before, after)
+	return nil
+}
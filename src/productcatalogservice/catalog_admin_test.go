@@ -0,0 +1,282 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const testAdminToken = "0123456789abcdef"
+
+// testAdminCatalog is a catalog of storeTestProducts in a JSON file, with
+// the admin API enabled for "alice". It returns the audit log's output.
+func testAdminCatalog(t *testing.T) (*productCatalog, *bytes.Buffer) {
+	t.Helper()
+	store, _ := fileBackend("products.json", jsonCatalog)(t, storeTestProducts)
+	catalog, err := loadCatalog(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := newProductCatalog(catalog, newInventory(defaultReservationTTL))
+	load := func() (*catalogIndex, error) {
+		return loadCatalog(context.Background(), store)
+	}
+	w := newCatalogWatcher(svc, load, watchedFile(store), 0)
+	var audit bytes.Buffer
+	svc.admin = newCatalogAdmin(store, w, map[string]string{testAdminToken: "alice"}, "", newAuditLog(&audit))
+	svc.admin.audit.now = func() time.Time { return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC) }
+	return svc, &audit
+}
+
+func adminContext(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestCatalogAdminChanges(t *testing.T) {
+	svc, audit := testAdminCatalog(t)
+	ctx := adminContext(testAdminToken)
+
+	shakers := &pb.Product{Id: "SHAKERS", Name: "Salt & Pepper Shakers", Picture: "/static/img/products/salt-and-pepper-shakers.jpg",
+		PriceUsd: usd(18, 490000000), Categories: []string{"Kitchen"}, Stock: proto.Int32(3)}
+	if _, err := svc.CreateProduct(ctx, &pb.CreateProductRequest{Product: shakers}); err != nil {
+		t.Fatalf("CreateProduct() = %v", err)
+	}
+	got, err := svc.GetProduct(ctx, &pb.GetProductRequest{Id: "SHAKERS"})
+	if err != nil {
+		t.Fatalf("created product not in catalog: %v", err)
+	}
+	if got.Categories[0] != "kitchen" {
+		t.Errorf("got category %q, want it lower cased", got.Categories[0])
+	}
+
+	mug := proto.Clone(storeTestProducts[1]).(*pb.Product)
+	mug.PriceUsd = usd(9, 500000000)
+	if _, err := svc.UpdateProduct(ctx, &pb.UpdateProductRequest{Product: mug}); err != nil {
+		t.Fatalf("UpdateProduct() = %v", err)
+	}
+	got, _ = svc.GetProduct(ctx, &pb.GetProductRequest{Id: "MUG"})
+	if !proto.Equal(got.PriceUsd, mug.PriceUsd) {
+		t.Errorf("got price %v after update, want %v", got.PriceUsd, mug.PriceUsd)
+	}
+
+	if _, err := svc.DeleteProduct(ctx, &pb.DeleteProductRequest{Id: "TOP"}); err != nil {
+		t.Fatalf("DeleteProduct() = %v", err)
+	}
+	if _, err := svc.GetProduct(ctx, &pb.GetProductRequest{Id: "TOP"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetProduct() of a deleted product = %v, want NotFound", err)
+	}
+
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad audit log line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d audit log entries, want 3", len(entries))
+	}
+	for i, want := range []struct{ action, id string }{{"create", "SHAKERS"}, {"update", "MUG"}, {"delete", "TOP"}} {
+		if e := entries[i]; e.Admin != "alice" || e.Action != want.action || e.ProductID != want.id {
+			t.Errorf("audit log entry %d = %s %s by %s, want %s %s by alice", i, e.Action, e.ProductID, e.Admin, want.action, want.id)
+		}
+	}
+	if entries[0].Before != nil || entries[0].After == nil {
+		t.Error("creation should be logged without a before and with an after")
+	}
+	if entries[1].Before == nil || !strings.Contains(string(entries[1].After), `"units":"9"`) {
+		t.Errorf("update should be logged with before and after, got %s -> %s", entries[1].Before, entries[1].After)
+	}
+	if entries[2].Before == nil || entries[2].After != nil {
+		t.Error("deletion should be logged with a before and without an after")
+	}
+}
+
+// TestCatalogAdminChangeRacesWatcher checks that a watcher reload that read
+// the catalog before an admin change does not swap it back in after it.
+func TestCatalogAdminChangeRacesWatcher(t *testing.T) {
+	svc, _ := testAdminCatalog(t)
+	w := svc.admin.watcher
+	// Someone edits the file, and the watcher starts reloading it.
+	jar := proto.Clone(storeTestProducts[0]).(*pb.Product)
+	jar.PriceUsd = usd(6, 0)
+	if err := svc.admin.store.UpdateProduct(context.Background(), jar); err != nil {
+		t.Fatal(err)
+	}
+	load := w.load
+	loaded, resume := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	w.load = func() (*catalogIndex, error) {
+		catalog, err := load()
+		once.Do(func() {
+			close(loaded)
+			<-resume
+		})
+		return catalog, err
+	}
+
+	checked := make(chan struct{})
+	go func() {
+		w.check(context.Background(), true)
+		close(checked)
+	}()
+	<-loaded
+
+	mug := proto.Clone(storeTestProducts[1]).(*pb.Product)
+	mug.PriceUsd = usd(9, 500000000)
+	updated := make(chan error, 1)
+	go func() {
+		_, err := svc.UpdateProduct(adminContext(testAdminToken), &pb.UpdateProductRequest{Product: mug})
+		updated <- err
+	}()
+	// Let the watcher finish once the change is saved.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		products, err := svc.admin.store.Products(context.Background())
+		if err == nil && proto.Equal(products[1].GetPriceUsd(), mug.PriceUsd) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the change was not saved")
+		}
+	}
+	close(resume)
+	<-checked
+	if err := <-updated; err != nil {
+		t.Fatalf("UpdateProduct() = %v", err)
+	}
+
+	for _, want := range []*pb.Product{jar, mug} {
+		got, _ := svc.GetProduct(context.Background(), &pb.GetProductRequest{Id: want.Id})
+		if !proto.Equal(got.GetPriceUsd(), want.PriceUsd) {
+			t.Errorf("got %s price %v, want %v", want.Id, got.GetPriceUsd(), want.PriceUsd)
+		}
+	}
+	if w.check(context.Background(), false) {
+		t.Error("the watcher reloaded the catalog the admin change swapped in")
+	}
+}
+
+func TestCatalogAdminErrors(t *testing.T) {
+	svc, audit := testAdminCatalog(t)
+	valid := &pb.Product{Id: "NEW", Name: "New", Picture: "/static/img/products/mug.jpg", PriceUsd: usd(1, 0)}
+	withPrice := func(m *pb.Money) *pb.Product {
+		p := proto.Clone(valid).(*pb.Product)
+		p.PriceUsd = m
+		return p
+	}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		call func(context.Context) error
+		want codes.Code
+	}{
+		{"no token", context.Background(), createCall(svc, valid), codes.Unauthenticated},
+		{"wrong token", adminContext("fedcba9876543210"), createCall(svc, valid), codes.Unauthenticated},
+		{"no product", adminContext(testAdminToken), createCall(svc, nil), codes.InvalidArgument},
+		{"existing ID", adminContext(testAdminToken), createCall(svc, storeTestProducts[0]), codes.AlreadyExists},
+		{"invalid nanos", adminContext(testAdminToken), createCall(svc, withPrice(&pb.Money{CurrencyCode: "USD", Units: 1, Nanos: 1e9})), codes.InvalidArgument},
+		{"negative price", adminContext(testAdminToken), createCall(svc, withPrice(&pb.Money{CurrencyCode: "USD", Units: -1})), codes.InvalidArgument},
+		{"not USD", adminContext(testAdminToken), createCall(svc, withPrice(&pb.Money{CurrencyCode: "EUR", Units: 1})), codes.InvalidArgument},
+		{"update missing", adminContext(testAdminToken), func(ctx context.Context) error {
+			_, err := svc.UpdateProduct(ctx, &pb.UpdateProductRequest{Product: valid})
+			return err
+		}, codes.NotFound},
+		{"delete missing", adminContext(testAdminToken), func(ctx context.Context) error {
+			_, err := svc.DeleteProduct(ctx, &pb.DeleteProductRequest{Id: "NOPE"})
+			return err
+		}, codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(tt.ctx); status.Code(err) != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+	if audit.Len() != 0 {
+		t.Errorf("failed changes were audited: %s", audit)
+	}
+
+	svc.admin = nil
+	if err := createCall(svc, valid)(adminContext(testAdminToken)); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v with the admin API disabled, want PermissionDenied", err)
+	}
+}
+
+func createCall(svc *productCatalog, p *pb.Product) func(context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := svc.CreateProduct(ctx, &pb.CreateProductRequest{Product: p})
+		return err
+	}
+}
+
+func TestValidateProductPicture(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mug.jpg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		picture    string
+		pictureDir string
+		wantErr    bool
+	}{
+		{"/static/img/products/mug.jpg", "", false},
+		{"/static/img/products/new-mug.png", "", false},
+		{"/static/img/products/mug.jpg", dir, false},
+		{"/static/img/products/jar.jpg", dir, true},
+		{"", "", true},
+		{"https://example.com/mug.jpg", "", true},
+		{"/static/img/products/../../../etc/passwd.jpg", "", true},
+		{"/static/img/products/mug.gif", "", true},
+		{"/static/img/products/sub/mug.jpg", "", true},
+	}
+	for _, tt := range tests {
+		a := newCatalogAdmin(nil, nil, nil, tt.pictureDir, nil)
+		p := &pb.Product{Id: "MUG", Name: "Mug", Picture: tt.picture, PriceUsd: usd(1, 0)}
+		if err := a.validateProduct(p); (err != nil) != tt.wantErr {
+			t.Errorf("validateProduct() with picture %q in %q = %v, wantErr %v", tt.picture, tt.pictureDir, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseAdminTokens(t *testing.T) {
+	tokens, err := parseAdminTokens("alice:0123456789abcdef, ci:fedcba9876543210")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens["0123456789abcdef"] != "alice" || tokens["fedcba9876543210"] != "ci" {
+		t.Errorf("got %v", tokens)
+	}
+	for _, s := range []string{"alice", "alice:short", ":0123456789abcdef", "a:0123456789abcdef,b:0123456789abcdef"} {
+		if _, err := parseAdminTokens(s); err == nil {
+			t.Errorf("parseAdminTokens(%q) = nil error", s)
+		}
+	}
+}
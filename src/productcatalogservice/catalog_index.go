@@ -0,0 +1,168 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+// catalogIndex is an immutable snapshot of the catalog with lookup indexes
+// built at load time. It is never modified once built, so any number of
+// requests can read it without locking.
+type catalogIndex struct {
+	products []*pb.Product
+	byID     map[string]*pb.Product
+	// byCategory maps lower case category names to the positions of their
+	// products.
+	byCategory map[string][]int
+	// categories lists each category once, spelled as first seen, with its
+	// product count, sorted by name.
+	categories []*pb.Category
+
+	// postings maps each stemmed word in product names and descriptions to
+	// the products it appears in, in catalog order. tokens holds the same
+	// words sorted, for prefix lookups.
+	postings map[string][]posting
+	tokens   []string
+}
+
+// posting records how often a word appears in a product's name and
+// description.
+type posting struct {
+	pos         int
+	name, descr int
+}
+
+func newCatalogIndex(products []*pb.Product) *catalogIndex {
+	idx := &catalogIndex{
+		products:   products,
+		byID:       make(map[string]*pb.Product, len(products)),
+		byCategory: make(map[string][]int),
+		postings:   make(map[string][]posting),
+	}
+	for i, p := range products {
+		idx.byID[p.Id] = p
+		for _, c := range p.Categories {
+			c = strings.ToLower(c)
+			if n := len(idx.byCategory[c]); n == 0 || idx.byCategory[c][n-1] != i {
+				idx.byCategory[c] = append(idx.byCategory[c], i)
+			}
+		}
+		counts := make(map[string]*posting)
+		for _, t := range analyze(p.Name) {
+			if counts[t] == nil {
+				counts[t] = &posting{pos: i}
+			}
+			counts[t].name++
+		}
+		for _, t := range analyze(p.Description) {
+			if counts[t] == nil {
+				counts[t] = &posting{pos: i}
+			}
+			counts[t].descr++
+		}
+		for t, c := range counts {
+			idx.postings[t] = append(idx.postings[t], *c)
+		}
+	}
+	seen := make(map[string]bool, len(idx.byCategory))
+	for _, p := range products {
+		for _, c := range p.Categories {
+			key := strings.ToLower(c)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			idx.categories = append(idx.categories, &pb.Category{
+				Name:         c,
+				ProductCount: int32(len(idx.byCategory[key])),
+			})
+		}
+	}
+	sort.Slice(idx.categories, func(i, j int) bool {
+		return strings.ToLower(idx.categories[i].Name) < strings.ToLower(idx.categories[j].Name)
+	})
+
+	idx.tokens = make([]string, 0, len(idx.postings))
+	for t := range idx.postings {
+		idx.tokens = append(idx.tokens, t)
+	}
+	sort.Strings(idx.tokens)
+	return idx
+}
+
+func (idx *catalogIndex) product(id string) (*pb.Product, bool) {
+	p, ok := idx.byID[id]
+	return p, ok
+}
+
+func (idx *catalogIndex) inCategory(category string) []*pb.Product {
+	positions := idx.byCategory[strings.ToLower(category)]
+	out := make([]*pb.Product, len(positions))
+	for i, pos := range positions {
+		out[i] = idx.products[pos]
+	}
+	return out
+}
+
+// withPrefix returns the indexed words that start with prefix.
+func (idx *catalogIndex) withPrefix(prefix string) []string {
+	start := sort.SearchStrings(idx.tokens, prefix)
+	end := start
+	for end < len(idx.tokens) && strings.HasPrefix(idx.tokens[end], prefix) {
+		end++
+	}
+	return idx.tokens[start:end]
+}
+
+// analyze splits s into lower case words of letters and digits, and stems
+// them.
+func analyze(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i, w := range words {
+		words[i] = stem(w)
+	}
+	return words
+}
+
+// stem strips common English plural and verb endings so that, for
+// example, "mugs" finds "mug" and "glasses" finds "glass". It is
+// deliberately conservative: a missed stem only costs a prefix match.
+func stem(w string) string {
+	if len(w) <= 3 {
+		return w
+	}
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ies"):
+		w = w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "ss"), strings.HasSuffix(w, "us"), strings.HasSuffix(w, "is"):
+	case strings.HasSuffix(w, "s"):
+		w = w[:len(w)-1]
+	}
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		if rest := strings.TrimSuffix(w, suffix); rest != w && len(rest) >= 3 && strings.ContainsAny(rest, "aeiouy") {
+			return rest
+		}
+	}
+	return w
+}
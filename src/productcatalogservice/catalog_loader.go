@@ -15,147 +15,73 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"net"
-	"os"
 	"strings"
 
-	"cloud.google.com/go/alloydbconn"
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
-	"github.com/golang/protobuf/jsonpb"
-	"github.com/jackc/pgx/v5/pgxpool"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/money"
 )
 
-func loadCatalog(catalog *pb.ListProductsResponse) error {
+// loadCatalog reads the catalog from store, and validates and indexes it.
+func loadCatalog(ctx context.Context, store CatalogStore) (*catalogIndex, error) {
 	catalogMutex.Lock()
 	defer catalogMutex.Unlock()
 
-	if os.Getenv("ALLOYDB_CLUSTER_NAME") != "" {
-		return loadCatalogFromAlloyDB(catalog)
-	}
-
-	return loadCatalogFromLocalFile(catalog)
-}
-
-func loadCatalogFromLocalFile(catalog *pb.ListProductsResponse) error {
-	log.Info("loading catalog from local products.json file...")
-
-	catalogJSON, err := os.ReadFile("products.json")
+	products, err := store.Products(ctx)
 	if err != nil {
-		log.Warnf("failed to open product catalog json file: %v", err)
-		return err
+		return nil, err
 	}
-
-	if err := jsonpb.Unmarshal(bytes.NewReader(catalogJSON), catalog); err != nil {
-		log.Warnf("failed to parse the catalog JSON: %v", err)
-		return err
-	}
-
-	log.Info("successfully parsed product catalog json")
-	return nil
+	return indexCatalog(products)
 }
 
-func getSecretPayload(project, secret, version string) (string, error) {
-	ctx := context.Background()
-	client, err := secretmanager.NewClient(ctx)
-	if err != nil {
-		log.Warnf("failed to create SecretManager client: %v", err)
-		return "", err
+// indexCatalog validates products and builds their indexes.
+func indexCatalog(products []*pb.Product) (*catalogIndex, error) {
+	normalizeCategories(products)
+	if err := validateCatalog(products); err != nil {
+		log.Warnf("invalid product catalog: %v", err)
+		return nil, err
 	}
-	defer client.Close()
-
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/%s", project, secret, version),
-	}
-
-	// Call the API.
-	result, err := client.AccessSecretVersion(ctx, req)
-	if err != nil {
-		log.Warnf("failed to access SecretVersion: %v", err)
-		return "", err
-	}
-
-	return string(result.Payload.Data), nil
+	return newCatalogIndex(products), nil
 }
 
-func loadCatalogFromAlloyDB(catalog *pb.ListProductsResponse) error {
-	log.Info("loading catalog from AlloyDB...")
-
-	projectID := os.Getenv("PROJECT_ID")
-	region := os.Getenv("REGION")
-	pgClusterName := os.Getenv("ALLOYDB_CLUSTER_NAME")
-	pgInstanceName := os.Getenv("ALLOYDB_INSTANCE_NAME")
-	pgDatabaseName := os.Getenv("ALLOYDB_DATABASE_NAME")
-	pgTableName := os.Getenv("ALLOYDB_TABLE_NAME")
-	pgSecretName := os.Getenv("ALLOYDB_SECRET_NAME")
-
-	pgPassword, err := getSecretPayload(projectID, pgSecretName, "latest")
-	if err != nil {
-		return err
-	}
-
-	dialer, err := alloydbconn.NewDialer(context.Background())
-	if err != nil {
-		log.Warnf("failed to set-up dialer connection: %v", err)
-		return err
-	}
-	cleanup := func() error { return dialer.Close() }
-	defer cleanup()
-
-	dsn := fmt.Sprintf(
-		"user=%s password=%s dbname=%s sslmode=disable",
-		"postgres", pgPassword, pgDatabaseName,
-	)
-
-	config, err := pgxpool.ParseConfig(dsn)
-	if err != nil {
-		log.Warnf("failed to parse DSN config: %v", err)
-		return err
-	}
-
-	pgInstanceURI := fmt.Sprintf("projects/%s/locations/%s/clusters/%s/instances/%s", projectID, region, pgClusterName, pgInstanceName)
-	config.ConnConfig.DialFunc = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
-		return dialer.Dial(ctx, pgInstanceURI)
-	}
-
-	pool, err := pgxpool.NewWithConfig(context.Background(), config)
-	if err != nil {
-		log.Warnf("failed to set-up pgx pool: %v", err)
-		return err
+// normalizeCategories lower cases and trims the products' categories and
+// drops empty ones, so that every catalog format lists them the same way.
+func normalizeCategories(products []*pb.Product) {
+	for _, p := range products {
+		categories := p.Categories[:0]
+		for _, c := range p.Categories {
+			if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+				categories = append(categories, c)
+			}
+		}
+		p.Categories = categories
 	}
-	defer pool.Close()
+}
 
-	query := "SELECT id, name, description, picture, price_usd_currency_code, price_usd_units, price_usd_nanos, categories FROM " + pgTableName
-	rows, err := pool.Query(context.Background(), query)
-	if err != nil {
-		log.Warnf("failed to query database: %v", err)
-		return err
+// validateCatalog rejects catalogs that are empty, have products without an
+// ID or name or with a duplicate ID, or have prices that are not valid USD
+// amounts.
+func validateCatalog(products []*pb.Product) error {
+	if len(products) == 0 {
+		return errors.New("catalog has no products")
 	}
-	defer rows.Close()
-
-	catalog.Products = catalog.Products[:0]
-	for rows.Next() {
-		product := &pb.Product{}
-		product.PriceUsd = &pb.Money{}
-
-		var categories string
-		err = rows.Scan(&product.Id, &product.Name, &product.Description,
-			&product.Picture, &product.PriceUsd.CurrencyCode, &product.PriceUsd.Units,
-			&product.PriceUsd.Nanos, &categories)
-		if err != nil {
-			log.Warnf("failed to scan query result row: %v", err)
-			return err
+	ids := make(map[string]bool, len(products))
+	for i, p := range products {
+		switch {
+		case p.GetId() == "":
+			return fmt.Errorf("product #%d has no ID", i)
+		case ids[p.GetId()]:
+			return fmt.Errorf("duplicate product ID %s", p.GetId())
+		case p.GetName() == "":
+			return fmt.Errorf("product %s has no name", p.GetId())
+		case p.GetPriceUsd().GetCurrencyCode() != "USD" || !money.IsValid(*p.GetPriceUsd()) || money.IsNegative(*p.GetPriceUsd()):
+			return fmt.Errorf("product %s has an invalid price", p.GetId())
+		case p.GetStock() < 0:
+			return fmt.Errorf("product %s has negative stock", p.GetId())
 		}
-		categories = strings.ToLower(categories)
-		product.Categories = strings.Split(categories, ",")
-
-		catalog.Products = append(catalog.Products, product)
+		ids[p.GetId()] = true
 	}
-
-	log.Info("successfully parsed product catalog from AlloyDB")
 	return nil
 }
@@ -0,0 +1,200 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+var (
+	errProductExists   = errors.New("a product with this ID already exists")
+	errProductNotFound = errors.New("no product with this ID")
+)
+
+// CatalogStore is a source of the product catalog. Implementations read the
+// whole catalog on every call; the service indexes it and reloads it when it
+// changes.
+type CatalogStore interface {
+	// Products returns every product in the catalog, in a stable order.
+	Products(ctx context.Context) ([]*pb.Product, error)
+	// CreateProduct adds p, or returns errProductExists.
+	CreateProduct(ctx context.Context, p *pb.Product) error
+	// UpdateProduct replaces the product with p's ID, or returns
+	// errProductNotFound.
+	UpdateProduct(ctx context.Context, p *pb.Product) error
+	// DeleteProduct removes the product with the given ID, or returns
+	// errProductNotFound.
+	DeleteProduct(ctx context.Context, id string) error
+	// Close releases the store's connections, if any.
+	Close() error
+}
+
+// newCatalogStore opens the catalog store selected by CATALOG_STORE:
+//
+//   - json (the default), yaml or csv: a file at CATALOG_PATH
+//   - sqlite: an SQLite database at CATALOG_PATH
+//   - postgres: a PostgreSQL database at CATALOG_DATABASE_URL
+//   - alloydb: AlloyDB, configured by the ALLOYDB_* variables
+//
+// The database stores read the CATALOG_TABLE table, "products" by default.
+// For compatibility, setting ALLOYDB_CLUSTER_NAME selects alloydb when
+// CATALOG_STORE is not set, and ALLOYDB_TABLE_NAME overrides CATALOG_TABLE
+// for it.
+func newCatalogStore(ctx context.Context) (CatalogStore, error) {
+	kind := os.Getenv("CATALOG_STORE")
+	if kind == "" && os.Getenv("ALLOYDB_CLUSTER_NAME") != "" {
+		kind = "alloydb"
+	}
+	path := os.Getenv("CATALOG_PATH")
+	table := os.Getenv("CATALOG_TABLE")
+	if table == "" {
+		table = "products"
+	}
+	switch kind {
+	case "", "json":
+		return newFileStore(pathOr(path, "products.json"), jsonCatalog), nil
+	case "yaml":
+		return newFileStore(pathOr(path, "products.yaml"), yamlCatalog), nil
+	case "csv":
+		return newFileStore(pathOr(path, "products.csv"), csvCatalog), nil
+	case "sqlite":
+		return newSQLiteStore(pathOr(path, "products.db"), table)
+	case "postgres":
+		return newPostgresStore(ctx, os.Getenv("CATALOG_DATABASE_URL"), table)
+	case "alloydb":
+		return newAlloyDBStore(ctx, table)
+	default:
+		return nil, fmt.Errorf("unknown CATALOG_STORE %q", kind)
+	}
+}
+
+func pathOr(path, def string) string {
+	if path == "" {
+		return def
+	}
+	return path
+}
+
+// watchedFile returns the file that store reads, if changes to the catalog
+// always show in the file's modification time and size.
+func watchedFile(store CatalogStore) string {
+	if s, ok := store.(*fileStore); ok {
+		return s.path
+	}
+	return ""
+}
+
+// productColumns are the columns of a catalog table. Categories are stored
+// as a comma-separated list. A NULL stock means stock is not tracked.
+const productColumns = "id, name, description, picture, price_usd_currency_code, price_usd_units, price_usd_nanos, categories, stock"
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// catalogStatements are the SQL statements that the database stores run.
+// They work on both PostgreSQL and SQLite, and expect id to be the table's
+// primary key.
+type catalogStatements struct {
+	// selectAll reads the whole catalog ordered by ID, so that an unchanged
+	// table always reads back the same.
+	selectAll string
+	// insert, update and delete take productArgs; delete only the first.
+	insert, update, delete string
+	// probeStock fails if the table has no stock column, which addStock
+	// adds.
+	probeStock, addStock string
+}
+
+func newCatalogStatements(table string) (catalogStatements, error) {
+	if !tableNamePattern.MatchString(table) {
+		return catalogStatements{}, fmt.Errorf("invalid catalog table name %q", table)
+	}
+	return catalogStatements{
+		selectAll: "SELECT " + productColumns + " FROM " + table + " ORDER BY id",
+		insert: "INSERT INTO " + table + " (" + productColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) " +
+			"ON CONFLICT (id) DO NOTHING",
+		update: "UPDATE " + table + " SET name = $2, description = $3, picture = $4, price_usd_currency_code = $5, " +
+			"price_usd_units = $6, price_usd_nanos = $7, categories = $8, stock = $9 WHERE id = $1",
+		delete:     "DELETE FROM " + table + " WHERE id = $1",
+		probeStock: "SELECT stock FROM " + table + " LIMIT 0",
+		addStock:   "ALTER TABLE " + table + " ADD COLUMN stock INTEGER",
+	}, nil
+}
+
+// migrateCatalogTable adds the stock column to a catalog table created
+// before stock was tracked. The column is NULL, so stock stays untracked
+// for the existing products. exec runs a statement on the table's
+// database.
+func migrateCatalogTable(ctx context.Context, statements catalogStatements, exec func(context.Context, string) error) error {
+	if exec(ctx, statements.probeStock) == nil {
+		return nil
+	}
+	if err := exec(ctx, statements.addStock); err != nil {
+		return fmt.Errorf("failed to add a stock column to the catalog table: %w", err)
+	}
+	log.Info("added a stock column to the catalog table")
+	return nil
+}
+
+// productArgs returns the values of p's columns, in productColumns order.
+func productArgs(p *pb.Product) []any {
+	return []any{p.GetId(), p.GetName(), p.GetDescription(), p.GetPicture(),
+		p.GetPriceUsd().GetCurrencyCode(), p.GetPriceUsd().GetUnits(), p.GetPriceUsd().GetNanos(),
+		strings.Join(p.GetCategories(), ","), p.Stock}
+}
+
+// productRows is the part of pgx.Rows and sql.Rows that scanProducts uses.
+type productRows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+}
+
+func scanProducts(rows productRows) ([]*pb.Product, error) {
+	var products []*pb.Product
+	for rows.Next() {
+		product := &pb.Product{PriceUsd: &pb.Money{}}
+		var categories string
+		err := rows.Scan(&product.Id, &product.Name, &product.Description,
+			&product.Picture, &product.PriceUsd.CurrencyCode, &product.PriceUsd.Units,
+			&product.PriceUsd.Nanos, &categories, &product.Stock)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan catalog row: %w", err)
+		}
+		product.Categories = splitCategories(categories)
+		products = append(products, product)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read catalog rows: %w", err)
+	}
+	return products, nil
+}
+
+// splitCategories splits a comma-separated list of categories.
+func splitCategories(s string) []string {
+	var categories []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			categories = append(categories, c)
+		}
+	}
+	return categories
+}
@@ -0,0 +1,291 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/money"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// catalogFormat reads and writes a catalog file.
+type catalogFormat struct {
+	decode func([]byte) ([]*pb.Product, error)
+	encode func([]*pb.Product) ([]byte, error)
+}
+
+var (
+	jsonCatalog = catalogFormat{decodeJSONCatalog, encodeJSONCatalog}
+	yamlCatalog = catalogFormat{decodeYAMLCatalog, encodeYAMLCatalog}
+	csvCatalog  = catalogFormat{decodeCSVCatalog, encodeCSVCatalog}
+)
+
+// fileStore reads the catalog from a file in one of the formats below.
+// Changes rewrite the whole file.
+type fileStore struct {
+	path   string
+	format catalogFormat
+	// mu serializes changes, each of which reads and rewrites the file.
+	mu sync.Mutex
+}
+
+func newFileStore(path string, format catalogFormat) *fileStore {
+	return &fileStore{path: path, format: format}
+}
+
+func (s *fileStore) Products(ctx context.Context) ([]*pb.Product, error) {
+	log.Infof("loading catalog from local %s file...", s.path)
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		log.Warnf("failed to open product catalog file: %v", err)
+		return nil, err
+	}
+	products, err := s.format.decode(b)
+	if err != nil {
+		log.Warnf("failed to parse the catalog file: %v", err)
+		return nil, err
+	}
+	log.Info("successfully parsed product catalog file")
+	return products, nil
+}
+
+func (s *fileStore) CreateProduct(ctx context.Context, p *pb.Product) error {
+	return s.change(func(products []*pb.Product) ([]*pb.Product, error) {
+		if productIndex(products, p.GetId()) >= 0 {
+			return nil, errProductExists
+		}
+		return append(products, p), nil
+	})
+}
+
+func (s *fileStore) UpdateProduct(ctx context.Context, p *pb.Product) error {
+	return s.change(func(products []*pb.Product) ([]*pb.Product, error) {
+		i := productIndex(products, p.GetId())
+		if i < 0 {
+			return nil, errProductNotFound
+		}
+		products[i] = p
+		return products, nil
+	})
+}
+
+func (s *fileStore) DeleteProduct(ctx context.Context, id string) error {
+	return s.change(func(products []*pb.Product) ([]*pb.Product, error) {
+		i := productIndex(products, id)
+		if i < 0 {
+			return nil, errProductNotFound
+		}
+		return append(products[:i], products[i+1:]...), nil
+	})
+}
+
+func (s *fileStore) Close() error { return nil }
+
+// change reads the catalog, applies update to it and writes it back. The
+// new file is written next to the old one and renamed over it, so readers
+// never see a partly written catalog.
+func (s *fileStore) change(update func([]*pb.Product) ([]*pb.Product, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	products, err := s.format.decode(b)
+	if err != nil {
+		return err
+	}
+	if products, err = update(products); err != nil {
+		return err
+	}
+	if b, err = s.format.encode(products); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func productIndex(products []*pb.Product, id string) int {
+	for i, p := range products {
+		if p.GetId() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// decodeJSONCatalog reads a catalog in the JSON form of ListProductsResponse,
+// as in products.json. encodeJSONCatalog writes it with the protobuf field
+// names, which the hand-maintained files use too.
+func decodeJSONCatalog(b []byte) ([]*pb.Product, error) {
+	var catalog pb.ListProductsResponse
+	if err := protojson.Unmarshal(b, &catalog); err != nil {
+		return nil, err
+	}
+	return catalog.Products, nil
+}
+
+func encodeJSONCatalog(products []*pb.Product) ([]byte, error) {
+	b, err := protojson.MarshalOptions{Multiline: true, Indent: "    ", UseProtoNames: true}.Marshal(&pb.ListProductsResponse{Products: products})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// decodeYAMLCatalog reads a catalog with the same structure and field names
+// as the JSON one.
+func decodeYAMLCatalog(b []byte) ([]*pb.Product, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("catalog YAML has no JSON equivalent: %w", err)
+	}
+	return decodeJSONCatalog(js)
+}
+
+func encodeYAMLCatalog(products []*pb.Product) ([]byte, error) {
+	js, err := encodeJSONCatalog(products)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// decodeCSVCatalog reads a catalog with one product per row. The first row
+// names the columns: id, name and price_usd are required, and description,
+// picture, categories (comma-separated) and stock are optional; an empty
+// stock means stock is not tracked. Prices are decimal amounts such as
+// 19.99.
+func decodeCSVCatalog(b []byte) ([]*pb.Product, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		switch name {
+		case "id", "name", "description", "picture", "price_usd", "categories", "stock":
+		default:
+			return nil, fmt.Errorf("unknown catalog CSV column %q", name)
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{"id", "name", "price_usd"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("catalog CSV has no %s column", name)
+		}
+	}
+
+	var products []*pb.Product
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return products, nil
+		} else if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return record[i]
+			}
+			return ""
+		}
+		product := &pb.Product{
+			Id:          field("id"),
+			Name:        field("name"),
+			Description: field("description"),
+			Picture:     field("picture"),
+			Categories:  splitCategories(field("categories")),
+		}
+		price, err := money.Parse(field("price_usd"), "USD")
+		if err != nil {
+			return nil, fmt.Errorf("product %s has an invalid price: %w", product.Id, err)
+		}
+		product.PriceUsd = &price
+		if s := field("stock"); s != "" {
+			stock, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("product %s has an invalid stock level: %w", product.Id, err)
+			}
+			product.Stock = proto.Int32(int32(stock))
+		}
+		products = append(products, product)
+	}
+}
+
+func encodeCSVCatalog(products []*pb.Product) ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"id", "name", "description", "picture", "price_usd", "categories", "stock"})
+	for _, p := range products {
+		var stock string
+		if p.Stock != nil {
+			stock = strconv.Itoa(int(*p.Stock))
+		}
+		w.Write([]string{p.GetId(), p.GetName(), p.GetDescription(), p.GetPicture(),
+			formatUSD(p.GetPriceUsd()), strings.Join(p.GetCategories(), ","), stock})
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// formatUSD formats m as a decimal amount with as many decimal places as it
+// needs, so that it reads back unchanged.
+func formatUSD(m *pb.Money) string {
+	frac := strings.TrimRight(fmt.Sprintf("%09d", m.GetNanos()), "0")
+	if frac == "" {
+		return strconv.FormatInt(m.GetUnits(), 10)
+	}
+	return strconv.FormatInt(m.GetUnits(), 10) + "." + frac
+}
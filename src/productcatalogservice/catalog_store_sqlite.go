@@ -0,0 +1,98 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore reads the catalog from a table in an SQLite database file.
+type sqliteStore struct {
+	db         *sql.DB
+	statements catalogStatements
+}
+
+func newSQLiteStore(path, table string) (*sqliteStore, error) {
+	statements, err := newCatalogStatements(table)
+	if err != nil {
+		return nil, err
+	}
+	// Opening a missing file would create an empty database.
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open catalog database: %w", err)
+	}
+	dsn := (&url.URL{Scheme: "file", Opaque: path, RawQuery: "_pragma=busy_timeout(5000)"}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = migrateCatalogTable(context.Background(), statements, func(ctx context.Context, statement string) error {
+		_, err := db.ExecContext(ctx, statement)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, statements: statements}, nil
+}
+
+func (s *sqliteStore) Products(ctx context.Context) ([]*pb.Product, error) {
+	rows, err := s.db.QueryContext(ctx, s.statements.selectAll)
+	if err != nil {
+		log.Warnf("failed to query catalog database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanProducts(rows)
+}
+
+func (s *sqliteStore) CreateProduct(ctx context.Context, p *pb.Product) error {
+	return s.exec(ctx, s.statements.insert, errProductExists, productArgs(p)...)
+}
+
+func (s *sqliteStore) UpdateProduct(ctx context.Context, p *pb.Product) error {
+	return s.exec(ctx, s.statements.update, errProductNotFound, productArgs(p)...)
+}
+
+func (s *sqliteStore) DeleteProduct(ctx context.Context, id string) error {
+	return s.exec(ctx, s.statements.delete, errProductNotFound, id)
+}
+
+// exec runs a statement that should change one row, and returns errNoRow if
+// it changed none.
+func (s *sqliteStore) exec(ctx context.Context, statement string, errNoRow error, args ...any) error {
+	res, err := s.db.ExecContext(ctx, statement, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update catalog database: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNoRow
+	}
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,417 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/protobuf/proto"
+)
+
+// catalogTableSchema creates a catalog table in SQLite or PostgreSQL.
+const catalogTableSchema = `CREATE TABLE %s (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	description TEXT NOT NULL,
+	picture TEXT NOT NULL,
+	price_usd_currency_code TEXT NOT NULL,
+	price_usd_units BIGINT NOT NULL,
+	price_usd_nanos INTEGER NOT NULL,
+	categories TEXT NOT NULL,
+	stock INTEGER
+)`
+
+// storeBackend creates a store holding products, and returns a function
+// that replaces its contents.
+type storeBackend func(t *testing.T, products []*pb.Product) (CatalogStore, func([]*pb.Product))
+
+// storeBackends lists every CatalogStore implementation for the
+// conformance tests. PostgreSQL is tested only when
+// CATALOG_TEST_DATABASE_URL points at a database the tests may create
+// tables in.
+var storeBackends = map[string]storeBackend{
+	"json":     fileBackend("products.json", jsonCatalog),
+	"yaml":     fileBackend("products.yaml", yamlCatalog),
+	"csv":      fileBackend("products.csv", csvCatalog),
+	"sqlite":   sqliteBackend,
+	"postgres": postgresBackend,
+}
+
+// storeTestProducts are in ID order, which database stores return. Stock
+// is not tracked for TOP.
+var storeTestProducts = []*pb.Product{
+	{Id: "JAR", Name: "Bamboo Glass Jar", Description: "Holds anything, from tea to coffee beans.", Picture: "/static/img/products/bamboo-glass-jar.jpg",
+		PriceUsd: usd(5, 490000000), Categories: []string{"kitchen"}, Stock: proto.Int32(12)},
+	{Id: "MUG", Name: "Mug", Description: "A simple mug, with a mustard interior.", Picture: "/static/img/products/mug.jpg",
+		PriceUsd: usd(8, 990000000), Categories: []string{"kitchen", "home"}, Stock: proto.Int32(0)},
+	{Id: "TOP", Name: "Tank Top", Picture: "/static/img/products/tank-top.jpg",
+		PriceUsd: usd(18, 0), Categories: []string{"clothing", "tops"}},
+}
+
+func TestCatalogStoreConformance(t *testing.T) {
+	for name, backend := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store, update := backend(t, storeTestProducts)
+			t.Cleanup(func() { store.Close() })
+
+			got, err := store.Products(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertProducts(t, got, storeTestProducts)
+
+			changed := []*pb.Product{
+				proto.Clone(storeTestProducts[0]).(*pb.Product),
+				{Id: "SHAKERS", Name: "Salt & Pepper Shakers", PriceUsd: usd(18, 490000000), Categories: []string{"kitchen"}, Stock: proto.Int32(3)},
+			}
+			changed[0].PriceUsd = usd(6, 0)
+			update(changed)
+			if got, err = store.Products(ctx); err != nil {
+				t.Fatal(err)
+			}
+			assertProducts(t, got, changed)
+
+			update(nil)
+			if got, err = store.Products(ctx); err != nil {
+				t.Fatal(err)
+			}
+			assertProducts(t, got, nil)
+		})
+	}
+}
+
+func TestCatalogStoreWriteConformance(t *testing.T) {
+	for name, backend := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store, _ := backend(t, storeTestProducts)
+			t.Cleanup(func() { store.Close() })
+
+			shakers := &pb.Product{Id: "SHAKERS", Name: "Salt & Pepper Shakers", Picture: "/static/img/products/salt-and-pepper-shakers.jpg",
+				PriceUsd: usd(18, 490000001), Categories: []string{"kitchen"}, Stock: proto.Int32(3)}
+			if err := store.CreateProduct(ctx, shakers); err != nil {
+				t.Fatalf("CreateProduct() = %v", err)
+			}
+			if err := store.CreateProduct(ctx, storeTestProducts[0]); !errors.Is(err, errProductExists) {
+				t.Errorf("CreateProduct() of an existing product = %v, want %v", err, errProductExists)
+			}
+
+			mug := proto.Clone(storeTestProducts[1]).(*pb.Product)
+			mug.Name, mug.PriceUsd, mug.Categories, mug.Stock = "Large Mug", usd(10, 500000000), []string{"kitchen"}, proto.Int32(7)
+			if err := store.UpdateProduct(ctx, mug); err != nil {
+				t.Fatalf("UpdateProduct() = %v", err)
+			}
+			if err := store.UpdateProduct(ctx, &pb.Product{Id: "NOPE", Name: "Nope", PriceUsd: usd(1, 0)}); !errors.Is(err, errProductNotFound) {
+				t.Errorf("UpdateProduct() of a missing product = %v, want %v", err, errProductNotFound)
+			}
+
+			if err := store.DeleteProduct(ctx, "TOP"); err != nil {
+				t.Fatalf("DeleteProduct() = %v", err)
+			}
+			if err := store.DeleteProduct(ctx, "TOP"); !errors.Is(err, errProductNotFound) {
+				t.Errorf("DeleteProduct() of a missing product = %v, want %v", err, errProductNotFound)
+			}
+
+			got, err := store.Products(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i].Id < got[j].Id })
+			assertProducts(t, got, []*pb.Product{storeTestProducts[0], mug, shakers})
+		})
+	}
+}
+
+func assertProducts(t *testing.T, got, want []*pb.Product) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d products, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !proto.Equal(got[i], want[i]) {
+			t.Errorf("product %d:\ngot  %v\nwant %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLoadCatalogNormalizesCategories(t *testing.T) {
+	for name, backend := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			store, _ := backend(t, []*pb.Product{
+				{Id: "MUG", Name: "Mug", PriceUsd: usd(8, 990000000), Categories: []string{" Kitchen", "HOME"}},
+			})
+			t.Cleanup(func() { store.Close() })
+
+			catalog, err := loadCatalog(context.Background(), store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := catalog.byID["MUG"].Categories, []string{"kitchen", "home"}; !slices.Equal(got, want) {
+				t.Errorf("categories = %q, want %q", got, want)
+			}
+			var names []string
+			for _, c := range catalog.categories {
+				names = append(names, c.Name)
+			}
+			if want := []string{"home", "kitchen"}; !slices.Equal(names, want) {
+				t.Errorf("listed categories = %q, want %q", names, want)
+			}
+		})
+	}
+}
+
+// TestJSONCatalogGolden checks that rewriting products.json, as the admin
+// API does, keeps its products and field names.
+func TestJSONCatalogGolden(t *testing.T) {
+	golden, err := os.ReadFile("products.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := decodeJSONCatalog(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encodeJSONCatalog(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeJSONCatalog(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProducts(t, got, want)
+	if got, want := jsonKeys(t, b), jsonKeys(t, golden); !slices.Equal(got, want) {
+		t.Errorf("encoded catalog has fields %q, want those of products.json, %q", got, want)
+	}
+}
+
+// jsonKeys returns the object keys used anywhere in the JSON document b.
+func jsonKeys(t *testing.T, b []byte) []string {
+	t.Helper()
+	var doc any
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, e := range v {
+				seen[k] = true
+				walk(e)
+			}
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(doc)
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestShippedCatalogLoads(t *testing.T) {
+	if _, err := loadCatalog(context.Background(), newFileStore("products.json", jsonCatalog)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewCatalogStore(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{env: map[string]string{}, want: "*main.fileStore"},
+		{env: map[string]string{"CATALOG_STORE": "yaml"}, want: "*main.fileStore"},
+		{env: map[string]string{"CATALOG_STORE": "sqlite", "CATALOG_PATH": filepath.Join(dir, "missing.db")}, wantErr: true},
+		{env: map[string]string{"CATALOG_STORE": "sqlite", "CATALOG_TABLE": "products; DROP TABLE products"}, wantErr: true},
+		{env: map[string]string{"CATALOG_STORE": "postgres"}, wantErr: true},
+		{env: map[string]string{"CATALOG_STORE": "mongodb"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.env), func(t *testing.T) {
+			for _, k := range []string{"CATALOG_STORE", "CATALOG_PATH", "CATALOG_TABLE", "CATALOG_DATABASE_URL", "ALLOYDB_CLUSTER_NAME"} {
+				t.Setenv(k, tt.env[k])
+			}
+			store, err := newCatalogStore(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newCatalogStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				defer store.Close()
+				if got := fmt.Sprintf("%T", store); got != tt.want {
+					t.Errorf("got a %s, want a %s", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteStoreAddsStockColumn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "products.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	schema := strings.Replace(fmt.Sprintf(catalogTableSchema, "products"), ",\n\tstock INTEGER", "", 1)
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO products VALUES ('MUG', 'Mug', '', '', 'USD', 8, 990000000, 'kitchen')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newSQLiteStore(path, "products")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	got, err := store.Products(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProducts(t, got, []*pb.Product{
+		{Id: "MUG", Name: "Mug", PriceUsd: usd(8, 990000000), Categories: []string{"kitchen"}},
+	})
+}
+
+func TestDecodeCSVCatalogErrors(t *testing.T) {
+	tests := map[string]string{
+		"no header":      "",
+		"unknown column": "id,name,price_usd,colour\nMUG,Mug,8.99,blue\n",
+		"missing column": "id,name\nMUG,Mug\n",
+		"invalid price":  "id,name,price_usd\nMUG,Mug,$8.99\n",
+		"invalid stock":  "id,name,price_usd,stock\nMUG,Mug,8.99,lots\n",
+		"short row":      "id,name,price_usd\nMUG,Mug\n",
+	}
+	for name, in := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeCSVCatalog([]byte(in)); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func fileBackend(name string, format catalogFormat) storeBackend {
+	return func(t *testing.T, products []*pb.Product) (CatalogStore, func([]*pb.Product)) {
+		path := filepath.Join(t.TempDir(), name)
+		update := func(products []*pb.Product) {
+			b, err := format.encode(products)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		update(products)
+		return newFileStore(path, format), update
+	}
+}
+
+// replaceTable returns a function that replaces the contents of table using
+// exec.
+func replaceTable(t *testing.T, table string, exec func(query string, args ...any) error) func([]*pb.Product) {
+	return func(products []*pb.Product) {
+		if err := exec("DELETE FROM " + table); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range products {
+			err := exec("INSERT INTO "+table+" ("+productColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+				p.Id, p.Name, p.Description, p.Picture, p.PriceUsd.CurrencyCode, p.PriceUsd.Units, p.PriceUsd.Nanos,
+				strings.Join(p.Categories, ","), p.Stock)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func sqliteBackend(t *testing.T, products []*pb.Product) (CatalogStore, func([]*pb.Product)) {
+	path := filepath.Join(t.TempDir(), "products.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(fmt.Sprintf(catalogTableSchema, "products")); err != nil {
+		t.Fatal(err)
+	}
+	update := replaceTable(t, "products", func(query string, args ...any) error {
+		_, err := db.Exec(query, args...)
+		return err
+	})
+	update(products)
+
+	store, err := newSQLiteStore(path, "products")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, update
+}
+
+func postgresBackend(t *testing.T, products []*pb.Product) (CatalogStore, func([]*pb.Product)) {
+	dsn := os.Getenv("CATALOG_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("CATALOG_TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	exec := func(query string, args ...any) error {
+		_, err := pool.Exec(ctx, query, args...)
+		return err
+	}
+	table := fmt.Sprintf("catalog_test_%d", os.Getpid())
+	if err := exec(fmt.Sprintf(catalogTableSchema, table)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { exec("DROP TABLE " + table) })
+	update := replaceTable(t, table, exec)
+	update(products)
+
+	store, err := newPostgresStore(ctx, dsn, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, update
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultFilePollInterval     = 5 * time.Second
+	defaultDatabasePollInterval = time.Minute
+)
+
+// catalogWatcher polls the catalog source and swaps in a new snapshot when
+// it changes. Loading and validation happen on the watcher's goroutine, so
+// requests only ever see a complete catalog; an invalid catalog is logged
+// and the current one is kept.
+type catalogWatcher struct {
+	catalog  *productCatalog
+	load     func() (*catalogIndex, error)
+	interval time.Duration
+	// path is the catalog file, if any. Its modification time and size are
+	// checked before reloading so that an unchanged file is not parsed.
+	path string
+
+	trigger chan struct{}
+	// mu makes each load and swap atomic, so that an older catalog is
+	// never swapped in after a newer one.
+	mu          sync.Mutex
+	modTime     time.Time
+	size        int64
+	fingerprint [sha256.Size]byte
+	reloads     metric.Int64Counter
+}
+
+func newCatalogWatcher(catalog *productCatalog, load func() (*catalogIndex, error), path string, interval time.Duration) *catalogWatcher {
+	w := &catalogWatcher{
+		catalog:     catalog,
+		load:        load,
+		interval:    interval,
+		path:        path,
+		trigger:     make(chan struct{}, 1),
+		fingerprint: catalogFingerprint(catalog.snapshot()),
+	}
+	if fi, err := os.Stat(path); path != "" && err == nil {
+		w.modTime, w.size = fi.ModTime(), fi.Size()
+	}
+	reloads, err := otel.Meter("productcatalogservice").Int64Counter("catalog.reloads",
+		metric.WithDescription("Catalog reloads, by result: reloaded, unchanged or failed."))
+	if err != nil {
+		log.Warnf("failed to create catalog reload counter: %v", err)
+		reloads = noop.Int64Counter{}
+	}
+	w.reloads = reloads
+	return w
+}
+
+// run polls the catalog source until ctx is done. It does not poll if the
+// interval is zero, but still reloads when triggered.
+func (w *catalogWatcher) run(ctx context.Context) {
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			w.check(ctx, false)
+		case <-w.trigger:
+			w.check(ctx, true)
+		}
+	}
+}
+
+// reload asks the watcher to reload the catalog even if the file looks
+// unchanged.
+func (w *catalogWatcher) reload() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// reloadNow reloads the catalog before returning, e.g. after it was changed
+// through the admin API.
+func (w *catalogWatcher) reloadNow(ctx context.Context) error {
+	_, err := w.update(ctx, true)
+	return err
+}
+
+// check reloads the catalog if its source has changed, and reports whether
+// a new catalog was swapped in.
+func (w *catalogWatcher) check(ctx context.Context, force bool) bool {
+	changed, err := w.update(ctx, force)
+	if err != nil {
+		log.Warnf("failed to reload catalog, keeping the current one: %v", err)
+	}
+	return changed
+}
+
+func (w *catalogWatcher) update(ctx context.Context, force bool) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.path != "" {
+		fi, err := os.Stat(w.path)
+		if err != nil {
+			w.count(ctx, "failed")
+			return false, err
+		}
+		if !force && fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+			return false, nil
+		}
+		w.modTime, w.size = fi.ModTime(), fi.Size()
+	}
+
+	catalog, err := w.load()
+	if err != nil {
+		w.count(ctx, "failed")
+		return false, err
+	}
+	fingerprint := catalogFingerprint(catalog)
+	if fingerprint == w.fingerprint {
+		w.count(ctx, "unchanged")
+		return false, nil
+	}
+	w.catalog.catalog.Store(catalog)
+	w.fingerprint = fingerprint
+	log.Infof("reloaded catalog (%d products)", len(catalog.products))
+	w.count(ctx, "reloaded")
+	return true, nil
+}
+
+func (w *catalogWatcher) count(ctx context.Context, result string) {
+	w.reloads.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+// catalogFingerprint hashes the products in catalog.
+func catalogFingerprint(catalog *catalogIndex) [sha256.Size]byte {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(&pb.ListProductsResponse{Products: catalog.products})
+	if err != nil {
+		// Products always marshal; a failure only means that the next
+		// reload is not skipped.
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(b)
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+const watcherTestCatalog = `{"products": [
+	{"id": "MUG", "name": "Mug", "priceUsd": {"currencyCode": "USD", "units": 8, "nanos": 990000000}, "stock": 3}
+]}`
+
+// writeCatalog writes contents to path with a modification time that
+// differs from any earlier write.
+func writeCatalog(t *testing.T, path, contents string, n int) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2025, 1, 1, 0, 0, n, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testWatcher(t *testing.T) (*catalogWatcher, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "products.json")
+	writeCatalog(t, path, watcherTestCatalog, 0)
+	store := newFileStore(path, jsonCatalog)
+	load := func() (*catalogIndex, error) {
+		return loadCatalog(context.Background(), store)
+	}
+	catalog, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := newProductCatalog(catalog, newInventory(defaultReservationTTL))
+	return newCatalogWatcher(svc, load, path, 0), path
+}
+
+func TestCatalogWatcherReloadsChangedFile(t *testing.T) {
+	w, path := testWatcher(t)
+	ctx := context.Background()
+	if w.check(ctx, false) {
+		t.Error("reloaded an unchanged file")
+	}
+
+	writeCatalog(t, path, `{"products": [
+		{"id": "MUG", "name": "Mug", "priceUsd": {"currencyCode": "USD", "units": 9}, "stock": 3},
+		{"id": "JAR", "name": "Jar", "priceUsd": {"currencyCode": "USD", "units": 5}, "stock": 1}
+	]}`, 1)
+	if !w.check(ctx, false) {
+		t.Fatal("did not reload a changed file")
+	}
+	mug, _ := w.catalog.snapshot().product("MUG")
+	if got := mug.GetPriceUsd().GetUnits(); got != 9 {
+		t.Errorf("got price %d, want 9", got)
+	}
+	if _, ok := w.catalog.snapshot().product("JAR"); !ok {
+		t.Error("new product missing after reload")
+	}
+
+	// Touching the file without changing it does not swap the catalog.
+	before := w.catalog.snapshot()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCatalog(t, path, string(b), 2)
+	if w.check(ctx, false) || w.catalog.snapshot() != before {
+		t.Error("swapped the catalog for identical contents")
+	}
+}
+
+func TestCatalogWatcherKeepsCatalogOnInvalidFile(t *testing.T) {
+	w, path := testWatcher(t)
+	ctx := context.Background()
+	for n, contents := range []string{
+		`{"products": [`,
+		`{"products": []}`,
+		`{"products": [{"id": "MUG", "name": "Mug", "priceUsd": {"currencyCode": "USD", "units": 1, "nanos": -5}}]}`,
+		`{"products": [{"id": "MUG", "name": "Mug"}, {"id": "MUG", "name": "Mug"}]}`,
+	} {
+		writeCatalog(t, path, contents, n+1)
+		if w.check(ctx, false) {
+			t.Errorf("reloaded invalid catalog %s", contents)
+		}
+		if _, ok := w.catalog.snapshot().product("MUG"); !ok {
+			t.Fatalf("lost the current catalog after loading %s", contents)
+		}
+	}
+}
+
+func TestCatalogWatcherCountsReloads(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	defer otel.SetMeterProvider(otel.GetMeterProvider())
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	w, path := testWatcher(t)
+	ctx := context.Background()
+	w.check(ctx, true)
+	writeCatalog(t, path, `{"products": [`, 1)
+	w.check(ctx, false)
+	writeCatalog(t, path, watcherTestCatalog+" ", 2)
+	w.check(ctx, false)
+	writeCatalog(t, path, `{"products": [{"id": "JAR", "name": "Jar", "priceUsd": {"currencyCode": "USD", "units": 5}}]}`, 3)
+	w.check(ctx, false)
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "catalog.reloads" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				result, _ := dp.Attributes.Value("result")
+				got[result.AsString()] = dp.Value
+			}
+		}
+	}
+	if want := map[string]int64{"unchanged": 2, "failed": 1, "reloaded": 1}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got reloads %v, want %v", got, want)
+	}
+}
+
+func TestCatalogWatcherSwapsWhileServing(t *testing.T) {
+	w, path := testWatcher(t)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := w.catalog.GetProduct(ctx, &pb.GetProductRequest{Id: "MUG"}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for n := 1; n <= 20; n++ {
+		writeCatalog(t, path, fmt.Sprintf(`{"products": [
+			{"id": "MUG", "name": "Mug", "priceUsd": {"currencyCode": "USD", "units": %d}, "stock": 3}
+		]}`, n), n)
+		if !w.check(ctx, false) {
+			t.Fatalf("reload %d did not swap the catalog", n)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,209 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultReservationTTL = 10 * time.Minute
+
+	// committedRetention is how long committed reservations are remembered,
+	// so that they can still be released (restocked) by a rolled back order.
+	committedRetention = 24 * time.Hour
+)
+
+var (
+	errReservationNotFound = errors.New("reservation not found")
+	errUnknownProduct      = errors.New("unknown product")
+	errInvalidQuantity     = errors.New("quantity must be positive")
+)
+
+// insufficientStockError is returned when a reservation asks for more units
+// of a product than are available.
+type insufficientStockError struct {
+	productID string
+	available int32
+}
+
+func (e *insufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for product %s: %d available", e.productID, e.available)
+}
+
+type reservation struct {
+	items     map[string]int32
+	expires   time.Time
+	committed bool
+}
+
+// inventory tracks what has been sold and reserved. Stock levels themselves
+// come from the catalog, so reloading it restocks products without losing
+// track of sales.
+type inventory struct {
+	mu           sync.Mutex
+	ttl          time.Duration
+	sold         map[string]int32
+	held         map[string]int32
+	reservations map[string]*reservation
+	now          func() time.Time
+}
+
+func newInventory(ttl time.Duration) *inventory {
+	return &inventory{
+		ttl:          ttl,
+		sold:         make(map[string]int32),
+		held:         make(map[string]int32),
+		reservations: make(map[string]*reservation),
+		now:          time.Now,
+	}
+}
+
+// available returns how many units of a product with the given stock level
+// can still be reserved.
+func (inv *inventory) available(productID string, stock int32) int32 {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked()
+	return inv.availableLocked(productID, stock)
+}
+
+// availableFor is like available for each of products. It is nil for
+// products whose stock is not tracked.
+func (inv *inventory) availableFor(products []*pb.Product) []*int32 {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked()
+	out := make([]*int32, len(products))
+	for i, p := range products {
+		if p.Stock != nil {
+			out[i] = proto.Int32(inv.availableLocked(p.Id, *p.Stock))
+		}
+	}
+	return out
+}
+
+func (inv *inventory) availableLocked(productID string, stock int32) int32 {
+	n := stock - inv.sold[productID] - inv.held[productID]
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// reserve holds items for id until the reservation is committed, released or
+// expires. Either every item is reserved or none are. stockOf returns the
+// stock level of a product, nil if it is not tracked, and whether the
+// product exists.
+func (inv *inventory) reserve(id string, items []*pb.CartItem, stockOf func(string) (*int32, bool)) (time.Time, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked()
+
+	if r, ok := inv.reservations[id]; ok {
+		return r.expires, nil
+	}
+	want := make(map[string]int32)
+	for _, item := range items {
+		if item.GetQuantity() <= 0 {
+			return time.Time{}, errInvalidQuantity
+		}
+		want[item.GetProductId()] += item.GetQuantity()
+	}
+	for productID, n := range want {
+		stock, ok := stockOf(productID)
+		if !ok {
+			return time.Time{}, fmt.Errorf("%w: %s", errUnknownProduct, productID)
+		}
+		if stock == nil {
+			continue
+		}
+		if avail := inv.availableLocked(productID, *stock); n > avail {
+			return time.Time{}, &insufficientStockError{productID: productID, available: avail}
+		}
+	}
+	for productID, n := range want {
+		inv.held[productID] += n
+	}
+	r := &reservation{items: want, expires: inv.now().Add(inv.ttl)}
+	inv.reservations[id] = r
+	return r.expires, nil
+}
+
+// commit turns a reservation into a sale. Committing twice is a no-op.
+func (inv *inventory) commit(id string) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked()
+
+	r, ok := inv.reservations[id]
+	if !ok {
+		return errReservationNotFound
+	}
+	if r.committed {
+		return nil
+	}
+	for productID, n := range r.items {
+		inv.held[productID] -= n
+		inv.sold[productID] += n
+	}
+	r.committed = true
+	r.expires = inv.now().Add(committedRetention)
+	return nil
+}
+
+// release gives the items of a reservation back, including ones that were
+// already sold. Releasing an unknown reservation is a no-op so that it can be
+// retried.
+func (inv *inventory) release(id string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	r, ok := inv.reservations[id]
+	if !ok {
+		return
+	}
+	counts := inv.held
+	if r.committed {
+		counts = inv.sold
+	}
+	for productID, n := range r.items {
+		counts[productID] -= n
+	}
+	delete(inv.reservations, id)
+}
+
+// expireLocked drops reservations past their expiry: pending ones give their
+// items back and committed ones are forgotten.
+func (inv *inventory) expireLocked() {
+	now := inv.now()
+	for id, r := range inv.reservations {
+		if now.Before(r.expires) {
+			continue
+		}
+		if !r.committed {
+			for productID, n := range r.items {
+				inv.held[productID] -= n
+			}
+		}
+		delete(inv.reservations, id)
+	}
+}
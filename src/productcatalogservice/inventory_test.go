@@ -0,0 +1,167 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// testInventory returns an inventory of 5 mugs, 1 lens and untracked
+// stock of postcards.
+func testInventory() (*inventory, *time.Time, func(string) (*int32, bool)) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	inv := newInventory(time.Minute)
+	inv.now = func() time.Time { return now }
+	stock := map[string]*int32{"mug": proto.Int32(5), "lens": proto.Int32(1), "postcard": nil}
+	return inv, &now, func(id string) (*int32, bool) {
+		n, ok := stock[id]
+		return n, ok
+	}
+}
+
+func TestReserveStock(t *testing.T) {
+	inv, _, stockOf := testInventory()
+	items := []*pb.CartItem{{ProductId: "mug", Quantity: 2}, {ProductId: "mug", Quantity: 1}}
+	if _, err := inv.reserve("order-1", items, stockOf); err != nil {
+		t.Fatal(err)
+	}
+	if got := inv.available("mug", 5); got != 2 {
+		t.Errorf("got %d mugs available, want 2", got)
+	}
+	// Reserving again with the same ID holds nothing more.
+	if _, err := inv.reserve("order-1", items, stockOf); err != nil {
+		t.Fatal(err)
+	}
+	if got := inv.available("mug", 5); got != 2 {
+		t.Errorf("got %d mugs available after retry, want 2", got)
+	}
+
+	// All or nothing.
+	_, err := inv.reserve("order-2", []*pb.CartItem{{ProductId: "lens", Quantity: 1}, {ProductId: "mug", Quantity: 3}}, stockOf)
+	var short *insufficientStockError
+	if !errors.As(err, &short) || short.productID != "mug" || short.available != 2 {
+		t.Fatalf("got %v, want insufficient stock for mug", err)
+	}
+	if got := inv.available("lens", 1); got != 1 {
+		t.Errorf("got %d lenses available after a failed reservation, want 1", got)
+	}
+
+	if _, err := inv.reserve("order-3", []*pb.CartItem{{ProductId: "nope", Quantity: 1}}, stockOf); !errors.Is(err, errUnknownProduct) {
+		t.Errorf("got %v, want errUnknownProduct", err)
+	}
+	if _, err := inv.reserve("order-4", []*pb.CartItem{{ProductId: "mug", Quantity: -1}}, stockOf); !errors.Is(err, errInvalidQuantity) {
+		t.Errorf("got %v, want errInvalidQuantity", err)
+	}
+}
+
+func TestCommitAndReleaseReservation(t *testing.T) {
+	inv, now, stockOf := testInventory()
+	items := []*pb.CartItem{{ProductId: "mug", Quantity: 2}}
+	if _, err := inv.reserve("order-1", items, stockOf); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.commit("order-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.commit("order-1"); err != nil {
+		t.Errorf("second commit: %v", err)
+	}
+	// Sold items stay sold after the reservation would have expired.
+	*now = now.Add(time.Hour)
+	if got := inv.available("mug", 5); got != 3 {
+		t.Errorf("got %d mugs available after commit, want 3", got)
+	}
+	// Releasing a committed reservation restocks it.
+	inv.release("order-1")
+	inv.release("order-1")
+	if got := inv.available("mug", 5); got != 5 {
+		t.Errorf("got %d mugs available after release, want 5", got)
+	}
+	if err := inv.commit("missing"); !errors.Is(err, errReservationNotFound) {
+		t.Errorf("got %v, want errReservationNotFound", err)
+	}
+}
+
+func TestReservationExpires(t *testing.T) {
+	inv, now, stockOf := testInventory()
+	if _, err := inv.reserve("order-1", []*pb.CartItem{{ProductId: "lens", Quantity: 1}}, stockOf); err != nil {
+		t.Fatal(err)
+	}
+	if got := inv.available("lens", 1); got != 0 {
+		t.Errorf("got %d lenses available, want 0", got)
+	}
+	*now = now.Add(2 * time.Minute)
+	if got := inv.available("lens", 1); got != 1 {
+		t.Errorf("got %d lenses available after expiry, want 1", got)
+	}
+	if err := inv.commit("order-1"); !errors.Is(err, errReservationNotFound) {
+		t.Errorf("commit after expiry: got %v, want errReservationNotFound", err)
+	}
+}
+
+func TestReserveStockRPC(t *testing.T) {
+	catalog := newProductCatalog(newCatalogIndex([]*pb.Product{
+		{Id: "lens", Name: "Vintage Camera Lens", Stock: proto.Int32(1)},
+	}), newInventory(defaultReservationTTL))
+	ctx := context.Background()
+	items := []*pb.CartItem{{ProductId: "lens", Quantity: 1}}
+	if _, err := catalog.ReserveStock(ctx, &pb.ReserveStockRequest{ReservationId: "order-1", Items: items}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := catalog.ReserveStock(ctx, &pb.ReserveStockRequest{ReservationId: "order-2", Items: items})
+	if got, want := status.Code(err), codes.FailedPrecondition; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	product, err := catalog.GetProduct(ctx, &pb.GetProductRequest{Id: "lens"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.GetStock() != 0 {
+		t.Errorf("got stock %d, want 0", product.GetStock())
+	}
+	if stored, _ := catalog.snapshot().product("lens"); stored.GetStock() != 1 {
+		t.Errorf("GetProduct changed the catalog's stock level")
+	}
+}
+
+func TestReserveUntrackedStock(t *testing.T) {
+	inv, _, stockOf := testInventory()
+	items := []*pb.CartItem{{ProductId: "postcard", Quantity: 1000}}
+	if _, err := inv.reserve("order-1", items, stockOf); err != nil {
+		t.Fatalf("reserving untracked stock: %v", err)
+	}
+	if _, err := inv.reserve("order-2", items, stockOf); err != nil {
+		t.Fatalf("reserving untracked stock again: %v", err)
+	}
+
+	catalog := newProductCatalog(newCatalogIndex([]*pb.Product{
+		{Id: "postcard", Name: "Postcard"},
+	}), inv)
+	product, err := catalog.GetProduct(context.Background(), &pb.GetProductRequest{Id: "postcard"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != nil {
+		t.Errorf("got stock %d for a product whose stock is not tracked, want none", product.GetStock())
+	}
+}
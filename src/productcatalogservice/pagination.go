@@ -0,0 +1,96 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var errInvalidPageToken = errors.New("invalid page token")
+
+// paginate returns the page of results that token points to and the token
+// for the next page. Tokens are tied to the request they were issued for, by
+// a fingerprint of its parameters, and are rejected for any other request.
+func paginate(results []*pb.Product, pageSize int32, token, fingerprint string) ([]*pb.Product, string, error) {
+	switch {
+	case pageSize < 0:
+		return nil, "", errors.New("page size must not be negative")
+	case pageSize == 0:
+		pageSize = defaultPageSize
+	case pageSize > maxPageSize:
+		pageSize = maxPageSize
+	}
+	offset := 0
+	if token != "" {
+		var err error
+		if offset, err = decodePageToken(token, fingerprint); err != nil {
+			return nil, "", err
+		}
+	}
+	if offset > len(results) {
+		offset = len(results)
+	}
+	end := offset + int(pageSize)
+	if end >= len(results) {
+		return results[offset:], "", nil
+	}
+	return results[offset:end], encodePageToken(end, fingerprint), nil
+}
+
+func encodePageToken(offset int, fingerprint string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset) + ":" + fingerprint))
+}
+
+func decodePageToken(token, fingerprint string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errInvalidPageToken
+	}
+	offset, fp, ok := strings.Cut(string(b), ":")
+	if !ok || fp != fingerprint {
+		return 0, errInvalidPageToken
+	}
+	n, err := strconv.Atoi(offset)
+	if err != nil || n < 0 {
+		return 0, errInvalidPageToken
+	}
+	return n, nil
+}
+
+func priceKey(m *pb.Money) string {
+	if m == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d.%09d", m.GetUnits(), m.GetNanos())
+}
+
+// requestFingerprint identifies the parameters of a paginated request, other
+// than the page size and token.
+func requestFingerprint(parts ...interface{}) string {
+	h := sha256.Sum256([]byte(fmt.Sprint(parts...)))
+	return base64.RawURLEncoding.EncodeToString(h[:9])
+}
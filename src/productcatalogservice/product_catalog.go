@@ -16,18 +16,32 @@ package main
 
 import (
 	"context"
-	"strings"
+	"errors"
+	"sync/atomic"
 	"time"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
 	"google.golang.org/grpc/codes"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+// maxBatchSize is how many products GetProducts returns at most.
+const maxBatchSize = 1000
+
 type productCatalog struct {
 	pb.UnimplementedProductCatalogServiceServer
-	catalog pb.ListProductsResponse
+	catalog   atomic.Pointer[catalogIndex]
+	inventory *inventory
+	// admin is nil unless the admin API is enabled.
+	admin *catalogAdmin
+}
+
+func newProductCatalog(catalog *catalogIndex, inv *inventory) *productCatalog {
+	p := &productCatalog{inventory: inv}
+	p.catalog.Store(catalog)
+	return p
 }
 
 func (p *productCatalog) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
@@ -38,49 +52,248 @@ func (p *productCatalog) Watch(req *healthpb.HealthCheckRequest, ws healthpb.Hea
 	return status.Errorf(codes.Unimplemented, "health check via Watch not implemented")
 }
 
-func (p *productCatalog) ListProducts(context.Context, *pb.Empty) (*pb.ListProductsResponse, error) {
+func (p *productCatalog) ListProducts(ctx context.Context, req *pb.ListProductsRequest) (*pb.ListProductsResponse, error) {
 	time.Sleep(extraLatency)
 
-	return &pb.ListProductsResponse{Products: p.parseCatalog()}, nil
+	if _, ok := pb.ProductSort_name[int32(req.GetSort())]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown sort order %d", req.GetSort())
+	}
+	q := productQuery{sort: req.GetSort()}
+	if req.GetCategory() != "" {
+		q.categories = []string{req.GetCategory()}
+	}
+	results := p.snapshot().find(q)
+	// Requests without paging, including ones from clients that still send
+	// Empty, get the whole catalog.
+	if req.GetPageSize() == 0 && req.GetPageToken() == "" {
+		return &pb.ListProductsResponse{Products: p.withStock(results...), TotalSize: int32(len(results))}, nil
+	}
+	fingerprint := requestFingerprint(req.GetCategory(), req.GetSort())
+	page, next, err := paginate(results, req.GetPageSize(), req.GetPageToken(), fingerprint)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return &pb.ListProductsResponse{
+		Products:      p.withStock(page...),
+		NextPageToken: next,
+		TotalSize:     int32(len(results))}, nil
 }
 
 func (p *productCatalog) GetProduct(ctx context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
 	time.Sleep(extraLatency)
 
-	var found *pb.Product
-	for i := 0; i < len(p.parseCatalog()); i++ {
-		if req.Id == p.parseCatalog()[i].Id {
-			found = p.parseCatalog()[i]
-		}
+	found, ok := p.snapshot().product(req.Id)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no product with ID %s", req.Id)
 	}
+	return p.withStock(found)[0], nil
+}
 
-	if found == nil {
-		return nil, status.Errorf(codes.NotFound, "no product with ID %s", req.Id)
+func (p *productCatalog) GetProducts(ctx context.Context, req *pb.GetProductsRequest) (*pb.GetProductsResponse, error) {
+	time.Sleep(extraLatency)
+
+	if len(req.GetIds()) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d products can be requested at once", maxBatchSize)
 	}
-	return found, nil
+	catalog := p.snapshot()
+	resp := &pb.GetProductsResponse{}
+	var found []*pb.Product
+	seen := make(map[string]bool, len(req.GetIds()))
+	for _, id := range req.GetIds() {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if product, ok := catalog.product(id); ok {
+			found = append(found, product)
+		} else {
+			resp.MissingIds = append(resp.MissingIds, id)
+		}
+	}
+	resp.Products = p.withStock(found...)
+	return resp, nil
+}
+
+func (p *productCatalog) ListCategories(ctx context.Context, req *pb.Empty) (*pb.ListCategoriesResponse, error) {
+	time.Sleep(extraLatency)
+
+	return &pb.ListCategoriesResponse{Categories: p.snapshot().categories}, nil
 }
 
 func (p *productCatalog) SearchProducts(ctx context.Context, req *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
 	time.Sleep(extraLatency)
 
-	var ps []*pb.Product
-	for _, product := range p.parseCatalog() {
-		if strings.Contains(strings.ToLower(product.Name), strings.ToLower(req.Query)) ||
-			strings.Contains(strings.ToLower(product.Description), strings.ToLower(req.Query)) {
-			ps = append(ps, product)
-		}
+	q, err := searchQuery(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	results := p.snapshot().find(q)
+	fingerprint := requestFingerprint(req.GetQuery(), req.GetCategories(), priceKey(req.GetMinPriceUsd()), priceKey(req.GetMaxPriceUsd()), req.GetSort())
+	page, next, err := paginate(results, req.GetPageSize(), req.GetPageToken(), fingerprint)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return &pb.SearchProductsResponse{
+		Results:       p.withStock(page...),
+		NextPageToken: next,
+		TotalSize:     int32(len(results))}, nil
+}
+
+func (p *productCatalog) ReserveStock(ctx context.Context, req *pb.ReserveStockRequest) (*pb.ReserveStockResponse, error) {
+	time.Sleep(extraLatency)
+
+	if req.GetReservationId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "reservation ID is required")
 	}
+	expires, err := p.inventory.reserve(req.GetReservationId(), req.GetItems(), p.stockOf)
+	var short *insufficientStockError
+	switch {
+	case errors.As(err, &short):
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	case errors.Is(err, errUnknownProduct):
+		return nil, status.Errorf(codes.NotFound, "%v", err)
+	case err != nil:
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	log.Infof("reserved stock (reservation_id: %s)", req.GetReservationId())
+	return &pb.ReserveStockResponse{ReservationId: req.GetReservationId(), ExpiresAtUnix: expires.Unix()}, nil
+}
 
-	return &pb.SearchProductsResponse{Results: ps}, nil
+func (p *productCatalog) CommitReservation(ctx context.Context, req *pb.CommitReservationRequest) (*pb.Empty, error) {
+	time.Sleep(extraLatency)
+
+	if err := p.inventory.commit(req.GetReservationId()); err != nil {
+		return nil, status.Errorf(codes.NotFound, "no reservation with ID %s", req.GetReservationId())
+	}
+	log.Infof("committed stock reservation (reservation_id: %s)", req.GetReservationId())
+	return &pb.Empty{}, nil
 }
 
-func (p *productCatalog) parseCatalog() []*pb.Product {
-	if reloadCatalog || len(p.catalog.Products) == 0 {
-		err := loadCatalog(&p.catalog)
-		if err != nil {
-			return []*pb.Product{}
-		}
+func (p *productCatalog) ReleaseReservation(ctx context.Context, req *pb.ReleaseReservationRequest) (*pb.Empty, error) {
+	time.Sleep(extraLatency)
+
+	p.inventory.release(req.GetReservationId())
+	log.Infof("released stock reservation (reservation_id: %s)", req.GetReservationId())
+	return &pb.Empty{}, nil
+}
+
+func (p *productCatalog) CreateProduct(ctx context.Context, req *pb.CreateProductRequest) (*pb.Product, error) {
+	time.Sleep(extraLatency)
+
+	admin, product, err := p.authorizeChange(ctx, req.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	err = p.admin.apply(ctx, p, admin, "create", product.Id, product, func() error {
+		return p.admin.store.CreateProduct(ctx, product)
+	})
+	if err != nil {
+		return nil, adminError(err)
+	}
+	log.Infof("created product %s (admin: %s)", product.Id, admin)
+	return p.withStock(product)[0], nil
+}
+
+func (p *productCatalog) UpdateProduct(ctx context.Context, req *pb.UpdateProductRequest) (*pb.Product, error) {
+	time.Sleep(extraLatency)
+
+	admin, product, err := p.authorizeChange(ctx, req.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	err = p.admin.apply(ctx, p, admin, "update", product.Id, product, func() error {
+		return p.admin.store.UpdateProduct(ctx, product)
+	})
+	if err != nil {
+		return nil, adminError(err)
+	}
+	log.Infof("updated product %s (admin: %s)", product.Id, admin)
+	return p.withStock(product)[0], nil
+}
+
+func (p *productCatalog) DeleteProduct(ctx context.Context, req *pb.DeleteProductRequest) (*pb.Empty, error) {
+	time.Sleep(extraLatency)
+
+	admin, err := p.authorizeAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.snapshot().product(req.GetId()); ok && len(p.snapshot().products) == 1 {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot delete the last product in the catalog")
+	}
+	err = p.admin.apply(ctx, p, admin, "delete", req.GetId(), nil, func() error {
+		return p.admin.store.DeleteProduct(ctx, req.GetId())
+	})
+	if err != nil {
+		return nil, adminError(err)
+	}
+	log.Infof("deleted product %s (admin: %s)", req.GetId(), admin)
+	return &pb.Empty{}, nil
+}
+
+// authorizeAdmin returns the name of the admin making the request.
+func (p *productCatalog) authorizeAdmin(ctx context.Context) (string, error) {
+	if p.admin == nil {
+		return "", status.Errorf(codes.PermissionDenied, "the catalog admin API is disabled")
+	}
+	admin, err := p.admin.authenticate(ctx)
+	if err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	return admin, nil
+}
+
+// authorizeChange returns the name of the admin making the request and a
+// validated copy of the product they sent.
+func (p *productCatalog) authorizeChange(ctx context.Context, product *pb.Product) (string, *pb.Product, error) {
+	admin, err := p.authorizeAdmin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if product == nil {
+		return "", nil, status.Errorf(codes.InvalidArgument, "product is required")
+	}
+	product = proto.Clone(product).(*pb.Product)
+	if err := p.admin.validateProduct(product); err != nil {
+		return "", nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return admin, product, nil
+}
+
+func adminError(err error) error {
+	switch {
+	case errors.Is(err, errProductExists):
+		return status.Errorf(codes.AlreadyExists, "%v", err)
+	case errors.Is(err, errProductNotFound):
+		return status.Errorf(codes.NotFound, "%v", err)
+	default:
+		log.Errorf("failed to change catalog: %v", err)
+		return status.Errorf(codes.Internal, "failed to change catalog")
+	}
+}
+
+// withStock returns copies of products with Stock set to the units that can
+// still be ordered, or left unset if their stock is not tracked.
+func (p *productCatalog) withStock(products ...*pb.Product) []*pb.Product {
+	stock := p.inventory.availableFor(products)
+	out := make([]*pb.Product, len(products))
+	for i, product := range products {
+		out[i] = proto.Clone(product).(*pb.Product)
+		out[i].Stock = stock[i]
 	}
+	return out
+}
+
+func (p *productCatalog) stockOf(id string) (*int32, bool) {
+	product, ok := p.snapshot().product(id)
+	if !ok {
+		return nil, false
+	}
+	return product.Stock, true
+}
 
-	return p.catalog.Products
+// snapshot returns the current catalog. It stays valid for as long as the
+// caller needs it, even if a new catalog is swapped in.
+func (p *productCatalog) snapshot() *catalogIndex {
+	return p.catalog.Load()
 }
@@ -16,12 +16,15 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -29,28 +32,25 @@ var (
 )
 
 func TestMain(m *testing.M) {
-	mockProductCatalog = &productCatalog{
-		catalog: pb.ListProductsResponse{
-			Products: []*pb.Product{},
-		},
-	}
+	products := []*pb.Product{}
 
-	mockProductCatalog.catalog.Products = append(mockProductCatalog.catalog.Products, &pb.Product{
+	products = append(products, &pb.Product{
 		Id:   "abc001",
 		Name: "Product Alpha One",
 	})
-	mockProductCatalog.catalog.Products = append(mockProductCatalog.catalog.Products, &pb.Product{
+	products = append(products, &pb.Product{
 		Id:   "abc002",
 		Name: "Product Delta",
 	})
-	mockProductCatalog.catalog.Products = append(mockProductCatalog.catalog.Products, &pb.Product{
+	products = append(products, &pb.Product{
 		Id:   "abc003",
 		Name: "Product Alpha Two",
 	})
-	mockProductCatalog.catalog.Products = append(mockProductCatalog.catalog.Products, &pb.Product{
+	products = append(products, &pb.Product{
 		Id:   "abc004",
 		Name: "Product Gamma",
 	})
+	mockProductCatalog = newProductCatalog(newCatalogIndex(products), newInventory(defaultReservationTTL))
 
 	os.Exit(m.Run())
 }
@@ -76,9 +76,35 @@ func TestGetProductNotFound(t *testing.T) {
 	}
 }
 
+func TestGetProducts(t *testing.T) {
+	resp, err := mockProductCatalog.GetProducts(context.Background(),
+		&pb.GetProductsRequest{Ids: []string{"abc003", "abc005", "abc001", "abc003"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range resp.Products {
+		got = append(got, p.Id)
+	}
+	if got, want := strings.Join(got, ","), "abc003,abc001"; got != want {
+		t.Errorf("got products %s, want %s", got, want)
+	}
+	if got, want := strings.Join(resp.MissingIds, ","), "abc005"; got != want {
+		t.Errorf("got missing IDs %s, want %s", got, want)
+	}
+
+	_, err = mockProductCatalog.GetProducts(context.Background(),
+		&pb.GetProductsRequest{Ids: make([]string, maxBatchSize+1)},
+	)
+	if got, want := status.Code(err), codes.InvalidArgument; got != want {
+		t.Errorf("got %s for too many IDs, want %s", got, want)
+	}
+}
+
 func TestListProducts(t *testing.T) {
 	products, err := mockProductCatalog.ListProducts(context.Background(),
-		&pb.Empty{},
+		&pb.ListProductsRequest{},
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -99,3 +125,157 @@ func TestSearchProducts(t *testing.T) {
 		t.Errorf("got %d, want %d", got, want)
 	}
 }
+
+func TestListProductsPages(t *testing.T) {
+	catalog := searchCatalog()
+	ctx := context.Background()
+	req := &pb.ListProductsRequest{PageSize: 2, Sort: pb.ProductSort_SORT_PRICE_DESCENDING}
+	var got []string
+	for pages := 1; ; pages++ {
+		resp, err := catalog.ListProducts(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TotalSize != 5 {
+			t.Errorf("got total size %d, want 5", resp.TotalSize)
+		}
+		for _, p := range resp.Products {
+			got = append(got, p.Id)
+		}
+		if resp.NextPageToken == "" {
+			if pages != 3 {
+				t.Errorf("got %d pages, want 3", pages)
+			}
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if strings.Join(got, ",") != "1,2,5,3,4" {
+		t.Errorf("got %v, want 1,2,5,3,4", got)
+	}
+
+	// The token of a page sorted by price does not page through a category.
+	_, err := catalog.ListProducts(ctx, &pb.ListProductsRequest{PageSize: 2, PageToken: req.PageToken, Category: "kitchen"})
+	if got, want := status.Code(err), codes.InvalidArgument; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestListProductsCategory(t *testing.T) {
+	resp, err := searchCatalog().ListProducts(context.Background(), &pb.ListProductsRequest{Category: "KITCHEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(resp.Products), 3; got != want {
+		t.Errorf("got %d kitchen products, want %d", got, want)
+	}
+	if resp.NextPageToken != "" {
+		t.Errorf("got a next page token without paging")
+	}
+}
+
+func TestCatalogIndexCategories(t *testing.T) {
+	catalog := newCatalogIndex([]*pb.Product{
+		{Id: "1", Categories: []string{"kitchen"}},
+		{Id: "2", Categories: []string{"clothing", "tops"}},
+		{Id: "3", Categories: []string{"Kitchen", "decor"}},
+	})
+	if got := len(catalog.inCategory("KITCHEN")); got != 2 {
+		t.Errorf("got %d kitchen products, want 2", got)
+	}
+	if got := len(catalog.inCategory("garden")); got != 0 {
+		t.Errorf("got %d garden products, want 0", got)
+	}
+	var got []string
+	for _, c := range catalog.categories {
+		got = append(got, fmt.Sprintf("%s=%d", c.Name, c.ProductCount))
+	}
+	if got, want := strings.Join(got, ","), "clothing=1,decor=1,kitchen=2,tops=1"; got != want {
+		t.Errorf("got categories %q, want %q", got, want)
+	}
+}
+
+func TestListCategories(t *testing.T) {
+	resp, err := searchCatalog().ListCategories(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int32)
+	for _, c := range resp.Categories {
+		counts[c.Name] = c.ProductCount
+	}
+	if got, want := counts["kitchen"], int32(3); got != want {
+		t.Errorf("got %d kitchen products, want %d", got, want)
+	}
+}
+
+// benchmarkCatalog is a catalog of n generated products.
+func benchmarkCatalog(n int) *productCatalog {
+	words := []string{"vintage", "modern", "cotton", "steel", "glass", "bamboo", "leather", "ceramic"}
+	products := make([]*pb.Product, n)
+	for i := range products {
+		products[i] = &pb.Product{
+			Id:          fmt.Sprintf("P%06d", i),
+			Name:        fmt.Sprintf("%s item %d", words[i%len(words)], i),
+			Description: fmt.Sprintf("A %s and %s product.", words[(i/3)%len(words)], words[(i/7)%len(words)]),
+			Categories:  []string{words[(i/5)%len(words)]},
+			Stock:       proto.Int32(100),
+		}
+	}
+	return newProductCatalog(newCatalogIndex(products), newInventory(defaultReservationTTL))
+}
+
+func BenchmarkGetProduct(b *testing.B) {
+	catalog := benchmarkCatalog(10000)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &pb.GetProductRequest{Id: fmt.Sprintf("P%06d", i%10000)}
+		if _, err := catalog.GetProduct(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListProductsPage(b *testing.B) {
+	catalog := benchmarkCatalog(10000)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := catalog.ListProducts(ctx, &pb.ListProductsRequest{PageSize: 20, Category: "cotton"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSearchProducts(b *testing.B) {
+	catalog := benchmarkCatalog(10000)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := catalog.SearchProducts(ctx, &pb.SearchProductsRequest{Query: "vintage glass"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSearchProductsParallel(b *testing.B) {
+	catalog := benchmarkCatalog(10000)
+	ctx := context.Background()
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			if _, err := catalog.SearchProducts(ctx, &pb.SearchProductsRequest{Query: "ceramic"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkNewCatalogIndex(b *testing.B) {
+	products := benchmarkCatalog(10000).snapshot().products
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newCatalogIndex(products)
+	}
+}
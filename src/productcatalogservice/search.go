@@ -0,0 +1,203 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/money"
+)
+
+const (
+	// nameBoost weighs matches in a product's name over matches in its
+	// description.
+	nameBoost = 3.0
+	// prefixWeight is the weight of a word that only starts with a query
+	// word, so that partially typed words still find products.
+	prefixWeight = 0.5
+)
+
+// productQuery selects, ranks and orders products.
+type productQuery struct {
+	// terms are the analyzed query words; every one must match.
+	terms      []string
+	categories []string
+	minPrice   *pb.Money
+	maxPrice   *pb.Money
+	sort       pb.ProductSort
+}
+
+func searchQuery(req *pb.SearchProductsRequest) (productQuery, error) {
+	q := productQuery{
+		categories: req.GetCategories(),
+		minPrice:   req.GetMinPriceUsd(),
+		maxPrice:   req.GetMaxPriceUsd(),
+		sort:       req.GetSort(),
+	}
+	seen := make(map[string]bool)
+	for _, t := range analyze(req.GetQuery()) {
+		if !seen[t] {
+			seen[t] = true
+			q.terms = append(q.terms, t)
+		}
+	}
+	for _, m := range []*pb.Money{q.minPrice, q.maxPrice} {
+		if m != nil && !money.IsValid(*m) {
+			return q, errors.New("invalid price bound")
+		}
+	}
+	if q.minPrice != nil && q.maxPrice != nil && comparePrices(q.minPrice, q.maxPrice) > 0 {
+		return q, errors.New("min_price_usd is above max_price_usd")
+	}
+	if _, ok := pb.ProductSort_name[int32(q.sort)]; !ok {
+		return q, fmt.Errorf("unknown sort order %d", q.sort)
+	}
+	return q, nil
+}
+
+type scoredProduct struct {
+	product *pb.Product
+	pos     int
+	score   float64
+}
+
+// find returns the products matching q in the order q asks for.
+func (idx *catalogIndex) find(q productQuery) []*pb.Product {
+	var matches []scoredProduct
+	switch {
+	case len(q.terms) > 0:
+		matches = idx.rank(q.terms)
+	case len(q.categories) == 1:
+		for _, pos := range idx.byCategory[strings.ToLower(q.categories[0])] {
+			matches = append(matches, scoredProduct{product: idx.products[pos], pos: pos})
+		}
+	default:
+		matches = make([]scoredProduct, len(idx.products))
+		for i, p := range idx.products {
+			matches[i] = scoredProduct{product: p, pos: i}
+		}
+	}
+
+	filtered := matches[:0]
+	for _, m := range matches {
+		if q.matches(m.product) {
+			filtered = append(filtered, m)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		a, b := filtered[i], filtered[j]
+		switch q.sort {
+		case pb.ProductSort_SORT_PRICE_ASCENDING:
+			if c := comparePrices(a.product.PriceUsd, b.product.PriceUsd); c != 0 {
+				return c < 0
+			}
+		case pb.ProductSort_SORT_PRICE_DESCENDING:
+			if c := comparePrices(a.product.PriceUsd, b.product.PriceUsd); c != 0 {
+				return c > 0
+			}
+		case pb.ProductSort_SORT_NAME:
+			if an, bn := strings.ToLower(a.product.Name), strings.ToLower(b.product.Name); an != bn {
+				return an < bn
+			}
+		default:
+			if a.score != b.score {
+				return a.score > b.score
+			}
+		}
+		return a.pos < b.pos
+	})
+
+	out := make([]*pb.Product, len(filtered))
+	for i, m := range filtered {
+		out[i] = m.product
+	}
+	return out
+}
+
+// rank scores the products that match every term. A term scores by how rare
+// it is in the catalog and how often it appears in the product, with name
+// matches boosted over description matches.
+func (idx *catalogIndex) rank(terms []string) []scoredProduct {
+	scores := make(map[int]float64)
+	hits := make(map[int]int)
+	for _, term := range terms {
+		termScores := make(map[int]float64)
+		for _, word := range idx.withPrefix(term) {
+			postings := idx.postings[word]
+			weight := math.Log(1 + float64(len(idx.products))/float64(len(postings)))
+			if word != term {
+				weight *= prefixWeight
+			}
+			for _, p := range postings {
+				s := weight * (nameBoost*float64(p.name) + float64(p.descr))
+				termScores[p.pos] = math.Max(termScores[p.pos], s)
+			}
+		}
+		for pos, s := range termScores {
+			scores[pos] += s
+			hits[pos]++
+		}
+	}
+	var out []scoredProduct
+	for pos, n := range hits {
+		if n == len(terms) {
+			out = append(out, scoredProduct{product: idx.products[pos], pos: pos, score: scores[pos]})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].pos < out[j].pos })
+	return out
+}
+
+func (q productQuery) matches(p *pb.Product) bool {
+	if q.minPrice != nil && comparePrices(p.PriceUsd, q.minPrice) < 0 {
+		return false
+	}
+	if q.maxPrice != nil && comparePrices(p.PriceUsd, q.maxPrice) > 0 {
+		return false
+	}
+	if len(q.categories) == 0 {
+		return true
+	}
+	for _, want := range q.categories {
+		for _, c := range p.Categories {
+			if strings.EqualFold(c, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// comparePrices compares two valid amounts in the same currency.
+func comparePrices(a, b *pb.Money) int {
+	switch {
+	case a.GetUnits() != b.GetUnits():
+		if a.GetUnits() < b.GetUnits() {
+			return -1
+		}
+		return 1
+	case a.GetNanos() != b.GetNanos():
+		if a.GetNanos() < b.GetNanos() {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func usd(units int64, nanos int32) *pb.Money {
+	return &pb.Money{CurrencyCode: "USD", Units: units, Nanos: nanos}
+}
+
+func searchCatalog() *productCatalog {
+	return newProductCatalog(newCatalogIndex([]*pb.Product{
+		{Id: "1", Name: "Sunglasses", Description: "Sleek aviator sunglasses.", PriceUsd: usd(19, 990000000), Categories: []string{"accessories"}},
+		{Id: "2", Name: "Tank Top", Description: "Cropped cotton tank, with a scooped neckline.", PriceUsd: usd(18, 990000000), Categories: []string{"clothing", "tops"}},
+		{Id: "3", Name: "Mug", Description: "A simple mug with a mustard interior.", PriceUsd: usd(8, 990000000), Categories: []string{"kitchen"}},
+		{Id: "4", Name: "Bamboo Glass Jar", Description: "Holds anything from a mug of tea to coffee beans.", PriceUsd: usd(5, 490000000), Categories: []string{"kitchen"}},
+		{Id: "5", Name: "Salt & Pepper Shakers", Description: "Add some flavor to your kitchen.", PriceUsd: usd(18, 490000000), Categories: []string{"kitchen"}},
+	}), newInventory(defaultReservationTTL))
+}
+
+func searchIDs(t *testing.T, catalog *productCatalog, req *pb.SearchProductsRequest) string {
+	t.Helper()
+	resp, err := catalog.SearchProducts(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range resp.Results {
+		ids = append(ids, p.Id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestSearchRanking(t *testing.T) {
+	catalog := searchCatalog()
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// Name matches rank above description matches.
+		{"mug", "3,4"},
+		// Plurals and partial words match.
+		{"mugs", "3,4"},
+		{"glasses", "4"},
+		{"sun", "1"},
+		{"shaker", "5"},
+		{"TANK", "2"},
+		// Every word has to match.
+		{"cotton tank", "2"},
+		{"mug tea", "4"},
+		{"mug nothing", ""},
+		{"", "1,2,3,4,5"},
+	}
+	for _, tt := range tests {
+		if got := searchIDs(t, catalog, &pb.SearchProductsRequest{Query: tt.query}); got != tt.want {
+			t.Errorf("search %q = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchFiltersAndSorting(t *testing.T) {
+	catalog := searchCatalog()
+	tests := []struct {
+		name string
+		req  *pb.SearchProductsRequest
+		want string
+	}{
+		{"category", &pb.SearchProductsRequest{Categories: []string{"Kitchen"}}, "3,4,5"},
+		{"any of categories", &pb.SearchProductsRequest{Categories: []string{"tops", "accessories"}}, "1,2"},
+		{"category and query", &pb.SearchProductsRequest{Query: "mug", Categories: []string{"kitchen"}}, "3,4"},
+		{"price range", &pb.SearchProductsRequest{MinPriceUsd: usd(8, 990000000), MaxPriceUsd: usd(18, 990000000)}, "2,3,5"},
+		{"max price only", &pb.SearchProductsRequest{MaxPriceUsd: usd(9, 0)}, "3,4"},
+		{"price ascending", &pb.SearchProductsRequest{Sort: pb.ProductSort_SORT_PRICE_ASCENDING}, "4,3,5,2,1"},
+		{"price descending", &pb.SearchProductsRequest{Sort: pb.ProductSort_SORT_PRICE_DESCENDING}, "1,2,5,3,4"},
+		{"name", &pb.SearchProductsRequest{Query: "mug", Sort: pb.ProductSort_SORT_NAME}, "4,3"},
+		{"name all", &pb.SearchProductsRequest{Sort: pb.ProductSort_SORT_NAME}, "4,3,5,1,2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := searchIDs(t, catalog, tt.req); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	catalog := searchCatalog()
+	ctx := context.Background()
+	req := &pb.SearchProductsRequest{Sort: pb.ProductSort_SORT_PRICE_ASCENDING, PageSize: 2}
+	var got []string
+	for page := 0; ; page++ {
+		resp, err := catalog.SearchProducts(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TotalSize != 5 {
+			t.Errorf("got total size %d, want 5", resp.TotalSize)
+		}
+		for _, p := range resp.Results {
+			got = append(got, p.Id)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		if page > 3 {
+			t.Fatal("too many pages")
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if strings.Join(got, ",") != "4,3,5,2,1" {
+		t.Errorf("got %v across pages, want 4,3,5,2,1", got)
+	}
+
+	// A token only works for the request it was issued for.
+	resp, err := catalog.SearchProducts(ctx, &pb.SearchProductsRequest{PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = catalog.SearchProducts(ctx, &pb.SearchProductsRequest{Query: "mug", PageSize: 2, PageToken: resp.NextPageToken})
+	if got, want := status.Code(err), codes.InvalidArgument; got != want {
+		t.Errorf("reused token: got %s, want %s", got, want)
+	}
+}
+
+func TestSearchRejectsBadRequests(t *testing.T) {
+	catalog := searchCatalog()
+	for _, req := range []*pb.SearchProductsRequest{
+		{MinPriceUsd: usd(10, 0), MaxPriceUsd: usd(5, 0)},
+		{MinPriceUsd: usd(1, -5)},
+		{PageSize: -1},
+		{PageToken: "not a token"},
+		{Sort: pb.ProductSort(42)},
+	} {
+		_, err := catalog.SearchProducts(context.Background(), req)
+		if got, want := status.Code(err), codes.InvalidArgument; got != want {
+			t.Errorf("SearchProducts(%v) = %s, want %s", req, got, want)
+		}
+	}
+}
+
+func TestStem(t *testing.T) {
+	for word, want := range map[string]string{
+		"mugs":        "mug",
+		"glasses":     "glass",
+		"accessories": "accessory",
+		"dress":       "dress",
+		"cactus":      "cactus",
+		"scooped":     "scoop",
+		"holding":     "hold",
+		"ring":        "ring",
+		"red":         "red",
+	} {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
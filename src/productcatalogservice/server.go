@@ -25,8 +25,8 @@ import (
 	"syscall"
 	"time"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/productcatalogservice/genproto"
-	"google.golang.org/grpc/credentials/insecure"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/grpcclient"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"cloud.google.com/go/profiler"
@@ -35,8 +35,10 @@ import (
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"google.golang.org/grpc"
 )
@@ -46,9 +48,9 @@ var (
 	log          *logrus.Logger
 	extraLatency time.Duration
 
-	port = "3550"
+	reservationTTL = defaultReservationTTL
 
-	reloadCatalog bool
+	port = "3550"
 )
 
 func init() {
@@ -80,6 +82,15 @@ func main() {
 		log.Info("Tracing disabled.")
 	}
 
+	if os.Getenv("ENABLE_STATS") == "1" {
+		log.Info("Stats enabled.")
+		if err := initStats(); err != nil {
+			log.Warnf("warn: failed to start metric exporter: %+v", err)
+		}
+	} else {
+		log.Info("Stats disabled.")
+	}
+
 	if os.Getenv("DISABLE_PROFILER") == "" {
 		log.Info("Profiling enabled.")
 		go initProfiling("productcatalogservice", "1.0.0")
@@ -101,21 +112,13 @@ func main() {
 		extraLatency = time.Duration(0)
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
-	go func() {
-		for {
-			sig := <-sigs
-			log.Printf("Received signal: %s", sig)
-			if sig == syscall.SIGUSR1 {
-				reloadCatalog = true
-				log.Infof("Enable catalog reloading")
-			} else {
-				reloadCatalog = false
-				log.Infof("Disable catalog reloading")
-			}
+	if s := os.Getenv("RESERVATION_TTL"); s != "" {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("failed to parse RESERVATION_TTL (%s) as time.Duration: %+v", s, err)
 		}
-	}()
+		reservationTTL = v
+	}
 
 	if os.Getenv("PORT") != "" {
 		port = os.Getenv("PORT")
@@ -140,11 +143,17 @@ func run(port string) string {
 		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
 		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()))
 
-	svc := &productCatalog{}
-	err = loadCatalog(&svc.catalog)
+	store, err := newCatalogStore(context.Background())
+	if err != nil {
+		log.Fatalf("could not open product catalog: %v", err)
+	}
+	catalog, err := loadCatalog(context.Background(), store)
 	if err != nil {
 		log.Fatalf("could not parse product catalog: %v", err)
 	}
+	svc := newProductCatalog(catalog, newInventory(reservationTTL))
+	w := startCatalogWatcher(svc, store)
+	enableCatalogAdmin(svc, store, w)
 
 	pb.RegisterProductCatalogServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
@@ -153,8 +162,87 @@ func run(port string) string {
 	return listener.Addr().String()
 }
 
-func initStats() {
-	// TODO(drewbr) Implement OpenTelemetry stats
+// enableCatalogAdmin turns on the admin API for the holders of the tokens in
+// CATALOG_ADMIN_TOKENS. Changes are recorded in the CATALOG_AUDIT_LOG file,
+// or in the service log if it is not set. Changes are swapped in through w.
+func enableCatalogAdmin(svc *productCatalog, store CatalogStore, w *catalogWatcher) {
+	s := os.Getenv("CATALOG_ADMIN_TOKENS")
+	if s == "" {
+		return
+	}
+	tokens, err := parseAdminTokens(s)
+	if err != nil {
+		log.Fatalf("failed to parse CATALOG_ADMIN_TOKENS: %v", err)
+	}
+	audit := newAuditLog(nil)
+	if path := os.Getenv("CATALOG_AUDIT_LOG"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("failed to open CATALOG_AUDIT_LOG: %v", err)
+		}
+		audit = newAuditLog(f)
+	}
+	svc.admin = newCatalogAdmin(store, w, tokens, os.Getenv("CATALOG_PICTURE_DIR"), audit)
+	log.Infof("catalog admin API enabled for %d admins", len(tokens))
+}
+
+// startCatalogWatcher reloads the catalog when its source changes, every
+// CATALOG_POLL_INTERVAL, and whenever the process receives SIGUSR1. SIGUSR2,
+// which used to turn off reloading on every request, is ignored.
+func startCatalogWatcher(svc *productCatalog, store CatalogStore) *catalogWatcher {
+	path, interval := watchedFile(store), defaultFilePollInterval
+	if path == "" {
+		interval = defaultDatabasePollInterval
+	}
+	if s := os.Getenv("CATALOG_POLL_INTERVAL"); s != "" {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("failed to parse CATALOG_POLL_INTERVAL (%s) as time.Duration: %+v", s, err)
+		}
+		interval = v
+	}
+	load := func() (*catalogIndex, error) {
+		return loadCatalog(context.Background(), store)
+	}
+	w := newCatalogWatcher(svc, load, path, interval)
+	go w.run(context.Background())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			log.Printf("Received signal: %s", sig)
+			if sig == syscall.SIGUSR1 {
+				w.reload()
+			}
+		}
+	}()
+	return w
+}
+
+// initStats exports metrics, such as catalog reloads and circuit breaker
+// states, to the collector every minute.
+func initStats() error {
+	var (
+		collectorAddr string
+		collectorConn *grpc.ClientConn
+	)
+
+	ctx := context.Background()
+
+	mustMapEnv(&collectorAddr, "COLLECTOR_SERVICE_ADDR")
+	mustConnGRPC(&collectorConn, collectorAddr)
+
+	exporter, err := otlpmetricgrpc.New(
+		ctx,
+		otlpmetricgrpc.WithGRPCConn(collectorConn))
+	if err != nil {
+		return err
+	}
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)))
+	otel.SetMeterProvider(mp)
+	return nil
 }
 
 func initTracing() error {
@@ -166,7 +254,7 @@ func initTracing() error {
 	ctx := context.Background()
 
 	mustMapEnv(&collectorAddr, "COLLECTOR_SERVICE_ADDR")
-	mustConnGRPC(ctx, &collectorConn, collectorAddr)
+	mustConnGRPC(&collectorConn, collectorAddr)
 
 	exporter, err := otlptracegrpc.New(
 		ctx,
@@ -209,12 +297,9 @@ func mustMapEnv(target *string, envKey string) {
 	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
+func mustConnGRPC(conn **grpc.ClientConn, addr string) {
 	var err error
-	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
-	defer cancel()
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	*conn, err = grpcclient.Dial(addr, log,
 		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
 		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()))
 	if err != nil {
@@ -14,7 +14,7 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 
-# [START gke_frontend_genproto]
+# [START gke_shared_genproto]
 
 PATH=$PATH:$(go env GOPATH)/bin
 protodir=../../protos
@@ -22,4 +22,4 @@ outdir=./genproto
 
 protoc --proto_path=$protodir --go_out=./$outdir --go_opt=paths=source_relative --go-grpc_out=./$outdir --go-grpc_opt=paths=source_relative $protodir/demo.proto
 
-# [END gke_frontend_genproto]
\ No newline at end of file
+# [END gke_shared_genproto]
\ No newline at end of file
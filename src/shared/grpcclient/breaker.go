@@ -0,0 +1,190 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultFailureThreshold is how many calls in a row must fail for a
+	// breaker to open, and defaultOpenDuration how long it then stays open
+	// before letting a call through to probe the target.
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 10 * time.Second
+)
+
+// breakerState is the state of a circuit breaker. Its value is what the
+// rpc.client.breaker.state metric reports.
+type breakerState int
+
+const (
+	// breakerClosed lets every call through.
+	breakerClosed breakerState = iota
+	// breakerHalfOpen lets one call through to find out whether the
+	// target has recovered.
+	breakerHalfOpen
+	// breakerOpen fails every call without sending it.
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// breaker is a circuit breaker for the calls to one target. Calls that fail
+// with UNAVAILABLE count as failures; calls that were cancelled or ran out of
+// time are ignored, and any other answer shows the target is up.
+type breaker struct {
+	target    string
+	threshold int
+	cooldown  time.Duration
+	log       Logger
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the breaker last opened
+	probing  bool      // whether the half-open probe is in flight
+
+	transitions metric.Int64Counter
+}
+
+func newBreaker(target string, threshold int, cooldown time.Duration, log Logger) *breaker {
+	b := &breaker{target: target, threshold: threshold, cooldown: cooldown, log: log, now: time.Now}
+	meter := otel.Meter("grpcclient")
+	transitions, err := meter.Int64Counter("rpc.client.breaker.transitions",
+		metric.WithDescription("Circuit breaker state changes, by target and new state."))
+	if err != nil {
+		otel.Handle(err)
+		transitions, _ = noop.Meter{}.Int64Counter("rpc.client.breaker.transitions")
+	}
+	b.transitions = transitions
+	gauge, err := meter.Int64ObservableGauge("rpc.client.breaker.state",
+		metric.WithDescription("Circuit breaker state by target: 0 closed, 1 half-open, 2 open."))
+	if err == nil {
+		_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+			b.mu.Lock()
+			state := b.state
+			b.mu.Unlock()
+			o.ObserveInt64(gauge, int64(state), metric.WithAttributes(attribute.String("target", target)))
+			return nil
+		}, gauge)
+	}
+	if err != nil {
+		otel.Handle(err)
+	}
+	return b
+}
+
+// allow reports whether a call may be sent, returning the error to fail it
+// with if not, and whether the call is the probe of a half-open breaker.
+// Each allowed call must be followed by a call to done.
+func (b *breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			break
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			break
+		}
+		b.probing = true
+		return true, nil
+	default:
+		return false, nil
+	}
+	return false, status.Errorf(codes.Unavailable, "circuit breaker for %s is open", b.target)
+}
+
+// done records the outcome of a call that allow let through.
+func (b *breaker) done(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable:
+		if probe {
+			b.trip()
+		} else if b.state == breakerClosed {
+			if b.failures++; b.failures >= b.threshold {
+				b.trip()
+			}
+		}
+	case codes.Canceled, codes.DeadlineExceeded:
+		// The caller gave up, or ran out of its own budget, which may be
+		// shorter than the target needs; neither says the target is down.
+	default:
+		b.failures = 0
+		if probe {
+			b.setState(breakerClosed)
+		}
+	}
+}
+
+func (b *breaker) trip() {
+	b.failures = 0
+	b.openedAt = b.now()
+	b.setState(breakerOpen)
+}
+
+func (b *breaker) setState(s breakerState) {
+	if s == b.state {
+		return
+	}
+	b.state = s
+	b.transitions.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("target", b.target), attribute.String("state", s.String())))
+	if s == breakerOpen {
+		b.log.Warnf("circuit breaker for %s opened, failing calls for %v", b.target, b.cooldown)
+	} else {
+		b.log.Infof("circuit breaker for %s is %s", b.target, s)
+	}
+}
+
+func (b *breaker) unaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	err = invoker(ctx, method, req, reply, cc, opts...)
+	b.done(probe, err)
+	return err
+}
@@ -0,0 +1,220 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testLogger records what is logged to it.
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Infof(format string, args ...any) { l.add(format, args) }
+func (l *testLogger) Warnf(format string, args ...any) { l.add(format, args) }
+
+func (l *testLogger) add(format string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+var (
+	errUnavailable = status.Error(codes.Unavailable, "connection refused")
+	errNotFound    = status.Error(codes.NotFound, "no such product")
+)
+
+func newTestBreaker() (*breaker, *time.Time, *testLogger) {
+	log := &testLogger{}
+	b := newBreaker("catalog:3550", 3, time.Second, log)
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	return b, &now, log
+}
+
+// call runs one call that ends with err through b, and returns the error
+// the caller sees.
+func call(b *breaker, err error) error {
+	probe, rejected := b.allow()
+	if rejected != nil {
+		return rejected
+	}
+	b.done(probe, err)
+	return err
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b, _, log := newTestBreaker()
+	call(b, errUnavailable)
+	call(b, errUnavailable)
+	call(b, errNotFound) // the target answered, so the count starts over
+	call(b, errUnavailable)
+	call(b, errUnavailable)
+	if b.state != breakerClosed {
+		t.Fatalf("breaker is %v after two failures in a row, want closed", b.state)
+	}
+	call(b, errUnavailable)
+	if b.state != breakerOpen {
+		t.Fatalf("breaker is %v after three failures in a row, want open", b.state)
+	}
+	if err := call(b, nil); status.Code(err) != codes.Unavailable {
+		t.Errorf("call through an open breaker got %v, want UNAVAILABLE", err)
+	}
+	if !strings.Contains(log.String(), "circuit breaker for catalog:3550 opened") {
+		t.Errorf("opening was not logged, got %q", log)
+	}
+}
+
+func TestBreakerMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	defer otel.SetMeterProvider(otel.GetMeterProvider())
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+
+	b, _, _ := newTestBreaker()
+	for i := 0; i < 3; i++ {
+		call(b, errUnavailable)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	var opened, state int64 = -1, -1
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					if s, _ := dp.Attributes.Value("state"); m.Name == "rpc.client.breaker.transitions" && s.AsString() == "open" {
+						opened = dp.Value
+					}
+				}
+			case metricdata.Gauge[int64]:
+				for _, dp := range data.DataPoints {
+					if target, _ := dp.Attributes.Value("target"); m.Name == "rpc.client.breaker.state" && target.AsString() == "catalog:3550" {
+						state = dp.Value
+					}
+				}
+			}
+		}
+	}
+	if opened != 1 {
+		t.Errorf("got %d transitions to open, want 1", opened)
+	}
+	if state != int64(breakerOpen) {
+		t.Errorf("got state %d, want %d (open)", state, breakerOpen)
+	}
+}
+
+func TestBreakerIgnoresCancellation(t *testing.T) {
+	b, _, _ := newTestBreaker()
+	for i := 0; i < 5; i++ {
+		call(b, status.Error(codes.Canceled, "caller went away"))
+	}
+	if b.state != breakerClosed {
+		t.Errorf("breaker is %v after cancelled calls, want closed", b.state)
+	}
+}
+
+// TestBreakerIgnoresDeadlines checks that callers with short budgets do not
+// open the breaker of a healthy but slower target.
+func TestBreakerIgnoresDeadlines(t *testing.T) {
+	b, now, _ := newTestBreaker()
+	for i := 0; i < 5; i++ {
+		call(b, status.Error(codes.DeadlineExceeded, "too slow"))
+	}
+	if b.state != breakerClosed {
+		t.Errorf("breaker is %v after calls ran out of time, want closed", b.state)
+	}
+
+	// A probe that runs out of time leaves the breaker half-open.
+	for i := 0; i < 3; i++ {
+		call(b, errUnavailable)
+	}
+	*now = now.Add(time.Second)
+	call(b, status.Error(codes.DeadlineExceeded, "too slow"))
+	if b.state != breakerHalfOpen {
+		t.Errorf("breaker is %v after its probe ran out of time, want half-open", b.state)
+	}
+	if err := call(b, nil); err != nil || b.state != breakerClosed {
+		t.Errorf("next probe got %v and left the breaker %v, want it closed", err, b.state)
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		probe error
+		want  breakerState
+	}{
+		{"recovered", nil, breakerClosed},
+		{"answered with an error", errNotFound, breakerClosed},
+		{"still down", errUnavailable, breakerOpen},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, now, _ := newTestBreaker()
+			for i := 0; i < 3; i++ {
+				call(b, errUnavailable)
+			}
+
+			*now = now.Add(time.Second)
+			probe, err := b.allow()
+			if err != nil || !probe {
+				t.Fatalf("first call after the cooldown was not let through as a probe: %v", err)
+			}
+			if b.state != breakerHalfOpen {
+				t.Errorf("breaker is %v while probing, want half-open", b.state)
+			}
+			if _, err := b.allow(); status.Code(err) != codes.Unavailable {
+				t.Errorf("second call while probing got %v, want UNAVAILABLE", err)
+			}
+			b.done(probe, tc.probe)
+			if b.state != tc.want {
+				t.Errorf("breaker is %v after the probe, want %v", b.state, tc.want)
+			}
+		})
+	}
+}
+
+func TestBreakerCancelledProbe(t *testing.T) {
+	b, now, _ := newTestBreaker()
+	for i := 0; i < 3; i++ {
+		call(b, errUnavailable)
+	}
+	*now = now.Add(time.Second)
+	call(b, status.Error(codes.Canceled, "caller went away"))
+	if probe, err := b.allow(); err != nil || !probe {
+		t.Errorf("no new probe after a cancelled one: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcclient builds the connections the Go services use to call
+// each other. Every connection balances calls round-robin across the
+// addresses its target resolves to, retries idempotent calls that fail with
+// UNAVAILABLE, keeps idle transports alive, and stops calling a target
+// that keeps failing until it has had time to recover.
+package grpcclient
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+// retryableMethods are the calls that are safe to send more than once,
+// by service.
+var retryableMethods = map[string][]string{
+	"hipstershop.ProductCatalogService": {"ListProducts", "GetProduct", "GetProducts", "SearchProducts", "ListCategories"},
+	"hipstershop.CartService":           {"GetCart"},
+	"hipstershop.CurrencyService":       {"GetSupportedCurrencies", "Convert", "ConvertBatch"},
+	"hipstershop.ShippingService":       {"GetQuote", "TrackShipment"},
+	"hipstershop.RecommendationService": {"ListRecommendations"},
+	"hipstershop.AdService":             {"GetAds"},
+}
+
+// retryPolicy is how retryableMethods are retried. Only UNAVAILABLE is
+// retried: the call never reached the server or was refused before doing
+// any work, and a call that timed out has no deadline left to retry in.
+var retryPolicy = map[string]any{
+	"maxAttempts":          3,
+	"initialBackoff":       "0.1s",
+	"maxBackoff":           "1s",
+	"backoffMultiplier":    2,
+	"retryableStatusCodes": []string{"UNAVAILABLE"},
+}
+
+// keepaliveParams pings transports that have calls in flight but have been
+// quiet for a while, so that calls on a dead connection fail instead of
+// hanging.
+var keepaliveParams = keepalive.ClientParameters{
+	Time:    30 * time.Second,
+	Timeout: 10 * time.Second,
+}
+
+// Logger receives circuit breaker state changes. *logrus.Logger satisfies
+// it.
+type Logger interface {
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+}
+
+// Dial returns a connection to target. A host:port target is resolved
+// through DNS, so that calls are spread across every address it has. opts
+// are applied after the defaults; interceptors in them run before the
+// circuit breaker sees the call.
+func Dial(target string, log Logger, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	b := newBreaker(target, defaultFailureThreshold, defaultOpenDuration, log)
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(serviceConfig()),
+		grpc.WithKeepaliveParams(keepaliveParams),
+	}, opts...)
+	opts = append(opts, grpc.WithChainUnaryInterceptor(b.unaryClientInterceptor))
+	if !strings.Contains(target, ":///") {
+		target = "dns:///" + target
+	}
+	return grpc.NewClient(target, opts...)
+}
+
+// serviceConfig returns the JSON service config of every connection.
+func serviceConfig() string {
+	var names []map[string]string
+	for service, methods := range retryableMethods {
+		for _, m := range methods {
+			names = append(names, map[string]string{"service": service, "method": m})
+		}
+	}
+	config, err := json.Marshal(map[string]any{
+		"loadBalancingConfig": []any{map[string]any{"round_robin": map[string]any{}}},
+		"methodConfig": []any{map[string]any{
+			"name":        names,
+			"retryPolicy": retryPolicy,
+		}},
+		// Stop retrying when most calls are failing, so that retries do
+		// not pile onto a service that is already struggling.
+		"retryThrottling": map[string]any{"maxTokens": 10, "tokenRatio": 0.1},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(config)
+}
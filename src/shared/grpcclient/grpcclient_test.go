@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcclient
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// flakyCart fails every call with UNAVAILABLE while failures is positive,
+// counting the failures down, and counts the calls it gets.
+type flakyCart struct {
+	pb.UnimplementedCartServiceServer
+
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (f *flakyCart) answer() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		return status.Error(codes.Unavailable, "try again")
+	}
+	return nil
+}
+
+func (f *flakyCart) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	return &pb.Cart{UserId: req.UserId}, f.answer()
+}
+
+func (f *flakyCart) AddItem(ctx context.Context, req *pb.AddItemRequest) (*pb.Empty, error) {
+	return &pb.Empty{}, f.answer()
+}
+
+func dialFlakyCart(t *testing.T, fake *flakyCart) pb.CartServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterCartServiceServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := Dial("passthrough:///bufnet", &testLogger{},
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewCartServiceClient(conn)
+}
+
+func TestDialRetriesIdempotentCalls(t *testing.T) {
+	fake := &flakyCart{failures: 2}
+	cl := dialFlakyCart(t, fake)
+	if _, err := cl.GetCart(context.Background(), &pb.GetCartRequest{UserId: "u"}); err != nil {
+		t.Fatalf("GetCart failed despite retries: %v", err)
+	}
+	if fake.calls != 3 {
+		t.Errorf("the cart got %d calls, want 3", fake.calls)
+	}
+}
+
+func TestDialDoesNotRetryOtherCalls(t *testing.T) {
+	fake := &flakyCart{failures: 1}
+	cl := dialFlakyCart(t, fake)
+	if _, err := cl.AddItem(context.Background(), &pb.AddItemRequest{UserId: "u"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("AddItem got %v, want UNAVAILABLE", err)
+	}
+	if fake.calls != 1 {
+		t.Errorf("the cart got %d calls, want 1", fake.calls)
+	}
+}
+
+func TestDialOpensBreaker(t *testing.T) {
+	fake := &flakyCart{failures: 1 << 30}
+	cl := dialFlakyCart(t, fake)
+	ctx := context.Background()
+	for i := 0; i < defaultFailureThreshold; i++ {
+		cl.AddItem(ctx, &pb.AddItemRequest{UserId: "u"})
+	}
+	calls := fake.calls
+	_, err := cl.AddItem(ctx, &pb.AddItemRequest{UserId: "u"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("call through an open breaker got %v, want UNAVAILABLE", err)
+	}
+	if fake.calls != calls {
+		t.Error("a call went through an open breaker")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+// defaultMinorUnits is the number of decimal places of most ISO 4217
+// currencies.
+const defaultMinorUnits = 2
+
+// minorUnits lists the ISO 4217 currencies that do not use two decimal
+// places.
+var minorUnits = map[string]int{
+	"BHD": 3, "BIF": 0, "CLF": 4, "CLP": 0, "DJF": 0, "GNF": 0,
+	"IQD": 3, "ISK": 0, "JOD": 3, "JPY": 0, "KMF": 0, "KRW": 0,
+	"KWD": 3, "LYD": 3, "OMR": 3, "PYG": 0, "RWF": 0, "TND": 3,
+	"UGX": 0, "UYI": 0, "UYW": 4, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+}
+
+// MinorUnits returns the number of decimal places the currency is written
+// with, e.g. 2 for USD and 0 for JPY. Unknown currencies use 2.
+func MinorUnits(currencyCode string) int {
+	if n, ok := minorUnits[currencyCode]; ok {
+		return n
+	}
+	return defaultMinorUnits
+}
+
+// Format writes m as a decimal number with as many decimal places as its
+// currency uses, rounding half to even, e.g. "12.35" for USD or "1235" for
+// JPY. It does not include a currency symbol.
+func Format(m pb.Money) string {
+	decimals := MinorUnits(m.GetCurrencyCode())
+	if r, err := Round(m, decimals, RoundHalfEven); err == nil {
+		m = r
+	}
+	units, nanos := m.GetUnits(), m.GetNanos()
+	sign := ""
+	if units < 0 || nanos < 0 {
+		sign, units, nanos = "-", -units, -nanos
+	}
+	// uint64 keeps -math.MinInt64 positive.
+	if decimals == 0 {
+		return fmt.Sprintf("%s%d", sign, uint64(units))
+	}
+	minor := int64(nanos)
+	for i := decimals; i < 9; i++ {
+		minor /= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, uint64(units), decimals, minor)
+}
+
+// Parse reads a decimal amount such as "12.5" or "-3" in the given currency.
+// It accepts at most nine decimal places, and rejects exponents, fractions
+// and thousands separators.
+func Parse(s, currencyCode string) (pb.Money, error) {
+	neg := strings.HasPrefix(s, "-")
+	whole, frac, hasFrac := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if whole == "" || len(frac) > 9 || (hasFrac && frac == "") || !isDigits(whole) || !isDigits(frac) {
+		return pb.Money{}, ErrInvalidArgument
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return pb.Money{}, ErrOverflow
+	}
+	nanos := 0
+	if frac != "" {
+		nanos, _ = strconv.Atoi(frac + strings.Repeat("0", 9-len(frac)))
+	}
+	if neg {
+		units, nanos = -units, -nanos
+	}
+	return pb.Money{CurrencyCode: currencyCode, Units: units, Nanos: int32(nanos)}, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"math"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+func TestMinorUnits(t *testing.T) {
+	for code, want := range map[string]int{"USD": 2, "EUR": 2, "JPY": 0, "KWD": 3, "": 2, "ZZZ": 2} {
+		if got := MinorUnits(code); got != want {
+			t.Errorf("MinorUnits(%q) = %d, want %d", code, got, want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		in   pb.Money
+		want string
+	}{
+		{"USD", mmc(12, 340000000, "USD"), "12.34"},
+		{"USD leading zero", mmc(12, 50000000, "USD"), "12.05"},
+		{"USD rounds half to even", mmc(0, 125000000, "USD"), "0.12"},
+		{"USD rounds up", mmc(1, 999000000, "USD"), "2.00"},
+		{"unknown currency", mm(3, 0), "3.00"},
+		{"JPY", mmc(1234, 0, "JPY"), "1234"},
+		{"JPY rounds", mmc(1234, 500000000, "JPY"), "1234"},
+		{"KWD", mmc(1, 5000000, "KWD"), "1.005"},
+		{"negative", mmc(-1, -500000000, "EUR"), "-1.50"},
+		{"negative below one", mmc(0, -50000000, "EUR"), "-0.05"},
+		{"min", mmc(math.MinInt64, 0, "JPY"), "-9223372036854775808"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Format(tt.in); got != tt.want {
+				t.Errorf("Format(%v) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    pb.Money
+		wantErr error
+	}{
+		{"12.5", mmc(12, 500000000, "USD"), nil},
+		{"12", mmc(12, 0, "USD"), nil},
+		{"0.05", mmc(0, 50000000, "USD"), nil},
+		{"-1.25", mmc(-1, -250000000, "USD"), nil},
+		{"1.123456789", mmc(1, 123456789, "USD"), nil},
+		{"1.1234567891", pb.Money{}, ErrInvalidArgument},
+		{"1.", pb.Money{}, ErrInvalidArgument},
+		{".5", pb.Money{}, ErrInvalidArgument},
+		{"1e3", pb.Money{}, ErrInvalidArgument},
+		{"1,000", pb.Money{}, ErrInvalidArgument},
+		{"+1", pb.Money{}, ErrInvalidArgument},
+		{"", pb.Money{}, ErrInvalidArgument},
+		{"99999999999999999999", pb.Money{}, ErrOverflow},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in, "USD")
+		if err != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, want %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !AreEquals(got, tt.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package money
+
+import (
+	"errors"
+	"math"
+	"math/big"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+const (
+	nanosMin = -999999999
+	nanosMax = +999999999
+	nanosMod = 1000000000
+)
+
+var (
+	ErrInvalidValue        = errors.New("one of the specified money values is invalid")
+	ErrMismatchingCurrency = errors.New("mismatching currency codes")
+	ErrOverflow            = errors.New("result does not fit in a money value")
+	ErrDivisionByZero      = errors.New("division by zero")
+	ErrInvalidArgument     = errors.New("invalid argument")
+)
+
+// RoundingMode says how results that fall between two representable amounts
+// are rounded.
+type RoundingMode int
+
+const (
+	// RoundHalfEven rounds to the nearest amount, and ties to the even one
+	// (banker's rounding).
+	RoundHalfEven RoundingMode = iota
+	// RoundHalfUp rounds to the nearest amount, and ties away from zero.
+	RoundHalfUp
+	// RoundDown truncates towards zero.
+	RoundDown
+)
+
+// IsValid checks if specified value has a valid units/nanos signs and ranges.
+func IsValid(m pb.Money) bool {
+	return signMatches(m) && validNanos(m.GetNanos())
+}
+
+func signMatches(m pb.Money) bool {
+	return m.GetNanos() == 0 || m.GetUnits() == 0 || (m.GetNanos() < 0) == (m.GetUnits() < 0)
+}
+
+func validNanos(nanos int32) bool { return nanosMin <= nanos && nanos <= nanosMax }
+
+// IsZero returns true if the specified money value is equal to zero.
+func IsZero(m pb.Money) bool { return m.GetUnits() == 0 && m.GetNanos() == 0 }
+
+// IsPositive returns true if the specified money value is valid and is
+// positive.
+func IsPositive(m pb.Money) bool {
+	return IsValid(m) && m.GetUnits() > 0 || (m.GetUnits() == 0 && m.GetNanos() > 0)
+}
+
+// IsNegative returns true if the specified money value is valid and is
+// negative.
+func IsNegative(m pb.Money) bool {
+	return IsValid(m) && m.GetUnits() < 0 || (m.GetUnits() == 0 && m.GetNanos() < 0)
+}
+
+// AreSameCurrency returns true if values l and r have a currency code and
+// they are the same values.
+func AreSameCurrency(l, r pb.Money) bool {
+	return l.GetCurrencyCode() == r.GetCurrencyCode() && l.GetCurrencyCode() != ""
+}
+
+// AreEquals returns true if values l and r are the equal, including the
+// currency. This does not check validity of the provided values.
+func AreEquals(l, r pb.Money) bool {
+	return l.GetCurrencyCode() == r.GetCurrencyCode() &&
+		l.GetUnits() == r.GetUnits() && l.GetNanos() == r.GetNanos()
+}
+
+// Negate returns the same amount with the sign negated.
+func Negate(m pb.Money) pb.Money {
+	return pb.Money{
+		Units:        -m.GetUnits(),
+		Nanos:        -m.GetNanos(),
+		CurrencyCode: m.GetCurrencyCode()}
+}
+
+// Must panics if the given error is not nil. This can be used with other
+// functions like: "m := Must(Sum(a,b))".
+func Must(v pb.Money, err error) pb.Money {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Sum adds two values. Returns an error if one of the values are invalid or
+// currency codes are not matching (unless currency code is unspecified for
+// both).
+func Sum(l, r pb.Money) (pb.Money, error) {
+	if !IsValid(l) || !IsValid(r) {
+		return pb.Money{}, ErrInvalidValue
+	} else if l.GetCurrencyCode() != r.GetCurrencyCode() {
+		return pb.Money{}, ErrMismatchingCurrency
+	}
+	units := l.GetUnits() + r.GetUnits()
+	nanos := l.GetNanos() + r.GetNanos()
+	if (l.GetUnits() > 0 && r.GetUnits() > 0 && units < 0) ||
+		(l.GetUnits() < 0 && r.GetUnits() < 0 && units >= 0) {
+		return pb.Money{}, ErrOverflow
+	}
+
+	if units == 0 || (units > 0 && nanos >= 0) || (units < 0 && nanos <= 0) {
+		// same sign <units, nanos>
+		carry := int64(nanos / nanosMod)
+		if (carry > 0 && units == math.MaxInt64) || (carry < 0 && units == math.MinInt64) {
+			return pb.Money{}, ErrOverflow
+		}
+		units += carry
+		nanos = nanos % nanosMod
+	} else {
+		// different sign. nanos guaranteed to not to go over the limit
+		if units > 0 {
+			units--
+			nanos += nanosMod
+		} else {
+			units++
+			nanos -= nanosMod
+		}
+	}
+
+	return pb.Money{
+		Units:        units,
+		Nanos:        nanos,
+		CurrencyCode: l.GetCurrencyCode()}, nil
+}
+
+// MultiplySlow multiplies m by n. It panics if m is invalid or the result
+// overflows.
+//
+// Deprecated: use Multiply, which returns an error instead.
+func MultiplySlow(m pb.Money, n uint32) pb.Money {
+	return Must(Multiply(m, int64(n)))
+}
+
+// Multiply returns m multiplied by n.
+func Multiply(m pb.Money, n int64) (pb.Money, error) {
+	if !IsValid(m) {
+		return pb.Money{}, ErrInvalidValue
+	}
+	v := toNanos(m)
+	return fromNanos(v.Mul(v, big.NewInt(n)), m.GetCurrencyCode())
+}
+
+// MultiplyDecimal returns m multiplied by factor, a decimal number such as
+// "1.0825" or a fraction such as "3/4", rounded to the nearest nano with the
+// given mode. Use Round to round the result to whole cents.
+func MultiplyDecimal(m pb.Money, factor string, mode RoundingMode) (pb.Money, error) {
+	if !IsValid(m) {
+		return pb.Money{}, ErrInvalidValue
+	}
+	f, ok := new(big.Rat).SetString(factor)
+	if !ok {
+		return pb.Money{}, ErrInvalidArgument
+	}
+	v := toNanos(m)
+	v.Mul(v, f.Num())
+	q, err := divRound(v, f.Denom(), mode)
+	if err != nil {
+		return pb.Money{}, err
+	}
+	return fromNanos(q, m.GetCurrencyCode())
+}
+
+// Divide returns m divided by n, rounded to the nearest nano with the given
+// mode.
+func Divide(m pb.Money, n int64, mode RoundingMode) (pb.Money, error) {
+	if !IsValid(m) {
+		return pb.Money{}, ErrInvalidValue
+	}
+	q, err := divRound(toNanos(m), big.NewInt(n), mode)
+	if err != nil {
+		return pb.Money{}, err
+	}
+	return fromNanos(q, m.GetCurrencyCode())
+}
+
+// Round rounds m to the given number of decimal places (0 to 9) with the
+// given mode, e.g. Round(m, 2, RoundHalfEven) rounds to whole cents.
+func Round(m pb.Money, decimals int, mode RoundingMode) (pb.Money, error) {
+	if !IsValid(m) {
+		return pb.Money{}, ErrInvalidValue
+	}
+	unit, err := decimalUnit(decimals)
+	if err != nil {
+		return pb.Money{}, err
+	}
+	q, err := divRound(toNanos(m), unit, mode)
+	if err != nil {
+		return pb.Money{}, err
+	}
+	return fromNanos(q.Mul(q, unit), m.GetCurrencyCode())
+}
+
+// Allocate splits m into len(ratios) parts proportional to ratios, without
+// losing or creating money: the parts always add up to m. Each part is a
+// multiple of the given number of decimal places (0 to 9); the smallest units
+// left over after the proportional split go one each to the first parts with
+// a non-zero ratio. Any amount below the smallest unit goes to the first such
+// part. Use equal ratios, e.g. []int64{1, 1, 1}, to split m evenly.
+func Allocate(m pb.Money, ratios []int64, decimals int) ([]pb.Money, error) {
+	if !IsValid(m) {
+		return nil, ErrInvalidValue
+	}
+	unit, err := decimalUnit(decimals)
+	if err != nil {
+		return nil, err
+	}
+	total := new(big.Int)
+	for _, r := range ratios {
+		if r < 0 {
+			return nil, ErrInvalidArgument
+		}
+		total.Add(total, big.NewInt(r))
+	}
+	if total.Sign() == 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	units, rest := new(big.Int).QuoRem(toNanos(m), unit, new(big.Int))
+	shares := make([]*big.Int, len(ratios))
+	left := new(big.Int).Set(units)
+	for i, r := range ratios {
+		shares[i] = new(big.Int).Mul(units, big.NewInt(r))
+		shares[i].Quo(shares[i], total)
+		left.Sub(left, shares[i])
+	}
+	// left has the same sign as m and is smaller than the number of parts
+	// with a non-zero ratio.
+	step := big.NewInt(int64(left.Sign()))
+	first := true
+	for i, r := range ratios {
+		if r == 0 {
+			continue
+		}
+		if left.Sign() != 0 {
+			shares[i].Add(shares[i], step)
+			left.Sub(left, step)
+		}
+		shares[i].Mul(shares[i], unit)
+		if first {
+			shares[i].Add(shares[i], rest)
+			first = false
+		}
+	}
+
+	out := make([]pb.Money, len(ratios))
+	for i, s := range shares {
+		if out[i], err = fromNanos(s, m.GetCurrencyCode()); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// toNanos returns m as a number of nanos.
+func toNanos(m pb.Money) *big.Int {
+	v := big.NewInt(m.GetUnits())
+	v.Mul(v, big.NewInt(nanosMod))
+	return v.Add(v, big.NewInt(int64(m.GetNanos())))
+}
+
+// fromNanos converts a number of nanos back to a money value, or returns
+// ErrOverflow if the units do not fit in an int64.
+func fromNanos(v *big.Int, currencyCode string) (pb.Money, error) {
+	units, nanos := new(big.Int).QuoRem(v, big.NewInt(nanosMod), new(big.Int))
+	if !units.IsInt64() {
+		return pb.Money{}, ErrOverflow
+	}
+	return pb.Money{
+		Units:        units.Int64(),
+		Nanos:        int32(nanos.Int64()),
+		CurrencyCode: currencyCode}, nil
+}
+
+// decimalUnit returns the number of nanos in the smallest unit with the given
+// number of decimal places.
+func decimalUnit(decimals int) (*big.Int, error) {
+	if decimals < 0 || decimals > 9 {
+		return nil, ErrInvalidArgument
+	}
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(9-decimals)), nil), nil
+}
+
+// divRound returns n/d rounded to an integer with the given mode.
+func divRound(n, d *big.Int, mode RoundingMode) (*big.Int, error) {
+	if d.Sign() == 0 {
+		return nil, ErrDivisionByZero
+	}
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if r.Sign() == 0 {
+		return q, nil
+	}
+	// Compare the remainder with half the divisor to pick a direction.
+	twice := new(big.Int).Abs(r)
+	cmp := twice.Lsh(twice, 1).CmpAbs(d)
+	away := false
+	switch mode {
+	case RoundDown:
+	case RoundHalfUp:
+		away = cmp >= 0
+	case RoundHalfEven:
+		away = cmp > 0 || (cmp == 0 && q.Bit(0) == 1)
+	default:
+		return nil, ErrInvalidArgument
+	}
+	if away {
+		// The exact quotient is negative if n and d have different signs.
+		if n.Sign() != d.Sign() {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q, nil
+}
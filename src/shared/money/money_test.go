@@ -16,10 +16,11 @@ package money
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"testing"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
 )
 
 func mmc(u int64, n int32, c string) pb.Money { return pb.Money{Units: u, Nanos: n, CurrencyCode: c} }
@@ -230,6 +231,10 @@ func TestSum(t *testing.T) {
 		{"mixed (larger negative, with borrow)", args{mm(-11, -100000000), mm(2, 9000000 /*.09*/)}, mm(-9, -91000000 /*.091*/), nil},
 		{"0+negative", args{mm(0, 0), mm(-2, -100000000)}, mm(-2, -100000000), nil},
 		{"negative+0", args{mm(-2, -100000000), mm(0, 0)}, mm(-2, -100000000), nil},
+		{"0+positive nanos", args{mm(0, 0), mm(0, 400000000)}, mm(0, 400000000), nil},
+		{"0+negative nanos", args{mm(0, 0), mm(0, -400000000)}, mm(0, -400000000), nil},
+		{"nanos carry from zero units", args{mm(0, 600000000), mm(0, 600000000)}, mm(1, 200000000), nil},
+		{"mixed to zero units", args{mm(1, 500000000), mm(-1, -700000000)}, mm(0, -200000000), nil},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -243,3 +248,172 @@ func TestSum(t *testing.T) {
 		})
 	}
 }
+
+func TestSumOverflow(t *testing.T) {
+	if _, err := Sum(mm(math.MaxInt64, 500000000), mm(0, 500000000)); err != ErrOverflow {
+		t.Errorf("Sum(max, .5): expected err=%v, got=%v", ErrOverflow, err)
+	}
+	if _, err := Sum(mm(math.MinInt64+1, 0), mm(-2, 0)); err != ErrOverflow {
+		t.Errorf("Sum(min+1, -2): expected err=%v, got=%v", ErrOverflow, err)
+	}
+}
+
+func TestMultiply(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       pb.Money
+		n       int64
+		want    pb.Money
+		wantErr error
+	}{
+		{"by zero", mmc(3, 500000000, "USD"), 0, mmc(0, 0, "USD"), nil},
+		{"by one", mmc(3, 500000000, "USD"), 1, mmc(3, 500000000, "USD"), nil},
+		{"carry", mmc(3, 500000000, "USD"), 3, mmc(10, 500000000, "USD"), nil},
+		{"negative factor", mm(3, 500000000), -2, mm(-7, 0), nil},
+		{"negative value", mm(-1, -990000000), 1000, mm(-1990, 0), nil},
+		{"large", mm(1<<40, 0), 1 << 22, mm(1<<62, 0), nil},
+		{"Error: invalid", mm(1, -1), 2, mm(0, 0), ErrInvalidValue},
+		{"Error: overflow", mm(1<<40, 0), 1 << 23, mm(0, 0), ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Multiply(tt.m, tt.n)
+			if err != tt.wantErr {
+				t.Errorf("Multiply(%v, %d): expected err=%v got=%v", tt.m, tt.n, tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Multiply(%v, %d) = %v, want %v", tt.m, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiplyDecimal(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       pb.Money
+		factor  string
+		mode    RoundingMode
+		want    pb.Money
+		wantErr error
+	}{
+		{"exact", mm(10, 0), "0.0825", RoundHalfEven, mm(0, 825000000), nil},
+		{"fraction", mm(10, 0), "3/4", RoundHalfEven, mm(7, 500000000), nil},
+		{"half-even rounds down", mm(0, 5), "0.5", RoundHalfEven, mm(0, 2), nil},
+		{"half-even rounds up", mm(0, 7), "0.5", RoundHalfEven, mm(0, 4), nil},
+		{"half-up", mm(0, 5), "0.5", RoundHalfUp, mm(0, 3), nil},
+		{"half-up negative", mm(0, -5), "0.5", RoundHalfUp, mm(0, -3), nil},
+		{"down", mm(0, 7), "0.5", RoundDown, mm(0, 3), nil},
+		{"down negative", mm(0, -7), "0.5", RoundDown, mm(0, -3), nil},
+		{"one third", mm(1, 0), "1/3", RoundHalfEven, mm(0, 333333333), nil},
+		{"Error: bad factor", mm(1, 0), "abc", RoundHalfEven, mm(0, 0), ErrInvalidArgument},
+		{"Error: overflow", mm(math.MaxInt64, 0), "1.5", RoundHalfEven, mm(0, 0), ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MultiplyDecimal(tt.m, tt.factor, tt.mode)
+			if err != tt.wantErr {
+				t.Errorf("MultiplyDecimal(%v, %s): expected err=%v got=%v", tt.m, tt.factor, tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MultiplyDecimal(%v, %s) = %v, want %v", tt.m, tt.factor, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDivide(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       pb.Money
+		n       int64
+		mode    RoundingMode
+		want    pb.Money
+		wantErr error
+	}{
+		{"exact", mm(10, 0), 4, RoundHalfEven, mm(2, 500000000), nil},
+		{"thirds", mm(10, 0), 3, RoundHalfEven, mm(3, 333333333), nil},
+		{"two thirds", mm(20, 0), 3, RoundHalfEven, mm(6, 666666667), nil},
+		{"two thirds down", mm(20, 0), 3, RoundDown, mm(6, 666666666), nil},
+		{"negative divisor", mm(20, 0), -3, RoundHalfUp, mm(-6, -666666667), nil},
+		{"Error: by zero", mm(1, 0), 0, RoundHalfEven, mm(0, 0), ErrDivisionByZero},
+		{"Error: overflow", mm(math.MinInt64, 0), -1, RoundHalfEven, mm(0, 0), ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Divide(tt.m, tt.n, tt.mode)
+			if err != tt.wantErr {
+				t.Errorf("Divide(%v, %d): expected err=%v got=%v", tt.m, tt.n, tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Divide(%v, %d) = %v, want %v", tt.m, tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		name     string
+		m        pb.Money
+		decimals int
+		mode     RoundingMode
+		want     pb.Money
+		wantErr  error
+	}{
+		{"half-even tie down", mm(0, 125000000), 2, RoundHalfEven, mm(0, 120000000), nil},
+		{"half-even tie up", mm(0, 135000000), 2, RoundHalfEven, mm(0, 140000000), nil},
+		{"half-up tie", mm(0, 125000000), 2, RoundHalfUp, mm(0, 130000000), nil},
+		{"half-up negative tie", mm(0, -125000000), 2, RoundHalfUp, mm(0, -130000000), nil},
+		{"down", mm(1, 999999999), 2, RoundDown, mm(1, 990000000), nil},
+		{"carry into units", mm(1, 999999999), 2, RoundHalfEven, mm(2, 0), nil},
+		{"whole units", mm(-2, -500000000), 0, RoundHalfEven, mm(-2, 0), nil},
+		{"nanos", mm(1, 1), 9, RoundDown, mm(1, 1), nil},
+		{"Error: decimals", mm(1, 0), 10, RoundHalfEven, mm(0, 0), ErrInvalidArgument},
+		{"Error: overflow", mm(math.MaxInt64, 900000000), 0, RoundHalfEven, mm(0, 0), ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Round(tt.m, tt.decimals, tt.mode)
+			if err != tt.wantErr {
+				t.Errorf("Round(%v, %d): expected err=%v got=%v", tt.m, tt.decimals, tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Round(%v, %d) = %v, want %v", tt.m, tt.decimals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name     string
+		m        pb.Money
+		ratios   []int64
+		decimals int
+		want     []pb.Money
+		wantErr  error
+	}{
+		{"even", mmc(10, 0, "USD"), []int64{1, 1}, 2, []pb.Money{mmc(5, 0, "USD"), mmc(5, 0, "USD")}, nil},
+		{"remainder", mm(10, 0), []int64{1, 1, 1}, 2, []pb.Money{mm(3, 340000000), mm(3, 330000000), mm(3, 330000000)}, nil},
+		{"negative", mm(-10, 0), []int64{1, 1, 1}, 2, []pb.Money{mm(-3, -340000000), mm(-3, -330000000), mm(-3, -330000000)}, nil},
+		{"ratios", mm(0, 50000000), []int64{3, 7}, 2, []pb.Money{mm(0, 20000000), mm(0, 30000000)}, nil},
+		{"zero ratio", mm(1, 0), []int64{0, 1, 2}, 2, []pb.Money{mm(0, 0), mm(0, 340000000), mm(0, 660000000)}, nil},
+		{"sub-cent goes to first", mm(1, 5000000), []int64{1, 1}, 2, []pb.Money{mm(0, 505000000), mm(0, 500000000)}, nil},
+		{"whole units", mm(7, 0), []int64{1, 1}, 0, []pb.Money{mm(4, 0), mm(3, 0)}, nil},
+		{"Error: no ratios", mm(1, 0), nil, 2, nil, ErrInvalidArgument},
+		{"Error: negative ratio", mm(1, 0), []int64{1, -1}, 2, nil, ErrInvalidArgument},
+		{"Error: invalid", mm(1, -1), []int64{1}, 2, nil, ErrInvalidValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Allocate(tt.m, tt.ratios, tt.decimals)
+			if err != tt.wantErr {
+				t.Errorf("Allocate(%v, %v): expected err=%v got=%v", tt.m, tt.ratios, tt.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Allocate(%v, %v) = %v, want %v", tt.m, tt.ratios, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracking generates and validates shipment tracking IDs.
+//
+// Tracking IDs pack a millisecond timestamp, the generating node and a
+// per-millisecond sequence number into 63 bits, written as 13 Crockford
+// base32 digits followed by a Luhn mod 32 check digit, grouped as
+// XXXXX-XXXXX-XXXX.
+package tracking
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nodeBits = 10
+	seqBits  = 12
+	// MaxNode is the largest node number a Generator accepts.
+	MaxNode = 1<<nodeBits - 1
+	maxSeq  = 1<<seqBits - 1
+
+	digits = 13
+	// alphabet is Crockford's base32: no I, L, O or U.
+	alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// epoch keeps the timestamp small enough for 41 bits until 2093.
+var epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrInvalid is returned for malformed tracking IDs.
+var ErrInvalid = errors.New("invalid tracking ID")
+
+// Generator creates tracking IDs that are unique as long as no two running
+// instances share a node number. It is safe for concurrent use.
+type Generator struct {
+	node uint64
+	now  func() time.Time
+
+	mu     sync.Mutex
+	lastMs int64
+	seq    uint64
+}
+
+// NewGenerator returns a generator for the given node, which must be at most
+// MaxNode.
+func NewGenerator(node uint16) (*Generator, error) {
+	if node > MaxNode {
+		return nil, errors.New("tracking node must be between 0 and 1023")
+	}
+	return &Generator{node: uint64(node), now: time.Now}, nil
+}
+
+// NewId generates a tracking ID.
+func (g *Generator) NewId() string {
+	g.mu.Lock()
+	ms := g.now().Sub(epoch).Milliseconds()
+	if ms < g.lastMs {
+		// The clock went backwards; keep counting from where it was.
+		ms = g.lastMs
+	}
+	if ms == g.lastMs {
+		g.seq++
+		if g.seq > maxSeq {
+			// Out of sequence numbers for this millisecond.
+			ms++
+			g.seq = 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMs = ms
+	v := uint64(ms)<<(nodeBits+seqBits) | g.node<<seqBits | g.seq
+	g.mu.Unlock()
+
+	var b [digits + 1]byte
+	for i := digits - 1; i >= 0; i-- {
+		b[i] = alphabet[v&31]
+		v >>= 5
+	}
+	b[digits] = checkDigit(string(b[:digits]))
+	s := string(b[:])
+	return s[:5] + "-" + s[5:10] + "-" + s[10:]
+}
+
+// Validate checks the format and check digit of a tracking ID. It accepts
+// lower case and ignores dashes and spaces, and returns the ID in its
+// canonical form.
+func Validate(id string) (string, error) {
+	s := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(id))
+	if len(s) != digits+1 {
+		return "", ErrInvalid
+	}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(alphabet, s[i]) < 0 {
+			return "", ErrInvalid
+		}
+	}
+	// 13 base32 digits hold 65 bits; IDs only use 63.
+	if strings.IndexByte(alphabet, s[0]) > 7 {
+		return "", ErrInvalid
+	}
+	if checkDigit(s[:digits]) != s[digits] {
+		return "", ErrInvalid
+	}
+	return s[:5] + "-" + s[5:10] + "-" + s[10:], nil
+}
+
+// checkDigit computes the Luhn mod 32 check digit, which catches any single
+// mistyped digit and most swapped pairs.
+func checkDigit(digits string) byte {
+	const n = len(alphabet)
+	sum, factor := 0, 2
+	for i := len(digits) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(alphabet, digits[i])
+		sum += addend/n + addend%n
+		factor = 3 - factor
+	}
+	return alphabet[(n-sum%n)%n]
+}
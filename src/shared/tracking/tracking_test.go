@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracking
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestIdsAreUnique generates IDs concurrently, within the same
+// millisecond, and across a clock that goes backwards.
+func TestIdsAreUnique(t *testing.T) {
+	g, err := NewGenerator(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, time.March, 4, 12, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	g.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(-time.Microsecond)
+		return now
+	}
+
+	const n = 10000
+	ids := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n/8; j++ {
+				ids <- g.NewId()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("duplicate tracking ID %s", id)
+		}
+		seen[id] = true
+		if _, err := Validate(id); err != nil {
+			t.Fatalf("generated invalid tracking ID %s: %v", id, err)
+		}
+	}
+	if _, err := NewGenerator(1024); err == nil {
+		t.Error("expected an error for node 1024")
+	}
+}
+
+// TestValidateCatchesTypos checks that the check digit rejects
+// every single-character substitution.
+func TestValidateCatchesTypos(t *testing.T) {
+	g, _ := NewGenerator(1)
+	id := g.NewId()
+	canonical, err := Validate(" " + strings.ToLower(strings.ReplaceAll(id, "-", "")) + " ")
+	if err != nil || canonical != id {
+		t.Fatalf("Validate(%q) = %q, %v; want %q", id, canonical, err, id)
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] == '-' {
+			continue
+		}
+		for _, c := range alphabet {
+			if byte(c) == id[i] {
+				continue
+			}
+			typo := id[:i] + string(c) + id[i+1:]
+			if _, err := Validate(typo); err == nil {
+				t.Errorf("Validate accepted %q (typo of %q)", typo, id)
+			}
+		}
+	}
+	for _, bad := range []string{"", "AB-123", id + "0", "IIIII-IIIII-IIII"} {
+		if _, err := Validate(bad); err == nil {
+			t.Errorf("Validate accepted %q", bad)
+		}
+	}
+}
@@ -15,9 +15,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/profiler"
@@ -29,7 +31,8 @@ import (
 	"google.golang.org/grpc/status"
 "github.com/joho/godotenv"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/tracking"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
@@ -89,7 +92,37 @@ func main() {
 		log.Info("Stats disabled.")
 		srv = grpc.NewServer()
 	}
-	svc := &server{}
+	rates, err := LoadRateTable(os.Getenv("SHIPPING_RATES_PATH"))
+	if err != nil {
+		log.Fatalf("failed to load shipping rates: %v", err)
+	}
+	node, err := trackingNodeFromEnv()
+	if err != nil {
+		log.Fatalf("failed to choose a tracking node: %v", err)
+	}
+	trackingIds, err := tracking.NewGenerator(node)
+	if err != nil {
+		log.Fatalf("failed to create tracking ID generator: %v", err)
+	}
+	log.Infof("generating tracking IDs as node %d", node)
+	svc := &server{rates: rates, trackingIds: trackingIds, shipments: newMemoryShipmentStore(), timeScale: 1}
+	if dir := os.Getenv("SHIPMENT_STORE_DIR"); dir != "" {
+		store, err := newFileShipmentStore(dir)
+		if err != nil {
+			log.Fatalf("failed to open shipment store %q: %v", dir, err)
+		}
+		svc.shipments = store
+		log.Infof("persisting shipments to %q", dir)
+	} else {
+		log.Info("SHIPMENT_STORE_DIR not set, shipments will not survive restarts")
+	}
+	if v := os.Getenv("SHIPMENT_TIME_SCALE"); v != "" {
+		scale, err := strconv.ParseFloat(v, 64)
+		if err != nil || scale <= 0 {
+			log.Fatalf("SHIPMENT_TIME_SCALE must be a positive number, got %q", v)
+		}
+		svc.timeScale = scale
+	}
 	pb.RegisterShippingServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
 	log.Infof("Shipping Service listening on port %s", port)
@@ -104,6 +137,12 @@ func main() {
 // server controls RPC service responses.
 type server struct {
 	pb.UnimplementedShippingServiceServer
+
+	rates       *RateTable
+	trackingIds *tracking.Generator
+	shipments   ShipmentStore
+	// timeScale speeds up simulated shipments.
+	timeScale float64
 }
 
 // Check is for health checking.
@@ -115,22 +154,35 @@ func (s *server) Watch(req *healthpb.HealthCheckRequest, ws healthpb.Health_Watc
 	return status.Errorf(codes.Unimplemented, "health check via Watch not implemented")
 }
 
-// GetQuote produces a shipping quote (cost) in USD.
+// GetQuote produces a shipping quote (cost) in USD for each shipping method.
 func (s *server) GetQuote(ctx context.Context, in *pb.GetQuoteRequest) (*pb.GetQuoteResponse, error) {
 	log.Info("[GetQuote] received request")
 	defer log.Info("[GetQuote] completed request")
 
-	// 1. Generate a quote based on the total number of items to be shipped.
-	quote := CreateQuoteFromCount(0)
+	// 1. Generate quotes based on the items to be shipped and their destination.
+	subtotal := float64(in.GetSubtotalUsd().GetUnits()) + float64(in.GetSubtotalUsd().GetNanos())/1e9
+	quote := s.rates.CreateQuote(in.Address, in.Items, subtotal)
+	options := s.rates.ShippingOptions(in.Address, in.Items, subtotal, time.Now())
 
 	// 2. Generate a response.
-	return &pb.GetQuoteResponse{
-		CostUsd: &pb.Money{
-			CurrencyCode: "USD",
-			Units:        int64(quote.Dollars),
-			Nanos:        int32(quote.Cents * 10000000)},
-	}, nil
+	resp := &pb.GetQuoteResponse{CostUsd: quoteToMoney(quote)}
+	for _, o := range options {
+		resp.Options = append(resp.Options, &pb.ShippingOption{
+			MethodId:             o.Method.ID,
+			CostUsd:              quoteToMoney(o.Quote),
+			Carrier:              o.Method.Carrier,
+			EarliestDeliveryDate: o.Earliest.Format(time.DateOnly),
+			LatestDeliveryDate:   o.Latest.Format(time.DateOnly),
+		})
+	}
+	return resp, nil
+}
 
+func quoteToMoney(q Quote) *pb.Money {
+	return &pb.Money{
+		CurrencyCode: "USD",
+		Units:        int64(q.Dollars),
+		Nanos:        int32(q.Cents * 10000000)}
 }
 
 // ShipOrder mocks that the requested items will be shipped.
@@ -138,16 +190,66 @@ func (s *server) GetQuote(ctx context.Context, in *pb.GetQuoteRequest) (*pb.GetQ
 func (s *server) ShipOrder(ctx context.Context, in *pb.ShipOrderRequest) (*pb.ShipOrderResponse, error) {
 	log.Info("[ShipOrder] received request")
 	defer log.Info("[ShipOrder] completed request")
+	method, ok := s.rates.Method(in.ShippingMethodId)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown shipping method %q", in.ShippingMethodId)
+	}
 	// 1. Create a Tracking ID
-	baseAddress := fmt.Sprintf("%s, %s, %s", in.Address.StreetAddress, in.Address.City, in.Address.State)
-	id := CreateTrackingId(baseAddress)
+	id := s.trackingIds.NewId()
 
-	// 2. Generate a response.
+	// 2. Start tracking the shipment.
+	now := time.Now()
+	shipment := NewShipment(id, method, in.Address, now, s.rates.DeliveryDate(method, in.Address, now), s.timeScale)
+	if err := s.shipments.Save(shipment); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save shipment: %v", err)
+	}
+
+	// 3. Generate a response.
 	return &pb.ShipOrderResponse{
 		TrackingId: id,
 	}, nil
 }
 
+// TrackShipment returns the history of a shipment.
+func (s *server) TrackShipment(ctx context.Context, in *pb.TrackShipmentRequest) (*pb.TrackShipmentResponse, error) {
+	log.Info("[TrackShipment] received request")
+	defer log.Info("[TrackShipment] completed request")
+
+	id, err := tracking.Validate(in.TrackingId)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%q is not a valid tracking ID", in.TrackingId)
+	}
+	shipment, err := s.shipments.Get(id)
+	if errors.Is(err, errShipmentNotFound) {
+		return nil, status.Errorf(codes.NotFound, "no shipment with tracking ID %q", in.TrackingId)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load shipment: %v", err)
+	}
+	if shipment.Advance(time.Now()) {
+		if err := s.shipments.Save(shipment); err != nil {
+			log.Warnf("failed to save shipment %q: %v", shipment.TrackingID, err)
+		}
+	}
+
+	resp := &pb.TrackShipmentResponse{
+		TrackingId:       shipment.TrackingID,
+		Status:           shipment.Status(),
+		ShippingMethodId: shipment.MethodID,
+		Carrier:          shipment.Carrier,
+	}
+	if !shipment.DeliveryDate.IsZero() {
+		resp.EstimatedDeliveryDate = shipment.DeliveryDate.Format(time.DateOnly)
+	}
+	for _, e := range shipment.Events {
+		resp.Events = append(resp.Events, &pb.ShipmentEvent{
+			Status:      e.Status,
+			TimeUnix:    e.Time.Unix(),
+			Description: e.Description,
+		})
+	}
+	return resp, nil
+}
+
 func initStats() {
 	//TODO(arbrown) Implement OpenTelemetry stats
 }
@@ -27,19 +27,19 @@ type Quote struct {
 
 // String representation of the Quote.
 func (q Quote) String() string {
-	return fmt.Sprintf("$%d.%d", q.Dollars, q.Cents)
+	return fmt.Sprintf("$%d.%02d", q.Dollars, q.Cents)
 }
 
-// CreateQuoteFromCount takes a number of items and returns a Price struct.
-func CreateQuoteFromCount(count int) Quote {
-	return CreateQuoteFromFloat(8.99)
+func (q Quote) cents() uint32 {
+	return q.Dollars*100 + q.Cents
 }
 
-// CreateQuoteFromFloat takes a price represented as a float and creates a Price struct.
+// CreateQuoteFromFloat takes a price represented as a float and creates a Price struct,
+// rounded to the nearest cent.
 func CreateQuoteFromFloat(value float64) Quote {
-	units, fraction := math.Modf(value)
+	cents := uint32(math.Round(value * 100))
 	return Quote{
-		uint32(units),
-		uint32(math.Trunc(fraction * 100)),
+		cents / 100,
+		cents % 100,
 	}
 }
\ No newline at end of file
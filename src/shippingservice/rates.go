@@ -0,0 +1,258 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+// defaultRatesJSON is used when SHIPPING_RATES_PATH is not set.
+//
+//go:embed rates.json
+var defaultRatesJSON []byte
+
+// PackagingInfo describes one unit of a product as shipped. Weight is in
+// kilograms and dimensions in centimeters. It has the same shape as the
+// frontend's PackagingInfo.
+type PackagingInfo struct {
+	Weight float64 `json:"weight"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Depth  float64 `json:"depth"`
+}
+
+// Zone is a group of destination countries sharing the same rates.
+type Zone struct {
+	Name string `json:"name"`
+	// Countries are matched case-insensitively against Address.country and
+	// may be either ISO codes or names.
+	Countries []string `json:"countries"`
+
+	BaseUSD    float64 `json:"base_usd"`
+	PerItemUSD float64 `json:"per_item_usd"`
+	PerKgUSD   float64 `json:"per_kg_usd"`
+	// FreeShippingThresholdUSD waives shipping with the default method for
+	// orders worth at least this much. Zero disables free shipping.
+	FreeShippingThresholdUSD float64 `json:"free_shipping_threshold_usd"`
+	// ExtraTransitDays is added to every method's delivery estimate.
+	ExtraTransitDays int `json:"extra_transit_days"`
+}
+
+// ShippingMethod is a delivery speed offered by a carrier.
+type ShippingMethod struct {
+	ID      string `json:"id"`
+	Carrier string `json:"carrier"`
+	// Multiplier is applied to the zone's rates.
+	Multiplier float64 `json:"multiplier"`
+	// MinDays and MaxDays are the transit time in business days.
+	MinDays int `json:"min_days"`
+	MaxDays int `json:"max_days"`
+}
+
+// ShippingOption is a priced shipping method with its delivery window.
+type ShippingOption struct {
+	Method   *ShippingMethod
+	Quote    Quote
+	Earliest time.Time
+	Latest   time.Time
+}
+
+// RateTable prices shipments by item count, billable weight and destination.
+type RateTable struct {
+	// DimensionalDivisor converts a package's volume (cm³) to its
+	// dimensional weight (kg). Packages are billed on the larger of their
+	// actual and dimensional weights.
+	DimensionalDivisor float64                  `json:"dimensional_divisor"`
+	DefaultPackage     PackagingInfo            `json:"default_package"`
+	Packages           map[string]PackagingInfo `json:"packages"`
+	// EstimateZone is used when no destination country is given, e.g. for
+	// the estimate shown on the cart page.
+	EstimateZone string `json:"estimate_zone"`
+	// DefaultZone is used for countries not listed in any zone.
+	DefaultZone string `json:"default_zone"`
+	Zones       []Zone `json:"zones"`
+
+	// DefaultMethod is used when the shopper has not picked a method.
+	DefaultMethod string           `json:"default_method"`
+	Methods       []ShippingMethod `json:"methods"`
+
+	byCountry map[string]*Zone
+	byName    map[string]*Zone
+	byMethod  map[string]*ShippingMethod
+}
+
+// LoadRateTable reads the rate table at path, or the built-in table if path
+// is empty.
+func LoadRateTable(path string) (*RateTable, error) {
+	if path == "" {
+		return ParseRateTable(defaultRatesJSON)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRateTable(b)
+}
+
+func ParseRateTable(b []byte) (*RateTable, error) {
+	t := new(RateTable)
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, fmt.Errorf("failed to parse rate table: %w", err)
+	}
+	if t.DimensionalDivisor <= 0 {
+		return nil, fmt.Errorf("dimensional_divisor must be positive")
+	}
+	t.byCountry = make(map[string]*Zone)
+	t.byName = make(map[string]*Zone)
+	for i := range t.Zones {
+		z := &t.Zones[i]
+		if z.BaseUSD < 0 || z.PerItemUSD < 0 || z.PerKgUSD < 0 || z.FreeShippingThresholdUSD < 0 {
+			return nil, fmt.Errorf("zone %q has a negative rate", z.Name)
+		}
+		if _, ok := t.byName[z.Name]; ok {
+			return nil, fmt.Errorf("duplicate zone %q", z.Name)
+		}
+		t.byName[z.Name] = z
+		for _, c := range z.Countries {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if other, ok := t.byCountry[c]; ok {
+				return nil, fmt.Errorf("country %q is in both zone %q and %q", c, other.Name, z.Name)
+			}
+			t.byCountry[c] = z
+		}
+	}
+	for _, name := range []string{t.DefaultZone, t.EstimateZone} {
+		if _, ok := t.byName[name]; !ok {
+			return nil, fmt.Errorf("unknown zone %q", name)
+		}
+	}
+	t.byMethod = make(map[string]*ShippingMethod)
+	for i := range t.Methods {
+		m := &t.Methods[i]
+		if m.Multiplier <= 0 || m.MinDays < 0 || m.MaxDays < m.MinDays {
+			return nil, fmt.Errorf("method %q has an invalid multiplier or delivery window", m.ID)
+		}
+		if _, ok := t.byMethod[m.ID]; ok {
+			return nil, fmt.Errorf("duplicate method %q", m.ID)
+		}
+		t.byMethod[m.ID] = m
+	}
+	if _, ok := t.byMethod[t.DefaultMethod]; !ok {
+		return nil, fmt.Errorf("unknown method %q", t.DefaultMethod)
+	}
+	return t, nil
+}
+
+// Method looks up a shipping method by ID. The empty ID is the default
+// method.
+func (t *RateTable) Method(id string) (*ShippingMethod, bool) {
+	if id == "" {
+		id = t.DefaultMethod
+	}
+	m, ok := t.byMethod[id]
+	return m, ok
+}
+
+// ZoneFor returns the zone that ships to address.
+func (t *RateTable) ZoneFor(address *pb.Address) *Zone {
+	country := strings.ToLower(strings.TrimSpace(address.GetCountry()))
+	if country == "" {
+		return t.byName[t.EstimateZone]
+	}
+	if z, ok := t.byCountry[country]; ok {
+		return z
+	}
+	return t.byName[t.DefaultZone]
+}
+
+// BillableWeight returns the total weight, in kilograms, charged for items.
+func (t *RateTable) BillableWeight(items []*pb.CartItem) float64 {
+	var kg float64
+	for _, item := range items {
+		p, ok := t.Packages[item.GetProductId()]
+		if !ok {
+			p = t.DefaultPackage
+		}
+		w := math.Max(p.Weight, p.Width*p.Height*p.Depth/t.DimensionalDivisor)
+		kg += w * float64(item.GetQuantity())
+	}
+	return kg
+}
+
+// CreateQuote prices shipping items to address with the default method.
+// subtotal is the value of the items in USD and only matters for
+// free-shipping thresholds.
+func (t *RateTable) CreateQuote(address *pb.Address, items []*pb.CartItem, subtotal float64) Quote {
+	return t.quote(t.byMethod[t.DefaultMethod], address, items, subtotal)
+}
+
+// ShippingOptions prices every shipping method, cheapest first. Delivery
+// windows are counted in business days from now.
+func (t *RateTable) ShippingOptions(address *pb.Address, items []*pb.CartItem, subtotal float64, now time.Time) []ShippingOption {
+	z := t.ZoneFor(address)
+	out := make([]ShippingOption, len(t.Methods))
+	for i := range t.Methods {
+		m := &t.Methods[i]
+		out[i] = ShippingOption{
+			Method:   m,
+			Quote:    t.quote(m, address, items, subtotal),
+			Earliest: addBusinessDays(now, m.MinDays+z.ExtraTransitDays),
+			Latest:   addBusinessDays(now, m.MaxDays+z.ExtraTransitDays),
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Quote.cents() < out[j].Quote.cents() })
+	return out
+}
+
+// DeliveryDate returns the latest date by which m delivers to address when
+// shipped at now.
+func (t *RateTable) DeliveryDate(m *ShippingMethod, address *pb.Address, now time.Time) time.Time {
+	return addBusinessDays(now, m.MaxDays+t.ZoneFor(address).ExtraTransitDays)
+}
+
+func (t *RateTable) quote(m *ShippingMethod, address *pb.Address, items []*pb.CartItem, subtotal float64) Quote {
+	count := 0
+	for _, item := range items {
+		count += int(item.GetQuantity())
+	}
+	if count == 0 {
+		return Quote{}
+	}
+	z := t.ZoneFor(address)
+	if m.ID == t.DefaultMethod && z.FreeShippingThresholdUSD > 0 && subtotal >= z.FreeShippingThresholdUSD {
+		return Quote{}
+	}
+	cost := z.BaseUSD + z.PerItemUSD*float64(count) + z.PerKgUSD*t.BillableWeight(items)
+	return CreateQuoteFromFloat(cost * m.Multiplier)
+}
+
+func addBusinessDays(t time.Time, days int) time.Time {
+	for days > 0 {
+		t = t.AddDate(0, 0, 1)
+		if wd := t.Weekday(); wd != time.Saturday && wd != time.Sunday {
+			days--
+		}
+	}
+	return t
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+)
+
+// shipmentLifecycle lists the states every shipment goes through, in order.
+var shipmentLifecycle = []pb.ShipmentStatus{
+	pb.ShipmentStatus_SHIPMENT_STATUS_LABEL_CREATED,
+	pb.ShipmentStatus_SHIPMENT_STATUS_PICKED_UP,
+	pb.ShipmentStatus_SHIPMENT_STATUS_IN_TRANSIT,
+	pb.ShipmentStatus_SHIPMENT_STATUS_OUT_FOR_DELIVERY,
+	pb.ShipmentStatus_SHIPMENT_STATUS_DELIVERED,
+}
+
+// Delivery happens on the delivery date between these hours (UTC).
+const (
+	outForDeliveryHour = 8
+	deliveredHour      = 14
+)
+
+// ShipmentEvent records a shipment entering a state.
+type ShipmentEvent struct {
+	Status      pb.ShipmentStatus `json:"status"`
+	Time        time.Time         `json:"time"`
+	Description string            `json:"description"`
+}
+
+// Shipment is a simulated parcel. Its Schedule is planned when the order
+// ships; Advance moves it through the lifecycle as the scheduled times pass.
+type Shipment struct {
+	TrackingID   string          `json:"tracking_id"`
+	MethodID     string          `json:"method_id"`
+	Carrier      string          `json:"carrier"`
+	City         string          `json:"city"`
+	DeliveryDate time.Time       `json:"delivery_date"`
+	Schedule     []ShipmentEvent `json:"schedule"`
+	Events       []ShipmentEvent `json:"events"`
+}
+
+// NewShipment plans a shipment created at now and delivered on
+// deliveryDate. timeScale speeds up the simulation: with a scale of 60 an
+// hour of shipping passes every minute.
+func NewShipment(trackingID string, method *ShippingMethod, address *pb.Address, now, deliveryDate time.Time, timeScale float64) *Shipment {
+	deliveryDay := time.Date(deliveryDate.Year(), deliveryDate.Month(), deliveryDate.Day(), 0, 0, 0, 0, time.UTC)
+	outForDelivery := deliveryDay.Add(outForDeliveryHour * time.Hour)
+	delivered := deliveryDay.Add(deliveredHour * time.Hour)
+	span := outForDelivery.Sub(now)
+
+	offsets := []time.Duration{
+		0,
+		span / 10,
+		span / 4,
+		span,
+		delivered.Sub(now),
+	}
+	s := &Shipment{
+		TrackingID:   trackingID,
+		MethodID:     method.ID,
+		Carrier:      method.Carrier,
+		City:         address.GetCity(),
+		DeliveryDate: deliveryDay,
+	}
+	for i, st := range shipmentLifecycle {
+		s.Schedule = append(s.Schedule, ShipmentEvent{
+			Status:      st,
+			Time:        now.Add(time.Duration(float64(offsets[i]) / timeScale)),
+			Description: s.describe(st),
+		})
+	}
+	s.Advance(now)
+	return s
+}
+
+func (s *Shipment) describe(st pb.ShipmentStatus) string {
+	switch st {
+	case pb.ShipmentStatus_SHIPMENT_STATUS_LABEL_CREATED:
+		return "Shipping label created"
+	case pb.ShipmentStatus_SHIPMENT_STATUS_PICKED_UP:
+		return fmt.Sprintf("Picked up by %s", s.Carrier)
+	case pb.ShipmentStatus_SHIPMENT_STATUS_IN_TRANSIT:
+		return "In transit"
+	case pb.ShipmentStatus_SHIPMENT_STATUS_OUT_FOR_DELIVERY:
+		if s.City != "" {
+			return fmt.Sprintf("Out for delivery in %s", s.City)
+		}
+		return "Out for delivery"
+	case pb.ShipmentStatus_SHIPMENT_STATUS_DELIVERED:
+		return "Delivered"
+	}
+	return st.String()
+}
+
+// Status returns the state the shipment is in.
+func (s *Shipment) Status() pb.ShipmentStatus {
+	if len(s.Events) == 0 {
+		return pb.ShipmentStatus_SHIPMENT_STATUS_UNSPECIFIED
+	}
+	return s.Events[len(s.Events)-1].Status
+}
+
+// Advance moves the shipment through every scheduled state whose time has
+// come. It reports whether the shipment changed state.
+func (s *Shipment) Advance(now time.Time) bool {
+	changed := false
+	for len(s.Events) < len(s.Schedule) {
+		next := s.Schedule[len(s.Events)]
+		if next.Time.After(now) {
+			break
+		}
+		s.Events = append(s.Events, next)
+		changed = true
+	}
+	return changed
+}
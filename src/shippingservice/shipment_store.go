@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var errShipmentNotFound = errors.New("shipment not found")
+
+// ShipmentStore persists shipments by tracking ID.
+type ShipmentStore interface {
+	Save(s *Shipment) error
+	// Get returns errShipmentNotFound if there is no such shipment.
+	Get(trackingID string) (*Shipment, error)
+}
+
+// memoryShipmentStore keeps shipments in memory; they are lost on restart.
+type memoryShipmentStore struct {
+	mu        sync.Mutex
+	shipments map[string][]byte
+}
+
+func newMemoryShipmentStore() *memoryShipmentStore {
+	return &memoryShipmentStore{shipments: make(map[string][]byte)}
+}
+
+func (m *memoryShipmentStore) Save(s *Shipment) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shipments[s.TrackingID] = b
+	return nil
+}
+
+func (m *memoryShipmentStore) Get(trackingID string) (*Shipment, error) {
+	m.mu.Lock()
+	b, ok := m.shipments[trackingID]
+	m.mu.Unlock()
+	if !ok {
+		return nil, errShipmentNotFound
+	}
+	s := new(Shipment)
+	return s, json.Unmarshal(b, s)
+}
+
+// fileShipmentStore keeps one JSON file per shipment in a directory.
+type fileShipmentStore struct {
+	dir string
+}
+
+func newFileShipmentStore(dir string) (*fileShipmentStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileShipmentStore{dir: dir}, nil
+}
+
+// path returns false for tracking IDs that would not name a file in dir.
+func (f *fileShipmentStore) path(trackingID string) (string, bool) {
+	if trackingID == "" || strings.ContainsAny(trackingID, `/\`) || strings.HasPrefix(trackingID, ".") {
+		return "", false
+	}
+	return filepath.Join(f.dir, trackingID+".json"), true
+}
+
+func (f *fileShipmentStore) Save(s *Shipment) error {
+	path, ok := f.path(s.TrackingID)
+	if !ok {
+		return fmt.Errorf("invalid tracking ID %q", s.TrackingID)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.dir, "shipment-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *fileShipmentStore) Get(trackingID string) (*Shipment, error) {
+	path, ok := f.path(trackingID)
+	if !ok {
+		return nil, errShipmentNotFound
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errShipmentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	s := new(Shipment)
+	return s, json.Unmarshal(b, s)
+}
@@ -15,16 +15,40 @@
 package main
 
 import (
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
-	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shared/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/tracking"
 )
 
+func mustLoadRates(t *testing.T) *RateTable {
+	t.Helper()
+	rates, err := LoadRateTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rates
+}
+
+func newTestServer(t *testing.T) *server {
+	trackingIds, err := tracking.NewGenerator(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &server{rates: mustLoadRates(t), trackingIds: trackingIds, shipments: newMemoryShipmentStore(), timeScale: 1}
+}
+
 // TestGetQuote is a basic check on the GetQuote RPC service.
 func TestGetQuote(t *testing.T) {
-	s := server{}
+	s := newTestServer(t)
 
 	// A basic test case to test logic and protobuf interactions.
 	req := &pb.GetQuoteRequest{
@@ -50,14 +74,94 @@ func TestGetQuote(t *testing.T) {
 	if err != nil {
 		t.Errorf("TestGetQuote (%v) failed", err)
 	}
-	if res.CostUsd.GetUnits() != 8 || res.CostUsd.GetNanos() != 990000000 {
-		t.Errorf("TestGetQuote: Quote value '%d.%d' does not match expected '%s'", res.CostUsd.GetUnits(), res.CostUsd.GetNanos(), "11.220000000")
+	// Europe: 14.99 base + 4 items * 1.00 + 2.4kg dimensional weight * 4.50.
+	if res.CostUsd.GetUnits() != 29 || res.CostUsd.GetNanos() != 790000000 {
+		t.Errorf("TestGetQuote: Quote value '%d.%d' does not match expected '%s'", res.CostUsd.GetUnits(), res.CostUsd.GetNanos(), "29.790000000")
+	}
+}
+
+// TestCreateQuote checks zone selection, billable weight and free shipping.
+func TestCreateQuote(t *testing.T) {
+	rates := mustLoadRates(t)
+	mugs := []*pb.CartItem{{ProductId: "6E92ZMYYFZ", Quantity: 2}}
+	tests := []struct {
+		name     string
+		address  *pb.Address
+		items    []*pb.CartItem
+		subtotal float64
+		want     string
+	}{
+		// 4.99 + 2 * 0.50 + 2 * 0.5kg * 1.50
+		{"domestic", &pb.Address{Country: "United States"}, mugs, 0, "$7.49"},
+		{"country code", &pb.Address{Country: "us"}, mugs, 0, "$7.49"},
+		{"no address uses estimate zone", nil, mugs, 0, "$7.49"},
+		// 19.99 + 2 * 1.50 + 2 * 0.5kg * 6.00
+		{"unlisted country", &pb.Address{Country: "Japan"}, mugs, 0, "$28.99"},
+		// 4.99 + 0.50 + 1.584kg dimensional weight * 1.50
+		{"dimensional weight", &pb.Address{Country: "US"}, []*pb.CartItem{{ProductId: "L9ECAV7KIM", Quantity: 1}}, 0, "$7.87"},
+		{"below free threshold", &pb.Address{Country: "US"}, mugs, 74.99, "$7.49"},
+		{"free shipping", &pb.Address{Country: "US"}, mugs, 75, "$0.00"},
+		{"no free shipping in zone", &pb.Address{Country: "Japan"}, mugs, 10000, "$28.99"},
+		{"no items", &pb.Address{Country: "US"}, nil, 0, "$0.00"},
+	}
+	for _, tt := range tests {
+		if got := rates.CreateQuote(tt.address, tt.items, tt.subtotal).String(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestParseRateTableRejectsBadConfig checks that rate table mistakes are
+// caught at startup.
+func TestParseRateTableRejectsBadConfig(t *testing.T) {
+	for name, config := range map[string]string{
+		"malformed":         `{`,
+		"no divisor":        `{"default_zone": "a", "estimate_zone": "a", "zones": [{"name": "a"}]}`,
+		"unknown zone":      `{"dimensional_divisor": 5000, "default_zone": "b", "estimate_zone": "a", "zones": [{"name": "a"}]}`,
+		"negative rate":     `{"dimensional_divisor": 5000, "default_zone": "a", "estimate_zone": "a", "zones": [{"name": "a", "base_usd": -1}]}`,
+		"duplicate country": `{"dimensional_divisor": 5000, "default_zone": "a", "estimate_zone": "a", "zones": [{"name": "a", "countries": ["US"]}, {"name": "b", "countries": ["us"]}]}`,
+		"unknown method":    `{"dimensional_divisor": 5000, "default_zone": "a", "estimate_zone": "a", "zones": [{"name": "a"}], "default_method": "x"}`,
+		"bad window":        `{"dimensional_divisor": 5000, "default_zone": "a", "estimate_zone": "a", "zones": [{"name": "a"}], "default_method": "x", "methods": [{"id": "x", "multiplier": 1, "min_days": 3, "max_days": 1}]}`,
+	} {
+		if _, err := ParseRateTable([]byte(config)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestShippingOptions checks that every method is offered with its own price
+// and delivery window.
+func TestShippingOptions(t *testing.T) {
+	rates := mustLoadRates(t)
+	mugs := []*pb.CartItem{{ProductId: "6E92ZMYYFZ", Quantity: 2}}
+	friday := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	options := rates.ShippingOptions(&pb.Address{Country: "US"}, mugs, 75, friday)
+	type option struct{ id, cost, earliest, latest string }
+	var got []option
+	for _, o := range options {
+		got = append(got, option{o.Method.ID, o.Quote.String(), o.Earliest.Format(time.DateOnly), o.Latest.Format(time.DateOnly)})
+	}
+	// Standard shipping is free above the threshold; the others are not.
+	want := []option{
+		{"standard", "$0.00", "2024-03-06", "2024-03-08"},
+		{"express", "$13.48", "2024-03-05", "2024-03-06"},
+		{"overnight", "$23.97", "2024-03-04", "2024-03-04"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got options %v, want %v", got, want)
+	}
+
+	// Further zones take longer.
+	options = rates.ShippingOptions(&pb.Address{Country: "Japan"}, mugs, 0, friday)
+	if got, want := options[0].Earliest.Format(time.DateOnly), "2024-03-12"; got != want {
+		t.Errorf("got earliest international delivery %s, want %s", got, want)
 	}
 }
 
 // TestShipOrder is a basic check on the ShipOrder RPC service.
 func TestShipOrder(t *testing.T) {
-	s := server{}
+	s := newTestServer(t)
 
 	// A basic test case to test logic and protobuf interactions.
 	req := &pb.ShipOrderRequest{
@@ -83,8 +187,183 @@ func TestShipOrder(t *testing.T) {
 	if err != nil {
 		t.Errorf("TestShipOrder (%v) failed", err)
 	}
-	// @todo improve quality of this test to check for a pattern such as '[A-Z]{2}-\d+-\d+'.
-	if len(res.TrackingId) != 18 {
-		t.Errorf("TestShipOrder: Tracking ID is malformed - has %d characters, %d expected", len(res.TrackingId), 18)
+	if _, err := tracking.Validate(res.TrackingId); err != nil {
+		t.Errorf("TestShipOrder: Tracking ID %q is malformed: %v", res.TrackingId, err)
+	}
+
+	req.ShippingMethodId = "teleport"
+	if _, err := s.ShipOrder(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("TestShipOrder: got %v for an unknown shipping method, want InvalidArgument", err)
+	}
+}
+
+// TestShipmentLifecycle checks that a shipment moves through every state in
+// order as time passes.
+func TestShipmentLifecycle(t *testing.T) {
+	rates := mustLoadRates(t)
+	method, _ := rates.Method("express")
+	monday := time.Date(2024, time.March, 4, 12, 0, 0, 0, time.UTC)
+	wednesday := time.Date(2024, time.March, 6, 0, 0, 0, 0, time.UTC)
+	s := NewShipment("ID", method, &pb.Address{City: "London"}, monday, wednesday, 1)
+
+	if got, want := s.Status(), pb.ShipmentStatus_SHIPMENT_STATUS_LABEL_CREATED; got != want {
+		t.Fatalf("got status %s, want %s", got, want)
+	}
+	if s.Advance(monday.Add(time.Minute)) {
+		t.Error("shipment advanced before its pickup time")
+	}
+	if !s.Advance(wednesday.Add(9 * time.Hour)) {
+		t.Fatal("shipment did not advance")
+	}
+	if got, want := s.Status(), pb.ShipmentStatus_SHIPMENT_STATUS_OUT_FOR_DELIVERY; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+	s.Advance(wednesday.Add(24 * time.Hour))
+	var got []pb.ShipmentStatus
+	for i, e := range s.Events {
+		got = append(got, e.Status)
+		if i > 0 && e.Time.Before(s.Events[i-1].Time) {
+			t.Errorf("event %s happened before %s", e.Status, s.Events[i-1].Status)
+		}
+	}
+	if !reflect.DeepEqual(got, shipmentLifecycle) {
+		t.Errorf("got events %v, want %v", got, shipmentLifecycle)
+	}
+	if got, want := s.Events[3].Description, "Out for delivery in London"; got != want {
+		t.Errorf("got description %q, want %q", got, want)
+	}
+}
+
+// TestShipmentTimeScale checks that a scaled simulation finishes early.
+func TestShipmentTimeScale(t *testing.T) {
+	rates := mustLoadRates(t)
+	method, _ := rates.Method("standard")
+	now := time.Date(2024, time.March, 4, 12, 0, 0, 0, time.UTC)
+	s := NewShipment("ID", method, nil, now, now.AddDate(0, 0, 7), 7*24*60)
+	s.Advance(now.Add(2 * time.Minute))
+	if got, want := s.Status(), pb.ShipmentStatus_SHIPMENT_STATUS_DELIVERED; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+}
+
+// TestTrackShipment checks that shipped orders can be tracked.
+func TestTrackShipment(t *testing.T) {
+	s := newTestServer(t)
+	shipped, err := s.ShipOrder(context.Background(), &pb.ShipOrderRequest{
+		Address: &pb.Address{City: "London", Country: "England"},
+		Items:   []*pb.CartItem{{ProductId: "23", Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.TrackShipment(context.Background(), &pb.TrackShipmentRequest{TrackingId: shipped.TrackingId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Status, pb.ShipmentStatus_SHIPMENT_STATUS_LABEL_CREATED; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+	if res.ShippingMethodId != "standard" || res.Carrier != "USPS" || len(res.Events) != 1 || res.EstimatedDeliveryDate == "" {
+		t.Errorf("got unexpected tracking response %v", res)
+	}
+
+	// The date is the one quoted, however fast the simulation runs.
+	s.timeScale = 7 * 24 * 60
+	shipped, err = s.ShipOrder(context.Background(), &pb.ShipOrderRequest{
+		Address: &pb.Address{City: "London", Country: "England"},
+		Items:   []*pb.CartItem{{ProductId: "23", Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scaled, err := s.TrackShipment(context.Background(), &pb.TrackShipmentRequest{TrackingId: shipped.TrackingId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scaled.EstimatedDeliveryDate != res.EstimatedDeliveryDate || scaled.EstimatedDeliveryDate == time.Now().Format(time.DateOnly) {
+		t.Errorf("got estimated delivery %s with a time scale, want %s", scaled.EstimatedDeliveryDate, res.EstimatedDeliveryDate)
+	}
+
+	// Tracking IDs are not case sensitive.
+	if _, err := s.TrackShipment(context.Background(), &pb.TrackShipmentRequest{TrackingId: strings.ToLower(shipped.TrackingId)}); err != nil {
+		t.Errorf("got %v for a lower case tracking ID", err)
+	}
+	unknown, _ := tracking.NewGenerator(2)
+	if _, err := s.TrackShipment(context.Background(), &pb.TrackShipmentRequest{TrackingId: unknown.NewId()}); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for an unknown tracking ID, want NotFound", err)
+	}
+	if _, err := s.TrackShipment(context.Background(), &pb.TrackShipmentRequest{TrackingId: "missing"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for a malformed tracking ID, want InvalidArgument", err)
+	}
+}
+
+// TestFileShipmentStore checks that shipments survive a restart.
+func TestFileShipmentStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileShipmentStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates := mustLoadRates(t)
+	method, _ := rates.Method("")
+	now := time.Now()
+	if err := store.Save(NewShipment("AB-123", method, nil, now, now.AddDate(0, 0, 3), 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = newFileShipmentStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.Get("AB-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Status(), pb.ShipmentStatus_SHIPMENT_STATUS_LABEL_CREATED; got != want {
+		t.Errorf("got status %s, want %s", got, want)
+	}
+	for _, id := range []string{"missing", "../AB-123", "/AB-123"} {
+		if _, err := store.Get(id); !errors.Is(err, errShipmentNotFound) {
+			t.Errorf("Get(%q): got %v, want %v", id, err, errShipmentNotFound)
+		}
+	}
+}
+
+func TestTrackingNodeFromEnv(t *testing.T) {
+	tests := []struct {
+		nodeId, replicas string
+		want             uint16
+		wantErr          bool
+	}{
+		{nodeId: "12", replicas: "3", want: 12},
+		{nodeId: "1024", wantErr: true},
+		{nodeId: "shipping-1", wantErr: true},
+		{replicas: "1", want: DefaultTrackingNode()},
+		{replicas: "3", wantErr: true},
+		{replicas: "none", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.nodeId+"/"+tt.replicas, func(t *testing.T) {
+			t.Setenv("SHIPPING_NODE_ID", tt.nodeId)
+			t.Setenv("SHIPPING_REPLICAS", tt.replicas)
+			got, err := trackingNodeFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("trackingNodeFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got node %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostOrdinal(t *testing.T) {
+	if n, err := hostOrdinal("shippingservice-12"); err != nil || n != 12 {
+		t.Errorf("hostOrdinal(shippingservice-12) = %d, %v; want 12", n, err)
+	}
+	for _, host := range []string{"shippingservice", "shippingservice-", "shippingservice-1024", "shippingservice-7f9c4"} {
+		if _, err := hostOrdinal(host); err == nil {
+			t.Errorf("hostOrdinal(%q) accepted a host name without an ordinal", host)
+		}
 	}
 }
@@ -15,42 +15,67 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
-	"time"
-)
-
-// seeded determines if the random number generator is ready.
-var seeded bool = false
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
 
-// CreateTrackingId generates a tracking ID.
-func CreateTrackingId(salt string) string {
-	if !seeded {
-		rand.Seed(time.Now().UnixNano())
-		seeded = true
-	}
+	"github.com/GoogleCloudPlatform/microservices-demo/src/shared/tracking"
+)
 
-	return fmt.Sprintf("%c%c-%d%s-%d%s",
-		getRandomLetterCode(),
-		getRandomLetterCode(),
-		len(salt),
-		getRandomNumber(3),
-		len(salt)/2,
-		getRandomNumber(7),
-	)
+// DefaultTrackingNode derives a node number from the host name and process
+// ID. Derived numbers can collide, so it is only suitable for a single
+// instance.
+func DefaultTrackingNode() uint16 {
+	h := fnv.New32a()
+	host, _ := os.Hostname()
+	h.Write([]byte(host))
+	pid := os.Getpid()
+	h.Write([]byte{byte(pid), byte(pid >> 8), byte(pid >> 16), byte(pid >> 24)})
+	return uint16(h.Sum32() % (tracking.MaxNode + 1))
 }
 
-// getRandomLetterCode generates a code point value for a capital letter.
-func getRandomLetterCode() uint32 {
-	return 65 + uint32(rand.Intn(25))
+// trackingNodeFromEnv returns the node number set by SHIPPING_NODE_ID,
+// either a number or "ordinal" for the ordinal at the end of a StatefulSet
+// pod's host name. Without it the node number is derived, which is refused
+// when SHIPPING_REPLICAS says more than one instance is running.
+func trackingNodeFromEnv() (uint16, error) {
+	v := os.Getenv("SHIPPING_NODE_ID")
+	if v == "" {
+		if r := os.Getenv("SHIPPING_REPLICAS"); r != "" {
+			replicas, err := strconv.Atoi(r)
+			if err != nil || replicas < 1 {
+				return 0, fmt.Errorf("SHIPPING_REPLICAS must be a positive number, got %q", r)
+			}
+			if replicas > 1 {
+				return 0, errors.New("SHIPPING_NODE_ID must be set when running more than one replica")
+			}
+		}
+		return DefaultTrackingNode(), nil
+	}
+	if v == "ordinal" {
+		host, err := os.Hostname()
+		if err != nil {
+			return 0, err
+		}
+		return hostOrdinal(host)
+	}
+	n, err := strconv.ParseUint(v, 10, 16)
+	if err != nil || n > tracking.MaxNode {
+		return 0, fmt.Errorf("SHIPPING_NODE_ID must be a number between 0 and 1023 or \"ordinal\", got %q", v)
+	}
+	return uint16(n), nil
 }
 
-// getRandomNumber generates a string representation of a number with the requested number of digits.
-func getRandomNumber(digits int) string {
-	str := ""
-	for i := 0; i < digits; i++ {
-		str = fmt.Sprintf("%s%d", str, rand.Intn(10))
+// hostOrdinal returns the ordinal a StatefulSet appends to its pods' host
+// names, as in shippingservice-2.
+func hostOrdinal(host string) (uint16, error) {
+	i := strings.LastIndexByte(host, '-')
+	n, err := strconv.ParseUint(host[i+1:], 10, 16)
+	if i < 0 || err != nil || n > tracking.MaxNode {
+		return 0, fmt.Errorf("host name %q does not end in an ordinal between 0 and 1023", host)
 	}
-
-	return str
+	return uint16(n), nil
 }